@@ -7,35 +7,138 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"time"
 )
 
 const CONNECTION_BASE = "http://localhost:3000/"
 
-// ClientSession has the main info to use the application
+// ClientSession has the main info to use the application.
+// Copies of a session share the same tokens
 type ClientSession struct {
+	tokens *sessionTokens
+}
+
+// sessionTokens are the tokens of a session
+type sessionTokens struct {
+	// authorization is the header to send (Bearer + access token)
 	authorization string
+	// refreshToken renews authorization once access token expires
+	refreshToken string
+	// mfaToken is the challenge token to send with the second factor, if login needs one
+	mfaToken string
+}
+
+// tokenPair is the server response for a login or a refresh (or a MFA challenge)
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	MFARequired  bool   `json:"mfa_required"`
+	MFAToken     string `json:"mfa_token"`
 }
 
-// Connect validates user auth info and sets the context (auth info) for the rest of the calls
+// Connect validates user auth info and sets the context (auth info) for the rest of the calls.
+// If user enabled a second factor, error is ErrMFARequired and session needs VerifyMFA
 func Connect(login, password string) (ClientSession, error) {
-	var result ClientSession
 	payload, errMarshal := json.Marshal(map[string]string{"name": login, "password": password})
 	if errMarshal != nil {
 		panic(errMarshal)
 	}
 
-	if resp, err := http.Post(CONNECTION_BASE+"login", "application/json", bytes.NewReader(payload)); err != nil {
-		return result, err
+	result := ClientSession{tokens: &sessionTokens{}}
+	return result, result.postTokens(CONNECTION_BASE+"login", payload)
+}
+
+// ConnectWithToken uses a personal access token for the rest of the calls (no login, no refresh)
+func ConnectWithToken(token string) ClientSession {
+	return ClientSession{tokens: &sessionTokens{authorization: "Bearer " + token}}
+}
+
+// postTokens posts payload to an url returning a token pair, and sets tokens of the session
+func (c *ClientSession) postTokens(url string, payload []byte) error {
+	if resp, err := http.Post(url, "application/json", bytes.NewReader(payload)); err != nil {
+		return err
+	} else {
+		defer resp.Body.Close()
+		var pair tokenPair
+		if body, err := io.ReadAll(resp.Body); err != nil {
+			return err
+		} else if resp.StatusCode >= 300 {
+			return decodeError(resp, body)
+		} else if err := json.Unmarshal(body, &pair); err != nil {
+			return err
+		} else if pair.MFARequired {
+			c.tokens.mfaToken = pair.MFAToken
+			return &ApiError{Status: resp.StatusCode, Code: ErrMFARequired.Code, Message: "second factor required"}
+		}
+
+		c.tokens.mfaToken = ""
+		c.tokens.authorization = "Bearer " + pair.AccessToken
+		c.tokens.refreshToken = pair.RefreshToken
+		return nil
+	}
+}
+
+// VerifyMFA sends the second factor (TOTP or recovery code) after a login returned ErrMFARequired
+func (c *ClientSession) VerifyMFA(code string) error {
+	if c.tokens.mfaToken == "" {
+		return errors.New("no pending second factor challenge")
+	} else if payload, err := json.Marshal(map[string]string{"mfa_token": c.tokens.mfaToken, "code": code}); err != nil {
+		return err
 	} else {
-		result.authorization = resp.Header.Get("Authorization")
-		return result, nil
+		return c.postTokens(CONNECTION_BASE+"login/mfa", payload)
+	}
+}
+
+// Refresh gets new tokens using the refresh token of the session
+func (c *ClientSession) Refresh() error {
+	if c.tokens.refreshToken == "" {
+		return errors.New("no refresh token")
+	} else if payload, err := json.Marshal(map[string]string{"refresh_token": c.tokens.refreshToken}); err != nil {
+		return err
+	} else {
+		return c.postTokens(CONNECTION_BASE+"token/refresh", payload)
+	}
+}
+
+// Logout revokes the tokens of the session
+func (c *ClientSession) Logout() error {
+	if payload, err := json.Marshal(map[string]string{"refresh_token": c.tokens.refreshToken}); err != nil {
+		return err
+	} else if _, err := c.callEndpoint("POST", CONNECTION_BASE+"logout", string(payload)); err != nil {
+		return err
 	}
+
+	c.tokens.refreshToken = ""
+	return nil
 }
 
-// callEndpoint is the low level http call mechanism
+// LogoutAll revokes all the tokens of current user, for any session
+func (c *ClientSession) LogoutAll() error {
+	if _, err := c.callEndpoint("POST", CONNECTION_BASE+"logout/all", ""); err != nil {
+		return err
+	}
+
+	c.tokens.refreshToken = ""
+	return nil
+}
+
+// callEndpoint is the low level http call mechanism.
+// If access token expired, tokens are refreshed once and call is made again
 func (c *ClientSession) callEndpoint(method, url string, body string) (string, error) {
+	payload, err := c.callEndpointOnce(method, url, body)
+	if errors.Is(err, ErrUnauthorized) && c.tokens.refreshToken != "" {
+		if errRefresh := c.Refresh(); errRefresh == nil {
+			return c.callEndpointOnce(method, url, body)
+		}
+	}
+
+	return payload, err
+}
+
+// callEndpointOnce makes the http call with current tokens
+func (c *ClientSession) callEndpointOnce(method, url string, body string) (string, error) {
 	client := http.Client{}
 	var request *http.Request
 	var payload io.Reader
@@ -51,24 +154,13 @@ func (c *ClientSession) callEndpoint(method, url string, body string) (string, e
 
 	request.Header = http.Header{
 		"Content-Type":  {"application/json"},
-		"Authorization": {c.authorization},
+		"Authorization": {c.tokens.authorization},
 	}
 
 	if resp, err := client.Do(request); err != nil {
-		// try and see what happened
-		defer resp.Body.Close()
-		if v, err := io.ReadAll(resp.Body); err != nil {
-			panic(err)
-		} else {
-			return string(v), err
-		}
+		// no response at all
+		return "", err
 	} else {
-		// Get new token (extended time)
-		newAuth := resp.Header.Get("Authorization")
-		if len(newAuth) > 0 {
-			c.authorization = newAuth
-		}
-
 		// read content
 		defer resp.Body.Close()
 		var payload string
@@ -79,7 +171,7 @@ func (c *ClientSession) callEndpoint(method, url string, body string) (string, e
 		}
 
 		if resp.StatusCode >= 300 {
-			return payload, fmt.Errorf("invalid call: %s", resp.Status)
+			return payload, decodeError(resp, []byte(payload))
 		} else {
 			return payload, nil
 		}
@@ -257,33 +349,25 @@ func (c *ClientSession) DeleteGroupOfUsers(groupName string) error {
 	return err
 }
 
-// Audit displays audit logs between two moments
+// AUDIT_DATE_LAYOUT is the format of dates of the audit period, as expected by the server
+const AUDIT_DATE_LAYOUT = "20060102"
+
+// Audit displays audit logs between two moments (zero time for no bound).
+// Server checks the period, failures are typed errors as for the other calls
 func (c *ClientSession) Audit(from, to time.Time) (string, error) {
-	url := CONNECTION_BASE + "audits/display"
-	var empty time.Time
-	var counter int
-	if empty.Compare(from) < 0 {
-		url = url + "?from=" + from.Format("20060102")
-		counter = 1
+	parameters := url.Values{}
+	if !from.IsZero() {
+		parameters.Set("from", from.Format(AUDIT_DATE_LAYOUT))
 	}
 
-	if to.Compare(empty) > 0 {
-		if counter != 0 {
-			url = url + "&to="
-		} else {
-			url = url + "?to="
-		}
-
-		url = url + to.Format("20060102")
-		counter = counter + 1
+	if !to.IsZero() {
+		parameters.Set("to", to.Format(AUDIT_DATE_LAYOUT))
 	}
 
-	// for two dates, test if they make sense
-	if counter >= 2 {
-		if from.Compare(to) > 0 {
-			return "", errors.New("period of time is invalid")
-		}
+	endpoint := CONNECTION_BASE + "audits/display"
+	if len(parameters) != 0 {
+		endpoint = endpoint + "?" + parameters.Encode()
 	}
 
-	return c.callEndpoint("GET", url, "")
+	return c.callEndpoint("GET", endpoint, "")
 }
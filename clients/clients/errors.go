@@ -0,0 +1,107 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ApiError is a failure sent back by the server.
+// Use errors.Is with the predefined errors (ErrNotFound, etc) to test the kind of failure
+type ApiError struct {
+	// Status is the http status of the response
+	Status int
+	// Code is the stable error code sent by the server
+	Code string
+	// Message is the message sent by the server
+	Message string
+	// CorrelationID is the id of the request, to find matching server logs
+	CorrelationID string
+}
+
+// Predefined errors, per error code
+var (
+	ErrBadRequest       = &ApiError{Code: "bad_request"}
+	ErrUnauthorized     = &ApiError{Code: "unauthorized"}
+	ErrForbidden        = &ApiError{Code: "forbidden"}
+	ErrMFARequired      = &ApiError{Code: "mfa_required"}
+	ErrNotFound         = &ApiError{Code: "not_found"}
+	ErrMethodNotAllowed = &ApiError{Code: "method_not_allowed"}
+	ErrConflict         = &ApiError{Code: "conflict"}
+	ErrTooManyRequests  = &ApiError{Code: "too_many_requests"}
+	ErrUnavailable      = &ApiError{Code: "unavailable"}
+	ErrInternal         = &ApiError{Code: "internal_error"}
+)
+
+// Error returns the content of the error
+func (e *ApiError) Error() string {
+	if e.CorrelationID != "" {
+		return fmt.Sprintf("%s (%d): %s [correlation id %s]", e.Code, e.Status, e.Message, e.CorrelationID)
+	}
+
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// Is returns true if target is an api error with the same code
+func (e *ApiError) Is(target error) bool {
+	if other, ok := target.(*ApiError); !ok {
+		return false
+	} else {
+		return other.Code == e.Code
+	}
+}
+
+// errorEnvelope is the json content the server sends for any failure
+type errorEnvelope struct {
+	Error struct {
+		Code          string `json:"code"`
+		Status        int    `json:"status"`
+		Message       string `json:"message"`
+		CorrelationID string `json:"correlation_id"`
+	} `json:"error"`
+}
+
+// decodeError builds an api error from a failed response and its body.
+// If body is not an error envelope, error is built from the status
+func decodeError(resp *http.Response, body []byte) error {
+	var envelope errorEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error.Code == "" {
+		return &ApiError{
+			Status:        resp.StatusCode,
+			Code:          codeForStatus(resp.StatusCode),
+			Message:       resp.Status,
+			CorrelationID: resp.Header.Get("X-Correlation-Id"),
+		}
+	}
+
+	return &ApiError{
+		Status:        resp.StatusCode,
+		Code:          envelope.Error.Code,
+		Message:       envelope.Error.Message,
+		CorrelationID: envelope.Error.CorrelationID,
+	}
+}
+
+// codeForStatus returns the error code to use when server sent no envelope
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrBadRequest.Code
+	case http.StatusUnauthorized:
+		return ErrUnauthorized.Code
+	case http.StatusForbidden:
+		return ErrForbidden.Code
+	case http.StatusNotFound:
+		return ErrNotFound.Code
+	case http.StatusMethodNotAllowed:
+		return ErrMethodNotAllowed.Code
+	case http.StatusConflict:
+		return ErrConflict.Code
+	case http.StatusTooManyRequests:
+		return ErrTooManyRequests.Code
+	case http.StatusServiceUnavailable:
+		return ErrUnavailable.Code
+	default:
+		return ErrInternal.Code
+	}
+}
@@ -1,7 +1,6 @@
 package clients
 
 import (
-	"fmt"
 	"io"
 	"net/http"
 )
@@ -25,10 +24,10 @@ func LoadStaticContent(path string) ([]byte, error) {
 	} else {
 		// read content
 		defer resp.Body.Close()
-		if resp.StatusCode >= 300 {
-			return nil, fmt.Errorf("invalid call: %s", resp.Status)
-		} else if body, err := io.ReadAll(resp.Body); err != nil {
+		if body, err := io.ReadAll(resp.Body); err != nil {
 			return nil, err
+		} else if resp.StatusCode >= 300 {
+			return nil, decodeError(resp, body)
 		} else {
 			return body, nil
 		}
@@ -119,4 +119,12 @@ func main() {
 
 	validateUserAuthSystem(session)
 	validateUsersGroups(session)
+
+	if err := session.Logout(); err != nil {
+		panic(err)
+	} else if _, err := session.GetUsername(); err == nil {
+		panic("session still valid after logout")
+	} else {
+		fmt.Println("Logged out")
+	}
 }
@@ -9,7 +9,7 @@ import "fmt"
 // GrantRole defines roles implemented
 type GrantRole string
 
-// Possible values are listed here
+// Built-in roles are listed here, other roles are defined in database
 const (
 	RoleRoot   GrantRole = "root"
 	RoleAdmin  GrantRole = "admin"
@@ -17,17 +17,14 @@ const (
 	RoleReader GrantRole = "reader"
 )
 
-// ParseGrantRole gets a string and returns matching role if any, or error
+// ParseGrantRole gets a string and returns matching role if any, or error.
+// Roles are the built-in ones and the roles loaded from database (see SetKnownRoles)
 func ParseGrantRole(value string) (GrantRole, error) {
-	switch value {
-	case string(RoleRoot):
-		return RoleRoot, nil
-	case string(RoleAdmin):
-		return RoleAdmin, nil
-	case string(RoleEditor):
-		return RoleEditor, nil
-	case string(RoleReader):
-		return RoleReader, nil
+	knownRoles.lock.RLock()
+	defer knownRoles.lock.RUnlock()
+
+	if _, found := knownRoles.values[GrantRole(value)]; found {
+		return GrantRole(value), nil
 	}
 
 	var empty GrantRole
@@ -64,9 +61,11 @@ const (
 	OperatorEquals     GrantOperator = "EQUALS"
 	OperatorStartsWith GrantOperator = "STARTS_WITH"
 	OperatorMatches    GrantOperator = "MATCHES"
+	OperatorContains   GrantOperator = "CONTAINS"
+	OperatorRegex      GrantOperator = "REGEX"
 )
 
-// ParseGrantOperator
+// ParseGrantOperator gets a string and returns matching operator if any, or error
 func ParseGrantOperator(value string) (GrantOperator, error) {
 	switch value {
 	case string(OperatorEquals):
@@ -75,12 +74,42 @@ func ParseGrantOperator(value string) (GrantOperator, error) {
 		return OperatorStartsWith, nil
 	case string(OperatorMatches):
 		return OperatorMatches, nil
+	case string(OperatorContains):
+		return OperatorContains, nil
+	case string(OperatorRegex):
+		return OperatorRegex, nil
 	}
 
 	var empty GrantOperator
 	return empty, fmt.Errorf("%s is not a grant operator", value)
 }
 
+////////////////////////////////////////////////////////////////
+// GRANT EFFECT IS WHETHER A MATCHING CONDITION GRANTS OR NOT //
+////////////////////////////////////////////////////////////////
+
+// GrantEffect is an enum to define what a matching condition does
+type GrantEffect string
+
+// Possible values are listed here
+const (
+	EffectAllow GrantEffect = "ALLOW"
+	EffectDeny  GrantEffect = "DENY"
+)
+
+// ParseGrantEffect gets a string and returns matching effect if any, or error
+func ParseGrantEffect(value string) (GrantEffect, error) {
+	switch value {
+	case string(EffectAllow):
+		return EffectAllow, nil
+	case string(EffectDeny):
+		return EffectDeny, nil
+	}
+
+	var empty GrantEffect
+	return empty, fmt.Errorf("%s is not a grant effect", value)
+}
+
 ////////////////////////////////////////////
 // GRANT ACCESS USER BASED ON A CONDITION //
 ////////////////////////////////////////////
@@ -93,4 +122,50 @@ type GrantAccessForResource struct {
 	Template string
 	// UserRoles are the roles this user may impersonate when accessing that page
 	UserRoles []GrantRole
+	// RequiresMFA is true if user should have used a second factor to access that page
+	RequiresMFA bool
+	// Methods are the http methods the condition applies to, empty for any method
+	Methods []string
+	// Effect is DENY if matching condition refuses access, ALLOW (or empty) otherwise
+	Effect GrantEffect
+}
+
+//////////////////////////////////////////////////////////
+// RESOURCE IS A PROTECTED TEMPLATE, WITHIN A FEATURE //
+//////////////////////////////////////////////////////////
+
+// Resource is a protected resource: a template to match urls, the feature it belongs to and the roles to access it
+type Resource struct {
+	// ID identifies the resource
+	ID int `json:"id"`
+	// Operator defining the resources condition (for instance EQUALS or MATCHES)
+	Operator GrantOperator `json:"operator"`
+	// Template is an URL or a regexp based template to accept a group of URL
+	Template string `json:"template"`
+	// Feature is the name of the group of resources this resource belongs to
+	Feature string `json:"feature"`
+	// Roles are the roles that may access the resource
+	Roles []GrantRole `json:"roles"`
+	// RequiresMFA is true if user should have used a second factor to access the resource
+	RequiresMFA bool `json:"requires_mfa"`
+	// Methods are the http methods the resource applies to, empty for any method
+	Methods []string `json:"methods,omitempty"`
+	// Effect is DENY if resource refuses access to its roles, ALLOW otherwise
+	Effect GrantEffect `json:"effect"`
+}
+
+//////////////////////////////////////////////
+// FEATURE IS A GROUP OF PROTECTED RESOURCES //
+//////////////////////////////////////////////
+
+// Feature is a group of resources. Roles are granted per feature
+type Feature struct {
+	// Name of the feature
+	Name string `json:"name"`
+	// Description explains what the feature is about
+	Description string `json:"description"`
+	// RequiresMFA is true if user should have used a second factor to access the resources of the feature
+	RequiresMFA bool `json:"requires_mfa"`
+	// Resources is the number of resources in that feature
+	Resources int `json:"resources"`
 }
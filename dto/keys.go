@@ -0,0 +1,15 @@
+package dto
+
+import "time"
+
+// SigningKey is a key to sign and verify tokens, as stored
+type SigningKey struct {
+	// ID is the key id, set as the kid header of tokens
+	ID string
+	// Algorithm is the signing algorithm (HS256, RS256 or EdDSA)
+	Algorithm string
+	// Material is the raw secret for HS256, the PKCS8 private key otherwise
+	Material []byte
+	// CreatedAt is the creation date of the key, most recent key is the current one
+	CreatedAt time.Time
+}
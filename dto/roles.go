@@ -0,0 +1,114 @@
+package dto
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// Role is a role definition, as stored in database
+type Role struct {
+	// Name of the role, for instance reader
+	Name GrantRole `json:"name"`
+	// Description of the role
+	Description string `json:"description"`
+	// Implies are the roles this role includes: an user with that role has those roles too (and the roles they imply)
+	Implies []GrantRole `json:"implies"`
+	// CanGrant is true if role may grant itself and the roles it implies
+	CanGrant bool `json:"can_grant"`
+	// BuiltIn is true for roles the application relies on (root, admin, editor, reader). They cannot change
+	BuiltIn bool `json:"built_in"`
+}
+
+// BuiltInRoles returns the roles the application relies on, with their hierarchy: root, admin, editor, reader
+func BuiltInRoles() []Role {
+	return []Role{
+		{Name: RoleRoot, Description: "allows any action with grant actions too", Implies: []GrantRole{RoleAdmin}, CanGrant: true, BuiltIn: true},
+		{Name: RoleAdmin, Description: "allows any action but cannot grant", Implies: []GrantRole{RoleEditor}, CanGrant: true, BuiltIn: true},
+		{Name: RoleEditor, Description: "crud operations are allowed", Implies: []GrantRole{RoleReader}, BuiltIn: true},
+		{Name: RoleReader, Description: "read only operations are allowed", BuiltIn: true},
+	}
+}
+
+// knownRoles are the current roles, per name. Built-in roles until roles are loaded from database
+var knownRoles = struct {
+	lock   sync.RWMutex
+	values map[GrantRole]Role
+}{values: rolesPerName(BuiltInRoles())}
+
+// rolesPerName indexes roles by name
+func rolesPerName(roles []Role) map[GrantRole]Role {
+	result := make(map[GrantRole]Role, len(roles))
+	for _, role := range roles {
+		result[role.Name] = role
+	}
+
+	return result
+}
+
+// SetKnownRoles replaces the current roles. Built-in roles remain, whatever the values
+func SetKnownRoles(roles []Role) {
+	values := rolesPerName(BuiltInRoles())
+	for _, role := range roles {
+		if _, builtIn := values[role.Name]; !builtIn {
+			values[role.Name] = role
+		}
+	}
+
+	knownRoles.lock.Lock()
+	defer knownRoles.lock.Unlock()
+	knownRoles.values = values
+}
+
+// KnownRoles returns the current roles, ordered by name
+func KnownRoles() []Role {
+	knownRoles.lock.RLock()
+	defer knownRoles.lock.RUnlock()
+
+	result := make([]Role, 0, len(knownRoles.values))
+	for _, role := range knownRoles.values {
+		result = append(result, role)
+	}
+
+	slices.SortFunc(result, func(a, b Role) int { return cmp.Compare(a.Name, b.Name) })
+	return result
+}
+
+// ExpandRoles returns roles and all the roles they imply, each role once, ordered by name
+func ExpandRoles(roles []GrantRole) []GrantRole {
+	knownRoles.lock.RLock()
+	defer knownRoles.lock.RUnlock()
+	return expandRoles(knownRoles.values, roles)
+}
+
+// MayGrantRole returns true if an user with those roles may grant role.
+// A role that may grant grants itself and the roles it implies, and roles implying it give that ability too
+func MayGrantRole(roles []GrantRole, role GrantRole) bool {
+	knownRoles.lock.RLock()
+	defer knownRoles.lock.RUnlock()
+
+	for _, granter := range expandRoles(knownRoles.values, roles) {
+		if knownRoles.values[granter].CanGrant && slices.Contains(expandRoles(knownRoles.values, []GrantRole{granter}), role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expandRoles returns roles and all the roles they imply in values, each role once, ordered by name
+func expandRoles(values map[GrantRole]Role, roles []GrantRole) []GrantRole {
+	var result []GrantRole
+	pending := slices.Clone(roles)
+	for len(pending) != 0 {
+		role := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !slices.Contains(result, role) {
+			result = append(result, role)
+			pending = append(pending, values[role].Implies...)
+		}
+	}
+
+	slices.Sort(result)
+	return result
+}
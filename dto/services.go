@@ -0,0 +1,31 @@
+package dto
+
+import "time"
+
+// Types of service account credentials
+const (
+	// CredentialSecret is a client secret (only its hash is stored)
+	CredentialSecret = "secret"
+	// CredentialPublicKey is a public key to verify assertions signed by the service
+	CredentialPublicKey = "public_key"
+)
+
+// ServiceCredential is a credential of a service account
+type ServiceCredential struct {
+	// ID is the credential id, set as the kid header of assertions for public keys
+	ID string `json:"id"`
+	// Type is either CredentialSecret or CredentialPublicKey
+	Type string `json:"type"`
+	// Material is the hash of the secret or the public key (DER, PKIX). Never displayed
+	Material []byte `json:"-"`
+	// CreatedAt is the creation date of the credential
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is the date the credential stops being valid, nil for no expiration
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ServiceAccount is a non human principal, authenticating with client credentials
+type ServiceAccount struct {
+	Name        string              `json:"name"`
+	Credentials []ServiceCredential `json:"credentials"`
+}
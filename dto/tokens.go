@@ -0,0 +1,19 @@
+package dto
+
+import "time"
+
+// AccessToken is a personal access token of an user, as displayed (value and hash are never displayed)
+type AccessToken struct {
+	// ID is the token id, to revoke it
+	ID string `json:"id"`
+	// Name is unique per user
+	Name string `json:"name"`
+	// CreatedAt is the creation date of the token
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is the date the token stops being valid
+	ExpiresAt time.Time `json:"expires_at"`
+	// LastUsedAt is the last use of the token (within a minute), nil if never used
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Roles are the roles of the token per feature, a subset of the user's roles
+	Roles map[string][]GrantRole `json:"roles"`
+}
@@ -0,0 +1,170 @@
+package engines
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// ACCESS_TOKEN_PREFIX starts any personal access token, to distinguish them from JWT (and to find leaked tokens)
+const ACCESS_TOKEN_PREFIX = "scr_pat_"
+
+// DEFAULT_ACCESS_TOKEN_DAYS is the validity of a personal access token, if not set
+const DEFAULT_ACCESS_TOKEN_DAYS = 30
+
+// MAX_ACCESS_TOKEN_DAYS is the maximum validity of a personal access token
+const MAX_ACCESS_TOKEN_DAYS = 365
+
+// AccessTokenCreation is the request to create a personal access token.
+// Roles are a subset of the current roles of the user, per feature
+type AccessTokenCreation struct {
+	Name string `json:"name" validate:"required,token_name"`
+	// ExpiresInDays is the validity of the token, DEFAULT_ACCESS_TOKEN_DAYS if not set
+	ExpiresInDays int                 `json:"expires_in_days"`
+	Roles         map[string][]string `json:"roles" validate:"required,role"`
+}
+
+// AccessTokenCreated is the created token. Value is displayed once
+type AccessTokenCreated struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AccessTokenID is a personal access token designated by the tokenId path parameter
+type AccessTokenID struct {
+	ID string `path:"tokenId" validate:"required"`
+}
+
+// ValidateTokenNameFormat tests if a personal access token name is valid or not
+func ValidateTokenNameFormat(name string) bool {
+	if res, err := regexp.MatchString(`^[a-zA-Z0-9_\-\.]{1,64}$`, name); err != nil {
+		panic(err)
+	} else {
+		return res
+	}
+}
+
+// NewAccessToken returns a random personal access token and its hash (to store)
+func NewAccessToken() (string, []byte, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", nil, err
+	}
+
+	token := ACCESS_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(value)
+	return token, HashAccessToken(token), nil
+}
+
+// HashAccessToken returns the hash of a personal access token, as stored
+func HashAccessToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// IsAccessTokenFormat returns true for a personal access token, false for a JWT
+func IsAccessTokenFormat(token string) bool {
+	return strings.HasPrefix(token, ACCESS_TOKEN_PREFIX)
+}
+
+// EndpointCreateAccessToken creates a personal access token for current user.
+// A personal access token cannot create tokens
+var EndpointCreateAccessToken = JSON(createAccessToken)
+
+// createAccessToken creates a personal access token for current user, with a subset of user's roles
+func createAccessToken(c *HandlerContext, request AccessTokenCreation) (AccessTokenCreated, error) {
+	var result AccessTokenCreated
+	login := c.GetLogin()
+	days := request.ExpiresInDays
+	if days == 0 {
+		days = DEFAULT_ACCESS_TOKEN_DAYS
+	}
+
+	if c.CurrentAuth.AccessTokenID != "" {
+		return result, NewApiError(http.StatusForbidden, ErrorCodeForbidden, "personal access tokens cannot create tokens")
+	} else if days < 0 || days > MAX_ACCESS_TOKEN_DAYS {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("validity should be between 1 and %d days", MAX_ACCESS_TOKEN_DAYS))
+	}
+
+	userRoles, err := c.Dao.GetUserRolesPerFeature(c.GetCurrentContext(), login)
+	if err != nil {
+		return result, err
+	}
+
+	tokenRoles := make(map[string][]dto.GrantRole)
+	for feature, values := range request.Roles {
+		if roles, err := dto.ParseGrantRoles(values); err != nil {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		} else if len(roles) == 0 {
+			continue
+		} else {
+			// user roles include the roles they imply
+			available := dto.ExpandRoles(userRoles[feature])
+			for _, role := range roles {
+				if !slices.Contains(available, role) {
+					return result, NewApiError(http.StatusForbidden, ErrorCodeForbidden, fmt.Sprintf("no role %s for feature %s", role, feature))
+				}
+			}
+
+			tokenRoles[feature] = roles
+		}
+	}
+
+	token, hash, err := NewAccessToken()
+	if err != nil {
+		return result, err
+	}
+
+	content := dto.AccessToken{
+		ID:        uuid.NewString(),
+		Name:      request.Name,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: time.Now().UTC().AddDate(0, 0, days),
+		Roles:     tokenRoles,
+	}
+
+	if err := c.Dao.AddAccessToken(c.GetCurrentContext(), login, content, hash); err != nil {
+		return result, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), login, "tokens", fmt.Sprintf("user %s creates access token %s", login, content.Name), []string{content.ID})
+	result.ID = content.ID
+	result.Name = content.Name
+	result.Token = token
+	result.ExpiresAt = content.ExpiresAt
+	return result, nil
+}
+
+// EndpointListAccessTokens lists the personal access tokens of current user (never their value)
+var EndpointListAccessTokens = JSON(listAccessTokens)
+
+// listAccessTokens lists the personal access tokens of current user
+func listAccessTokens(c *HandlerContext, request NoContent) ([]dto.AccessToken, error) {
+	return c.Dao.ListAccessTokens(c.GetCurrentContext(), c.GetLogin())
+}
+
+// EndpointRevokeAccessToken revokes a personal access token of current user
+var EndpointRevokeAccessToken = JSON(revokeAccessToken)
+
+// revokeAccessToken revokes a personal access token of current user
+func revokeAccessToken(c *HandlerContext, request AccessTokenID) (NoContent, error) {
+	login := c.GetLogin()
+	if deleted, err := c.Dao.DeleteAccessToken(c.GetCurrentContext(), login, request.ID); err != nil {
+		return NoContent{}, err
+	} else if !deleted {
+		return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching token")
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), login, "tokens", fmt.Sprintf("user %s revokes access token", login), []string{request.ID})
+	return NoContent{}, nil
+}
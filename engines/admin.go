@@ -1,7 +1,6 @@
 package engines
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 
@@ -9,24 +8,11 @@ import (
 )
 
 // EndpointAdminCreateUser creates an user with no role
-func EndpointAdminCreateUser(c *HandlerContext) error {
-	var headers http.Header
-	var content UserInformation
-	if err := c.BindJsonBody(&content); err != nil {
-		c.BuildError(http.StatusBadRequest, err, headers)
-	} else if !ValidateUsernameFormat(content.Username) {
-		c.Build(http.StatusForbidden, "invalid username format", headers)
-	} else if !ValidateUserpasswordFormat(content.Password) {
-		c.Build(http.StatusForbidden, "invalid password format", headers)
-	} else if err := c.Dao.UpsertUser(context.Background(), content.Username, content.Password); err != nil {
-		c.BuildError(http.StatusInternalServerError, err, headers)
-	} else {
-		headers = c.RequestHeaderByNames("Authorization")
-		c.Build(http.StatusOK, "", headers)
-	}
+var EndpointAdminCreateUser = JSON(adminCreateUser)
 
-	// no error we could not manage
-	return nil
+// adminCreateUser creates an user with no role
+func adminCreateUser(c *HandlerContext, content UserInformation) (NoContent, error) {
+	return NoContent{}, c.Dao.UpsertUser(c.GetCurrentContext(), content.Username, content.Password)
 }
 
 // EndpointRootDeleteUser reads user's login parameter and delete that user (cannot be current user)
@@ -34,14 +20,14 @@ func EndpointRootDeleteUser(c *HandlerContext) error {
 	username := c.GetQueryParameters()["username"]
 	var headers http.Header
 	if len(username) == 0 {
-		c.Build(http.StatusBadRequest, "missing username for user deletion", headers)
+		c.BuildErrorMessage(http.StatusBadRequest, "missing username for user deletion", headers)
 	} else if !ValidateUsernameFormat(username) {
-		c.Build(http.StatusForbidden, "invalid username format", nil)
+		c.BuildErrorMessage(http.StatusForbidden, "invalid username format", nil)
 	} else if currentUser := c.GetLogin(); currentUser == "" {
-		c.Build(http.StatusInternalServerError, "cannot find user", nil)
+		c.BuildErrorMessage(http.StatusInternalServerError, "cannot find user", nil)
 	} else if currentUser == username {
-		c.Build(http.StatusBadRequest, "cannot delete your own account", nil)
-	} else if err := c.Dao.DeleteUser(context.Background(), username); err != nil {
+		c.BuildErrorMessage(http.StatusBadRequest, "cannot delete your own account", nil)
+	} else if err := c.Dao.DeleteUser(c.GetCurrentContext(), username); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 	} else {
 		c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
@@ -55,13 +41,13 @@ func EndpointRootDeleteUser(c *HandlerContext) error {
 func EndpointAdminListUserRoles(c *HandlerContext) error {
 	username := c.GetQueryParameters()["username"]
 	if len(username) == 0 {
-		c.Build(http.StatusBadRequest, "missing username for user roles information", nil)
+		c.BuildErrorMessage(http.StatusBadRequest, "missing username for user roles information", nil)
 	} else if !ValidateUsernameFormat(username) {
-		c.Build(http.StatusForbidden, "invalid username format", nil)
-	} else if values, err := c.Dao.GetUserRolesPerFeature(context.Background(), username); err != nil {
+		c.BuildErrorMessage(http.StatusForbidden, "invalid username format", nil)
+	} else if values, err := c.Dao.GetUserRolesPerFeature(c.GetCurrentContext(), username); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 	} else if len(values) == 0 {
-		c.Build(http.StatusNotFound, fmt.Sprintf("no matching user for %s", username), nil)
+		c.BuildErrorMessage(http.StatusNotFound, fmt.Sprintf("no matching user for %s", username), nil)
 	} else if err := c.BuildJson(http.StatusOK, values, c.RequestHeaderByNames("Authorization")); err != nil {
 		c.ClearResponse()
 		c.BuildError(http.StatusInternalServerError, err, nil)
@@ -72,44 +58,59 @@ func EndpointAdminListUserRoles(c *HandlerContext) error {
 }
 
 // EndpointAdminEditUserRoles changes roles of a given user for a given group
-func EndpointAdminEditUserRoles(c *HandlerContext) error {
-	username := c.GetQueryParameters()["username"]
-	var values map[string][]string
-	if len(username) == 0 {
-		c.Build(http.StatusBadRequest, "missing username for user roles information", nil)
-	} else if !ValidateUsernameFormat(username) {
-		c.Build(http.StatusForbidden, "invalid username format", nil)
-	} else if actor := c.GetLogin(); actor == "" {
-		c.Build(http.StatusInternalServerError, "cannot access login from current content", nil)
-	} else if actorAccess, err := c.Dao.GetUserRolesPerFeature(context.Background(), actor); err != nil {
-		c.BuildError(http.StatusInternalServerError, err, nil)
-	} else if err := c.BindJsonBody(&values); err != nil {
-		c.BuildError(http.StatusBadRequest, err, nil)
-	} else if len(values) == 0 {
-		c.Build(http.StatusBadRequest, "empty request", nil)
-	} else {
-		parsedRequest := make(map[string][]dto.GrantRole)
-		// request may be parsed
-		for group, rawRoles := range values {
-			if len(group) == 0 {
-				c.Build(http.StatusBadRequest, "empty value", nil)
-				return nil
-			} else if roles, err := dto.ParseGrantRoles(rawRoles); err != nil {
-				c.Build(http.StatusBadRequest, "invalid roles", nil)
-				return nil
-			} else {
-				parsedRequest[group] = roles
-			}
-		}
+var EndpointAdminEditUserRoles = JSON(adminEditUserRoles)
 
-		if err := MayGrant(actorAccess, parsedRequest); err != nil {
-			c.BuildError(http.StatusUnauthorized, err, nil)
-		} else if err := c.Dao.GrantAccessToFeatures(context.Background(), username, parsedRequest); err != nil {
-			c.BuildError(http.StatusInternalServerError, err, nil)
+// adminEditUserRoles changes roles of a given user, if current user may grant them
+func adminEditUserRoles(c *HandlerContext, request UserRolesEdition) (NoContent, error) {
+	var result NoContent
+	parsedRequest := make(map[string][]dto.GrantRole)
+	for feature, rawRoles := range request.Access {
+		if len(feature) == 0 {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "empty value")
+		} else if roles, err := dto.ParseGrantRoles(rawRoles); err != nil {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid roles")
 		} else {
-			c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
+			parsedRequest[feature] = roles
 		}
 	}
 
-	return nil
+	if actor := c.GetLogin(); actor == "" {
+		return result, NewApiError(http.StatusInternalServerError, ErrorCodeInternal, "cannot access login from current content")
+	} else if actorAccess, err := c.Dao.GetUserRolesPerFeature(c.GetCurrentContext(), actor); err != nil {
+		return result, err
+	} else if err := MayGrant(actorAccess, parsedRequest); err != nil {
+		return result, NewApiError(http.StatusUnauthorized, ErrorCodeUnauthorized, err.Error())
+	} else if err := c.Dao.GrantAccessToFeatures(c.GetCurrentContext(), request.Username, parsedRequest, isDryRun(request.DryRun)); err != nil {
+		return result, err
+	} else if isDryRun(request.DryRun) {
+		return result, previewGrants(c, request.Username, parsedRequest)
+	}
+
+	return result, nil
+}
+
+// previewGrants sends the changes of access of an user if roles per feature were changed (see EndpointAdminEditUserRoles)
+func previewGrants(c *HandlerContext, username string, change map[string][]dto.GrantRole) error {
+	if current, err := c.Dao.GetUserRolesPerFeature(c.GetCurrentContext(), username); err != nil {
+		return err
+	} else if resources, err := c.Dao.GetResources(c.GetCurrentContext()); err != nil {
+		return err
+	} else {
+		diff := AccessDiff{User: username, Changes: DiffGrants(c.GetRoutes(), resources, current, change)}
+		return c.BuildJson(http.StatusOK, diff, nil)
+	}
+}
+
+// EndpointAdminUnlockUser clears failed logins of an user, so that user may log in again
+var EndpointAdminUnlockUser = JSON(adminUnlockUser)
+
+// adminUnlockUser clears failed logins of an user, and logs the event
+func adminUnlockUser(c *HandlerContext, request UserName) (NoContent, error) {
+	var result NoContent
+	if err := c.Dao.UnlockLogin(c.GetCurrentContext(), userSubject(request.Username)); err != nil {
+		return result, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "security", fmt.Sprintf("user %s unlocks user %s", c.GetLogin(), request.Username), nil)
+	return result, nil
 }
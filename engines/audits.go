@@ -3,49 +3,35 @@ package engines
 import (
 	"net/http"
 	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
 )
 
 // AUDIT_DATE_LAYOUT defines the date format
 const AUDIT_DATE_LAYOUT = "20060102"
 
+// AuditPeriod is the period to display audit logs for. Dates are formatted as AUDIT_DATE_LAYOUT, both are optional
+type AuditPeriod struct {
+	From string `query:"from" validate:"date"`
+	To   string `query:"to" validate:"date"`
+}
+
 // EndpointRootAuditLogs displays audit logs (no possibility to change them)
-func EndpointRootAuditLogs(c *HandlerContext) error {
-	parameters := c.RequestUrlParameters()
-	var from, to string
-	for k, v := range parameters {
-		switch k {
-		case "from":
-			if len(v) != 1 || !ValidateDateFormat(v[0]) {
-				c.Build(http.StatusBadRequest, "invalid parameter from: expecting one value as a eight digit number", nil)
-				return nil
-			} else {
-				from = v[0]
-			}
-		case "to":
-			if len(v) != 1 || !ValidateDateFormat(v[0]) {
-				c.Build(http.StatusBadRequest, "invalid parameter to: expecting one value as a eight digit number", nil)
-				return nil
-			} else {
-				to = v[0]
-			}
-		default:
-			c.Build(http.StatusBadRequest, "invalid parameter. Expecting only from and to", nil)
-			return nil
-		}
-	}
+var EndpointRootAuditLogs = JSON(rootAuditLogs)
 
+// rootAuditLogs loads audit logs for that period
+func rootAuditLogs(c *HandlerContext, period AuditPeriod) ([]dto.AuditEntryLog, error) {
+	from, to := period.From, period.To
 	// from and to parameters found, if any
 	if from != "" && to != "" && from > to {
-		c.Build(http.StatusBadRequest, "invalid parameters: from is greater than to", nil)
-		return nil
+		return nil, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid parameters: from is greater than to")
 	}
 
 	// parse them to become a date
 	var fromDate, toDate time.Time
 	if len(from) == len(AUDIT_DATE_LAYOUT) {
 		if fd, err := time.Parse(AUDIT_DATE_LAYOUT, from); err != nil {
-			c.Build(http.StatusBadRequest, "invalid from parameter: format mismatch", nil)
-			return nil
+			return nil, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid from parameter: format mismatch")
 		} else {
 			fromDate = fd
 		}
@@ -53,8 +39,7 @@ func EndpointRootAuditLogs(c *HandlerContext) error {
 
 	if len(to) == len(AUDIT_DATE_LAYOUT) {
 		if fd, err := time.Parse(AUDIT_DATE_LAYOUT, to); err != nil {
-			c.Build(http.StatusBadRequest, "invalid to parameter: format mismatch", nil)
-			return nil
+			return nil, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid to parameter: format mismatch")
 		} else {
 			toDate = fd
 		}
@@ -63,11 +48,5 @@ func EndpointRootAuditLogs(c *HandlerContext) error {
 	}
 
 	// get answer and returns it
-	if values, err := c.Dao.LoadAuditEvents(c.GetCurrentContext(), fromDate, toDate); err != nil {
-		c.Build(http.StatusInternalServerError, "invalid to parameter: format mismatch", nil)
-		return nil
-	} else {
-		c.BuildJson(http.StatusOK, values, c.RequestHeaderByNames("Authorization"))
-		return nil
-	}
+	return c.Dao.LoadAuditEvents(c.GetCurrentContext(), fromDate, toDate)
 }
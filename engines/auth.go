@@ -3,83 +3,448 @@ package engines
 import (
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/zefrenchwan/scrutateur.git/dto"
+	"github.com/zefrenchwan/scrutateur.git/storage"
 )
 
+// MAX_REGEX_TEMPLATE_LENGTH is the maximum length of a REGEX template
+const MAX_REGEX_TEMPLATE_LENGTH = 512
+
+// urlPartValidator validates url parts matching a * in a template
+var urlPartValidator = regexp.MustCompile(REGEXP_URL_PART)
+
+// captureNameValidator validates names of {name} parts in a template
+var captureNameValidator = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compiledTemplate is a compiled REGEX template, or the compilation error
+type compiledTemplate struct {
+	pattern *regexp.Regexp
+	err     error
+}
+
+// MAX_COMPILED_TEMPLATES is the maximum number of compiled REGEX templates kept in process
+const MAX_COMPILED_TEMPLATES = 1024
+
+// compiledTemplates are the compiled REGEX templates, per template.
+// Templates to validate come from requests too, so that cache is bounded
+var compiledTemplates = storage.NewLRUCache(MAX_COMPILED_TEMPLATES, time.Hour)
+
 // AuthRulesEngine applies grant conditions and tests whether an user may access a resource
 type AuthRulesEngine struct {
 	// Conditions to apply
 	Conditions []dto.GrantAccessForResource
 }
 
-// CanAccessResource returns true and roles for user if user may access, false and nil otherwise. Error if any as the last value
-func (re *AuthRulesEngine) CanAccessResource(url string) (bool, []dto.GrantRole, error) {
-	regexpValidator := regexp.MustCompile(REGEXP_URL_PART)
-	for _, condition := range re.Conditions {
-		templateUrl := condition.Template
-		expectedRoles := condition.UserRoles
-		switch condition.Operator {
-		case dto.OperatorEquals:
-			if templateUrl == url {
-				return true, expectedRoles, nil
+// Decision is the result of the conditions for a request
+type Decision struct {
+	// Allowed is true if a condition allows access and no condition denies it
+	Allowed bool
+	// Roles are the roles of all the allowing conditions, nil if access is not allowed
+	Roles []dto.GrantRole
+	// RequiresMFA is true if any allowing condition requires a second factor, since roles come from all of them
+	RequiresMFA bool
+	// Rule is the deciding condition: most specific deny condition if any, most specific allow condition otherwise.
+	// Nil if no condition matches
+	Rule *dto.GrantAccessForResource
+}
+
+// RuleTrace is how a condition applied to a request, see Explain
+type RuleTrace struct {
+	// Condition is the traced condition
+	Condition dto.GrantAccessForResource
+	// MethodMatches is true if condition applies to the http method of the request
+	MethodMatches bool
+	// TemplateMatches is true if url of the request matches the template of the condition
+	TemplateMatches bool
+	// Captures are the named captures of the template, if it matches
+	Captures map[string]string
+	// Deciding is true for the deciding condition (see Decision)
+	Deciding bool
+}
+
+// Matches returns true if condition applies to the request
+func (t RuleTrace) Matches() bool {
+	return t.MethodMatches && t.TemplateMatches
+}
+
+// Evaluate applies conditions to a request with that http method and url. Precedence is:
+//  1. any matching deny condition refuses access, whatever the allow conditions
+//  2. otherwise, roles are the roles of all the matching allow conditions, and the most specific one decides MFA policy
+//
+// See CompareSpecificity for the most specific condition. Result does not depend on conditions order
+func (re *AuthRulesEngine) Evaluate(method, url string) Decision {
+	return re.evaluate(method, url, nil)
+}
+
+// Explain evaluates a request as Evaluate does, and traces each condition, in conditions order
+func (re *AuthRulesEngine) Explain(method, url string) (Decision, []RuleTrace) {
+	traces := make([]RuleTrace, 0, len(re.Conditions))
+	decision := re.evaluate(method, url, func(condition dto.GrantAccessForResource, methodMatches, templateMatches bool, captures map[string]string) {
+		traces = append(traces, RuleTrace{Condition: condition, MethodMatches: methodMatches, TemplateMatches: templateMatches, Captures: captures})
+	})
+
+	for index := range re.Conditions {
+		traces[index].Deciding = &re.Conditions[index] == decision.Rule
+	}
+
+	return decision, traces
+}
+
+// ExplainCompact returns a one line trace of the decision for a request, to log refused requests
+func (re *AuthRulesEngine) ExplainCompact(method, url string) string {
+	decision, traces := re.Explain(method, url)
+	matching := 0
+	for _, trace := range traces {
+		if trace.Matches() {
+			matching++
+		}
+	}
+
+	if decision.Rule == nil {
+		return fmt.Sprintf("%d conditions, none matches", len(traces))
+	}
+
+	rule := decision.Rule
+	verb := "allowed"
+	if !decision.Allowed {
+		verb = "denied"
+	}
+
+	return fmt.Sprintf("%d conditions, %d matching, %s by %s %s (methods %v, roles %v)", len(traces), matching, verb, rule.Operator, rule.Template, rule.Methods, rule.UserRoles)
+}
+
+// evaluate applies conditions to a request, and calls trace (if not nil) for each condition
+func (re *AuthRulesEngine) evaluate(method, url string, trace func(dto.GrantAccessForResource, bool, bool, map[string]string)) Decision {
+	var allow, deny *dto.GrantAccessForResource
+	var roles []dto.GrantRole
+	requiresMFA := false
+	for index := range re.Conditions {
+		condition := &re.Conditions[index]
+		methodMatches := MatchesMethod(condition.Methods, method)
+		var templateMatches bool
+		var captures map[string]string
+		if methodMatches || trace != nil {
+			templateMatches, captures = MatchTemplate(condition.Operator, condition.Template, url)
+		}
+
+		if trace != nil {
+			trace(*condition, methodMatches, templateMatches, captures)
+		}
+
+		if !methodMatches || !templateMatches {
+			continue
+		} else if condition.Effect == dto.EffectDeny {
+			if deny == nil || CompareSpecificity(*condition, *deny) < 0 {
+				deny = condition
+			}
+		} else {
+			if allow == nil || CompareSpecificity(*condition, *allow) < 0 {
+				allow = condition
+			}
+
+			requiresMFA = requiresMFA || condition.RequiresMFA
+			for _, role := range condition.UserRoles {
+				if !slices.Contains(roles, role) {
+					roles = append(roles, role)
+				}
 			}
-		case dto.OperatorStartsWith:
-			if strings.HasPrefix(url, templateUrl) {
-				return true, expectedRoles, nil
+		}
+	}
+
+	if deny != nil {
+		return Decision{Rule: deny}
+	} else if allow == nil {
+		return Decision{}
+	}
+
+	slices.Sort(roles)
+	return Decision{Allowed: true, Roles: roles, RequiresMFA: requiresMFA, Rule: allow}
+}
+
+// CanAccessResource returns true and roles for user if user may access url with that http method, false and nil otherwise. Error if any as the last value
+func (re *AuthRulesEngine) CanAccessResource(method, url string) (bool, []dto.GrantRole, error) {
+	decision := re.Evaluate(method, url)
+	return decision.Allowed, decision.Roles, nil
+}
+
+// CompareSpecificity returns a negative value if a is more specific than b, positive if b is more specific, 0 for the same condition.
+// Operators are, from most to less specific: EQUALS, MATCHES, REGEX, STARTS_WITH, CONTAINS.
+// Then, the longer the literal part of template, the more specific. Templates order, methods and MFA policy break ties, for a stable result
+func CompareSpecificity(a, b dto.GrantAccessForResource) int {
+	if rankA, rankB := operatorSpecificity(a.Operator), operatorSpecificity(b.Operator); rankA != rankB {
+		return rankB - rankA
+	} else if lengthA, lengthB := literalLength(a.Operator, a.Template), literalLength(b.Operator, b.Template); lengthA != lengthB {
+		return lengthB - lengthA
+	} else if a.Template != b.Template {
+		return strings.Compare(a.Template, b.Template)
+	} else if spanA, spanB := methodsSpan(a.Methods), methodsSpan(b.Methods); spanA != spanB {
+		// condition restricted to less methods is more specific
+		return spanA - spanB
+	} else if a.RequiresMFA != b.RequiresMFA {
+		// stricter first
+		if a.RequiresMFA {
+			return -1
+		}
+
+		return 1
+	}
+
+	return 0
+}
+
+// methodsSpan returns the number of http methods a condition applies to, more than any set for any method
+func methodsSpan(methods []string) int {
+	if len(methods) == 0 {
+		return math.MaxInt16
+	}
+
+	return len(methods)
+}
+
+// operatorSpecificity ranks operators, most specific first
+func operatorSpecificity(operator dto.GrantOperator) int {
+	switch operator {
+	case dto.OperatorEquals:
+		return 5
+	case dto.OperatorMatches:
+		return 4
+	case dto.OperatorRegex:
+		return 3
+	case dto.OperatorStartsWith:
+		return 2
+	case dto.OperatorContains:
+		return 1
+	}
+
+	return 0
+}
+
+// literalLength returns the length of the literal part of a template: without wildcards or captures for MATCHES
+func literalLength(operator dto.GrantOperator, templateUrl string) int {
+	if operator != dto.OperatorMatches {
+		return len(templateUrl)
+	}
+
+	result := 0
+	for _, part := range strings.Split(templateUrl, "/") {
+		if _, capture := captureName(part); part != "*" && part != "**" && !capture {
+			result += len(part)
+		}
+	}
+
+	return result
+}
+
+// ConditionsFromPermissions returns the grant conditions of an user with those roles per feature (and roles they imply), for those resources.
+// It is the same as the conditions from the database, without a database lookup
+func ConditionsFromPermissions(roles map[string][]dto.GrantRole, resources []dto.Resource) []dto.GrantAccessForResource {
+	var result []dto.GrantAccessForResource
+	for _, resource := range resources {
+		var granted []dto.GrantRole
+		for _, role := range dto.ExpandRoles(roles[resource.Feature]) {
+			if slices.Contains(resource.Roles, role) && !slices.Contains(granted, role) {
+				granted = append(granted, role)
 			}
-		case dto.OperatorMatches:
-			localTest := true
-			urlParts := strings.Split(url, "/")
-			templateParts := strings.Split(templateUrl, "/")
-			size := len(urlParts)
-
-			// test first that there is exactly the same amount of / parts
-			if size != len(templateParts) {
-				localTest = false
-			} else {
-				for index, value := range urlParts {
-					if !localTest {
-						break
-					}
-					templatePart := templateParts[index]
-					if templatePart == "*" {
-						localTest = regexpValidator.MatchString(value)
-					} else {
-						localTest = (value == templatePart)
-					}
+		}
+
+		if len(granted) != 0 {
+			result = append(result, dto.GrantAccessForResource{Operator: resource.Operator, Template: resource.Template, UserRoles: granted, RequiresMFA: resource.RequiresMFA, Methods: resource.Methods, Effect: resource.Effect})
+		}
+	}
+
+	return result
+}
+
+// RequiresMFA returns true if any allowing condition for url and that http method requires a second factor
+func (re *AuthRulesEngine) RequiresMFA(method, url string) bool {
+	return re.Evaluate(method, url).RequiresMFA
+}
+
+// MatchesMethod returns true if http method is one of methods, or if methods is empty (any method).
+// HEAD requests match GET, as they read the same resource
+func MatchesMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+
+	method = strings.ToUpper(method)
+	return slices.Contains(methods, method) || (method == http.MethodHead && slices.Contains(methods, http.MethodGet))
+}
+
+// MatchesTemplate returns true if url matches template for that operator
+func MatchesTemplate(operator dto.GrantOperator, templateUrl string, url string) bool {
+	matches, _ := MatchTemplate(operator, templateUrl, url)
+	return matches
+}
+
+// MatchTemplate returns true if url matches template for that operator, and the named captures if any.
+// Captures are {name} parts of a MATCHES template, or named groups of a REGEX template.
+// REGEX templates match the whole url, and an invalid template matches no url
+func MatchTemplate(operator dto.GrantOperator, templateUrl string, url string) (bool, map[string]string) {
+	switch operator {
+	case dto.OperatorEquals:
+		return templateUrl == url, nil
+	case dto.OperatorStartsWith:
+		return strings.HasPrefix(url, templateUrl), nil
+	case dto.OperatorContains:
+		return strings.Contains(url, templateUrl), nil
+	case dto.OperatorMatches:
+		captures := make(map[string]string)
+		if !matchParts(strings.Split(templateUrl, "/"), strings.Split(url, "/"), captures) {
+			return false, nil
+		}
+
+		return true, captures
+	case dto.OperatorRegex:
+		if pattern, err := compileRegexTemplate(templateUrl); err != nil {
+			return false, nil
+		} else if values := pattern.FindStringSubmatch(url); values == nil {
+			return false, nil
+		} else {
+			captures := make(map[string]string)
+			for index, name := range pattern.SubexpNames() {
+				if name != "" {
+					captures[name] = values[index]
 				}
 			}
 
-			if localTest {
-				return true, expectedRoles, nil
+			return true, captures
+		}
+	}
+
+	return false, nil
+}
+
+// matchParts returns true if url parts match template parts, and sets captures.
+// In template, * is any url part, ** any number of url parts (even none), {name} any url part captured as name
+func matchParts(templateParts, urlParts []string, captures map[string]string) bool {
+	if len(templateParts) == 0 {
+		return len(urlParts) == 0
+	}
+
+	templatePart := templateParts[0]
+	if templatePart == "**" {
+		// try to match as few parts as possible first
+		for consumed := 0; consumed <= len(urlParts); consumed++ {
+			if consumed > 0 && !urlPartValidator.MatchString(urlParts[consumed-1]) {
+				return false
+			} else if matchParts(templateParts[1:], urlParts[consumed:], captures) {
+				return true
+			}
+		}
+
+		return false
+	} else if len(urlParts) == 0 {
+		return false
+	}
+
+	value := urlParts[0]
+	if templatePart == "*" {
+		if !urlPartValidator.MatchString(value) {
+			return false
+		}
+	} else if name, found := captureName(templatePart); found {
+		if !urlPartValidator.MatchString(value) {
+			return false
+		}
+
+		captures[name] = value
+	} else if value != templatePart {
+		return false
+	}
+
+	return matchParts(templateParts[1:], urlParts[1:], captures)
+}
+
+// captureName returns the name of a {name} template part, and false if part is not a capture
+func captureName(templatePart string) (string, bool) {
+	if name, found := strings.CutPrefix(templatePart, "{"); !found {
+		return "", false
+	} else if name, found := strings.CutSuffix(name, "}"); !found || !captureNameValidator.MatchString(name) {
+		return "", false
+	} else {
+		return name, true
+	}
+}
+
+// compileRegexTemplate returns the compiled pattern of a REGEX template, anchored to match the whole url.
+// Template is compiled alone first, so that unbalanced groups cannot escape the anchors.
+// Patterns are compiled once, invalid ones included
+func compileRegexTemplate(templateUrl string) (*regexp.Regexp, error) {
+	if value, found := compiledTemplates.Get(templateUrl); found {
+		compiled := value.(compiledTemplate)
+		return compiled.pattern, compiled.err
+	}
+
+	var compiled compiledTemplate
+	if len(templateUrl) > MAX_REGEX_TEMPLATE_LENGTH {
+		compiled.err = fmt.Errorf("regex template is longer than %d characters", MAX_REGEX_TEMPLATE_LENGTH)
+	} else if _, err := regexp.Compile(templateUrl); err != nil {
+		compiled.err = err
+	} else {
+		compiled.pattern, compiled.err = regexp.Compile("^(?:" + templateUrl + ")$")
+	}
+
+	compiledTemplates.Set(templateUrl, compiled)
+	return compiled.pattern, compiled.err
+}
+
+// ValidateTemplate returns an error if template is not valid for that operator
+func ValidateTemplate(operator dto.GrantOperator, templateUrl string) error {
+	if templateUrl == "" {
+		return errors.New("empty template")
+	}
+
+	switch operator {
+	case dto.OperatorEquals, dto.OperatorStartsWith, dto.OperatorContains:
+		return nil
+	case dto.OperatorMatches:
+		for _, part := range strings.Split(templateUrl, "/") {
+			if strings.ContainsAny(part, "{}") {
+				if _, found := captureName(part); !found {
+					return fmt.Errorf("invalid capture %s", part)
+				}
 			}
 		}
+
+		return nil
+	case dto.OperatorRegex:
+		_, err := compileRegexTemplate(templateUrl)
+		return err
 	}
 
-	return false, nil, nil
+	return fmt.Errorf("%s is not a grant operator", operator)
 }
 
 // MayGrant returns an error if adminAccess ore not sufficient to grant requestedAccess.
-// Parameters are group => roles of user
+// Parameters are group => roles of user. Roles hierarchy applies (see dto.MayGrantRole):
+// to remove access on a group (no role), user should be able to grant at least one role on that group
 func MayGrant(adminAccess map[string][]dto.GrantRole, requestedAccess map[string][]dto.GrantRole) error {
 	if len(adminAccess) == 0 {
 		return errors.New("no admin access")
 	} else if len(requestedAccess) == 0 {
 		return nil
-	} else {
-		for group, roles := range requestedAccess {
-			if len(group) == 0 {
-				return errors.New("empty value")
-			} else if accessRights, found := adminAccess[group]; !found {
-				return fmt.Errorf("cannot grant on group %s", group)
-			} else if !slices.Contains(accessRights, dto.RoleRoot) && !slices.Contains(accessRights, dto.RoleAdmin) {
-				return errors.New("cannot grant access due to insufficient privileges: needs admin or root")
-			} else if slices.Contains(roles, dto.RoleRoot) && !slices.Contains(accessRights, dto.RoleRoot) {
-				return errors.New("cannot grant access due to insufficient privileges: admin cannot grant root")
+	}
+
+	for group, roles := range requestedAccess {
+		if len(group) == 0 {
+			return errors.New("empty value")
+		} else if accessRights, found := adminAccess[group]; !found {
+			return fmt.Errorf("cannot grant on group %s", group)
+		} else if !slices.ContainsFunc(dto.ExpandRoles(accessRights), func(role dto.GrantRole) bool { return dto.MayGrantRole(accessRights, role) }) {
+			return errors.New("cannot grant access due to insufficient privileges: no role to grant")
+		} else {
+			for _, role := range roles {
+				if !dto.MayGrantRole(accessRights, role) {
+					return fmt.Errorf("cannot grant access due to insufficient privileges: cannot grant %s", role)
+				}
 			}
 		}
 	}
@@ -0,0 +1,110 @@
+package engines
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// NoContent is the response type of typed handlers sending no body
+type NoContent struct{}
+
+// JSON adapts a typed handler to a request processor. Request is built from:
+//   - path parameters, for fields tagged path:"name"
+//   - url parameters, for fields tagged query:"name" (string or []string)
+//   - json body, either in the field tagged body:"true", or in the request itself if no field has that tag
+//
+// Request is then validated (see ValidateStruct), and handler is called.
+// Handler result is sent as json with a 200 status (empty body for NoContent), error is sent with BuildError.
+// If handler builds the response itself, that response is sent as is
+func JSON[Req any, Resp any](handler func(*HandlerContext, Req) (Resp, error)) RequestProcessor {
+	return func(c *HandlerContext) error {
+		var request Req
+		if err := bindRequest(c, &request); err != nil {
+			c.BuildError(http.StatusBadRequest, err, nil)
+			return nil
+		} else if err := ValidateStruct(request); err != nil {
+			c.BuildError(http.StatusBadRequest, err, nil)
+			return nil
+		}
+
+		response, err := handler(c, request)
+		if err != nil {
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+		} else if c.response.ShouldSend() {
+			// handler decided
+			return nil
+		} else if _, empty := any(response).(NoContent); empty {
+			c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
+		} else if err := c.BuildJson(http.StatusOK, response, c.RequestHeaderByNames("Authorization")); err != nil {
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+		}
+
+		return nil
+	}
+}
+
+// bindRequest fills target (pointer to the request) with path parameters, url parameters and body
+func bindRequest(c *HandlerContext, target any) error {
+	value := reflect.ValueOf(target).Elem()
+	if value.Kind() != reflect.Struct {
+		return bindBody(c, target)
+	}
+
+	valueType := value.Type()
+	bodyIndex := -1
+	for index := 0; index < valueType.NumField(); index++ {
+		if valueType.Field(index).Tag.Get("body") == "true" {
+			bodyIndex = index
+		}
+	}
+
+	// body first, so that parameters always win
+	if bodyIndex >= 0 {
+		if err := bindBody(c, value.Field(bodyIndex).Addr().Interface()); err != nil {
+			return err
+		}
+	} else if err := bindBody(c, target); err != nil {
+		return err
+	}
+
+	pathParameters := c.GetQueryParameters()
+	urlParameters := c.RequestUrlParameters()
+	for index := 0; index < valueType.NumField(); index++ {
+		field := valueType.Field(index)
+		fieldValue := value.Field(index)
+		if name := field.Tag.Get("path"); name != "" && field.Type.Kind() == reflect.String {
+			fieldValue.SetString(pathParameters[name])
+		} else if name := field.Tag.Get("query"); name != "" {
+			values := urlParameters[name]
+			switch {
+			case field.Type.Kind() == reflect.String && len(values) > 1:
+				return fmt.Errorf("expecting one value for parameter %s", name)
+			case field.Type.Kind() == reflect.String && len(values) == 1:
+				fieldValue.SetString(values[0])
+			case field.Type == reflect.TypeOf([]string{}):
+				fieldValue.Set(reflect.ValueOf(values))
+			}
+		}
+	}
+
+	return nil
+}
+
+// bindBody decodes the json body, if any, into target
+func bindBody(c *HandlerContext, target any) error {
+	if body, err := c.RequestBodyAsString(); err != nil {
+		return err
+	} else if strings.TrimSpace(body) == "" {
+		return nil
+	} else if err := json.Unmarshal([]byte(body), target); err != nil {
+		return errors.New("invalid json body")
+	}
+
+	return nil
+}
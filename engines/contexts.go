@@ -2,7 +2,9 @@ package engines
 
 import (
 	"context"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/zefrenchwan/scrutateur.git/dto"
 	"github.com/zefrenchwan/scrutateur.git/storage"
@@ -15,16 +17,30 @@ type HandlerContextKey string
 type ProcessingAuth struct {
 	Login string
 	Roles []dto.GrantRole
+	// Token is the content of the access token of the request
+	Token TokenContent
+	// AccessTokenID is the id of the personal access token of the request, if any (then, Token is empty)
+	AccessTokenID string
 }
 
 // HandlerContext is the context to pass on each request, for the processor to get everything
 type HandlerContext struct {
-	// go context
+	// go context, from the request
 	context context.Context
+	// cancels are the functions to call to release context resources once request is processed
+	cancels []context.CancelFunc
 	// decorated request (to ease request use)
 	request RequestDecorator
 	// response to send, will do as the last step
 	response AbstractResponse
+	// errorHandler builds the response when a processor fails
+	errorHandler ErrorHandler
+	// correlationID identifies the request in logs and error responses
+	correlationID string
+	// logger is the engine logger
+	logger *log.Logger
+	// routes returns the routes registered in the engine
+	routes func() []Route
 	// design choice: include dao in here, we don't build a general engine, we want custom use
 	Dao storage.Dao
 	// current auth content as structured data (no "any" stuff)
@@ -36,11 +52,73 @@ func (c *HandlerContext) GetCurrentContext() context.Context {
 	return c.context
 }
 
+// SetTimeout limits the remaining processing time of the request to that delay.
+// Storage calls using current context are cancelled once delay is over.
+// Delay replaces any previous timeout (it starts from the request context)
+func (c *HandlerContext) SetTimeout(delay time.Duration) {
+	ctx, cancel := context.WithTimeout(c.request.Context(), delay)
+	c.context = ctx
+	c.cancels = append(c.cancels, cancel)
+}
+
+// release frees the resources linked to current context
+func (c *HandlerContext) release() {
+	for index := len(c.cancels) - 1; index >= 0; index-- {
+		c.cancels[index]()
+	}
+
+	c.cancels = nil
+}
+
+// GetCorrelationID returns the id of the request, to link logs and responses
+func (c *HandlerContext) GetCorrelationID() string {
+	return c.correlationID
+}
+
+// LogError logs a failure that does not change the response, with the correlation id of the request
+func (c *HandlerContext) LogError(failure error) {
+	if c.logger != nil && failure != nil {
+		c.logger.Printf("ERROR [%s] when processing %s %s: %s\n", c.correlationID, c.GetRequestMethod(), c.GetRequestPath(), failure.Error())
+	}
+}
+
+// BackgroundErrorLogger returns a function logging failures of work done once response is sent, as LogError does.
+// That function does not use the context, released once request is processed
+func (c *HandlerContext) BackgroundErrorLogger() func(error) {
+	logger, correlationID, method, path := c.logger, c.correlationID, c.GetRequestMethod(), c.GetRequestPath()
+	return func(failure error) {
+		if logger != nil && failure != nil {
+			logger.Printf("ERROR [%s] when processing %s %s: %s\n", correlationID, method, path, failure.Error())
+		}
+	}
+}
+
+// GetRoutes returns the routes registered in the engine, nil for a context out of an engine
+func (c *HandlerContext) GetRoutes() []Route {
+	if c.routes == nil {
+		return nil
+	}
+
+	return c.routes()
+}
+
+// LogDenial logs a request refused to an user, with the trace of the access decision
+func (c *HandlerContext) LogDenial(login, trace string) {
+	if c.logger != nil {
+		c.logger.Printf("DENIED [%s] %s %s for %s: %s\n", c.correlationID, c.GetRequestMethod(), c.GetRequestPath(), login, trace)
+	}
+}
+
 // GetQueryParameters returns the query parameters
 func (c *HandlerContext) GetQueryParameters() map[string]string {
 	return c.request.GetQueryParameters()
 }
 
+// GetClientAddress returns the address of the client (no port)
+func (c *HandlerContext) GetClientAddress() string {
+	return c.request.RemoteAddress()
+}
+
 // GetRequestPath returns the path of the query
 func (c *HandlerContext) GetRequestPath() string {
 	return c.request.GetPath()
@@ -158,9 +236,30 @@ func (c *HandlerContext) BuildJson(code int, body any, headers http.Header) erro
 	return c.response.BuildJson(code, body, headers)
 }
 
-// BuildError sets all values in parameters and flags the response to be ready
+// BuildError sends failure as a json error envelope and flags the response to be ready.
+// Code is the http status to use unless failure defines its own (see AsApiError).
+// Causes of server errors are logged, never sent
 func (c *HandlerContext) BuildError(code int, failure error, headers http.Header) {
-	c.response.BuildError(code, failure, headers)
+	apiError := AsApiError(code, failure)
+	apiError.CorrelationID = c.correlationID
+	if apiError.Status >= 500 && c.logger != nil {
+		c.logger.Printf("ERROR [%s] when processing %s %s: %s\n", c.correlationID, c.GetRequestMethod(), c.GetRequestPath(), apiError.Error())
+	}
+
+	responseHeaders := make(http.Header)
+	if headers != nil {
+		responseHeaders = headers.Clone()
+	}
+
+	responseHeaders.Set("Content-Type", "application/json")
+	if err := c.response.BuildJson(apiError.Status, NewErrorEnvelope(apiError), responseHeaders); err != nil {
+		c.response.Build(apiError.Status, apiError.Message, headers)
+	}
+}
+
+// BuildErrorMessage sends an error with that status and message (safe to display) and flags the response to be ready
+func (c *HandlerContext) BuildErrorMessage(code int, message string, headers http.Header) {
+	c.BuildError(code, NewApiError(code, ErrorCodeForStatus(code), message), headers)
 }
 
 // BuildRaw sets values (body as is) and mark the response as ready
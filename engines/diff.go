@@ -0,0 +1,110 @@
+package engines
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// AccessChange is a change of access to a protected route
+type AccessChange struct {
+	// Route is the changed route
+	Route RouteReference `json:"route"`
+	// AllowedBefore is true if access was allowed before the change
+	AllowedBefore bool `json:"allowed_before"`
+	// AllowedAfter is true if access is allowed after the change
+	AllowedAfter bool `json:"allowed_after"`
+	// GainedRoles are the roles for that route after the change only
+	GainedRoles []dto.GrantRole `json:"gained_roles,omitempty"`
+	// LostRoles are the roles for that route before the change only
+	LostRoles []dto.GrantRole `json:"lost_roles,omitempty"`
+}
+
+// AccessDiff is the changes of access of an user
+type AccessDiff struct {
+	// User is the login of the user
+	User string `json:"user"`
+	// Changes are the routes that user gains or loses, or with other roles
+	Changes []AccessChange `json:"changes"`
+}
+
+// DiffAccess compares access to protected routes with conditions before and after a change.
+// Each route is evaluated with its sample path (see Route.SamplePath), routes with no change are not listed
+func DiffAccess(routes []Route, before, after []dto.GrantAccessForResource) []AccessChange {
+	result := []AccessChange{}
+	beforeEngine, afterEngine := AuthRulesEngine{Conditions: before}, AuthRulesEngine{Conditions: after}
+	for _, route := range routes {
+		if !route.Protected {
+			continue
+		}
+
+		path := route.SamplePath()
+		previous, next := beforeEngine.Evaluate(route.Method, path), afterEngine.Evaluate(route.Method, path)
+		change := AccessChange{
+			Route:         RouteReference{Method: route.Method, Pattern: route.Pattern},
+			AllowedBefore: previous.Allowed,
+			AllowedAfter:  next.Allowed,
+			GainedRoles:   missingRoles(next.Roles, previous.Roles),
+			LostRoles:     missingRoles(previous.Roles, next.Roles),
+		}
+
+		if change.AllowedBefore != change.AllowedAfter || len(change.GainedRoles) != 0 || len(change.LostRoles) != 0 {
+			result = append(result, change)
+		}
+	}
+
+	return result
+}
+
+// DiffGrants compares access of an user with roles per feature, before and after a change of grants.
+// Change sets roles per feature, empty roles remove access to the feature (as Dao.GrantAccessToFeatures)
+func DiffGrants(routes []Route, resources []dto.Resource, current, change map[string][]dto.GrantRole) []AccessChange {
+	next := maps.Clone(current)
+	if next == nil {
+		next = make(map[string][]dto.GrantRole)
+	}
+
+	for feature, roles := range change {
+		if len(roles) == 0 {
+			delete(next, feature)
+		} else {
+			next[feature] = roles
+		}
+	}
+
+	return DiffAccess(routes, ConditionsFromPermissions(current, resources), ConditionsFromPermissions(next, resources))
+}
+
+// DiffResources compares access of users (roles per feature, per login) with resources before and after a change.
+// Users with no change are not listed, others are ordered by login
+func DiffResources(routes []Route, users map[string]map[string][]dto.GrantRole, before, after []dto.Resource) []AccessDiff {
+	var result []AccessDiff
+	for _, login := range slices.Sorted(maps.Keys(users)) {
+		roles := users[login]
+		if changes := DiffAccess(routes, ConditionsFromPermissions(roles, before), ConditionsFromPermissions(roles, after)); len(changes) != 0 {
+			result = append(result, AccessDiff{User: login, Changes: changes})
+		}
+	}
+
+	return result
+}
+
+// missingRoles returns the roles in values that are not in others
+func missingRoles(values, others []dto.GrantRole) []dto.GrantRole {
+	var result []dto.GrantRole
+	for _, value := range values {
+		if !slices.Contains(others, value) {
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
+
+// isDryRun returns true if dry run parameter is set to a true value (see strconv.ParseBool)
+func isDryRun(value string) bool {
+	result, _ := strconv.ParseBool(value)
+	return result
+}
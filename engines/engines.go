@@ -1,35 +1,235 @@
 package engines
 
 import (
+	"context"
+	"errors"
+	"log"
+	"net"
 	"net/http"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/zefrenchwan/scrutateur.git/storage"
 )
 
+// ServerOptions defines the http server configuration
+type ServerOptions struct {
+	// ReadTimeout is the maximum duration to read a request, body included
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration before timing out writes of the response
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum amount of time to wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration
+	// ShutdownTimeout is the maximum duration to drain in-flight requests once a stop signal is received
+	ShutdownTimeout time.Duration
+}
+
+// DefaultServerOptions returns the options to use when nothing specific is set
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 20 * time.Second,
+	}
+}
+
+// shutdownHook is an action to perform once the server stopped accepting requests
+type shutdownHook struct {
+	// name of the hook, for logging purpose
+	name string
+	// action to perform
+	action func()
+}
+
 // ProcessingEngine links url patterns to processors
 type ProcessingEngine struct {
-	dao storage.Dao
-	mux *http.ServeMux
+	dao          storage.Dao
+	mux          *http.ServeMux
+	logger       *log.Logger
+	errorHandler ErrorHandler
+	options      ServerOptions
+	hooks        []shutdownHook
+	// methods are, per url pattern, the methods registered for that pattern
+	methods map[string][]string
+	// routes are the registered routes, in registration order
+	routes []*Route
 }
 
 // NewProcessingEngine builds a new engine.
 // Dao parameter is necessary to put it on each context
-func NewProcessingEngine(dao storage.Dao) ProcessingEngine {
-	return ProcessingEngine{
-		dao: dao,
-		mux: http.NewServeMux(),
+func NewProcessingEngine(dao storage.Dao, logger *log.Logger) *ProcessingEngine {
+	return &ProcessingEngine{
+		dao:          dao,
+		mux:          http.NewServeMux(),
+		logger:       logger,
+		errorHandler: DefaultErrorHandler(logger),
+		options:      DefaultServerOptions(),
+		methods:      make(map[string][]string),
+	}
+}
+
+// SetErrorHandler changes the error handler for all routes (unless a route overrides it)
+func (e *ProcessingEngine) SetErrorHandler(handler ErrorHandler) {
+	e.errorHandler = handler
+}
+
+// SetServerOptions changes the http server configuration. Call it before Launch
+func (e *ProcessingEngine) SetServerOptions(options ServerOptions) {
+	e.options = options
+}
+
+// OnShutdown registers an action to perform when the server stops.
+// Actions are performed in the order they were registered, once in-flight requests are drained
+func (e *ProcessingEngine) OnShutdown(name string, action func()) {
+	e.hooks = append(e.hooks, shutdownHook{name: name, action: action})
+}
+
+// AddProcessors links a (method + urlpattern) to a set of processors.
+// Pattern follows the http.ServeMux syntax, for instance /user/{username}/delete.
+// Routing on method is made by the mux: GET routes accept HEAD, OPTIONS is answered by the engine,
+// and other methods get a 405 with the Allow header
+// It returns the route, to document it
+func (e *ProcessingEngine) AddProcessors(method string, urlPattern string, processors ...RequestProcessor) *Route {
+	method = strings.ToUpper(method)
+	if _, found := e.methods[urlPattern]; !found {
+		e.mux.HandleFunc(http.MethodOptions+" "+urlPattern, e.optionsHandler(urlPattern))
+	}
+
+	e.methods[urlPattern] = append(e.methods[urlPattern], method)
+	e.mux.HandleFunc(method+" "+urlPattern, e.BuildHandlerFunc(processors...))
+
+	route := &Route{Method: method, Pattern: urlPattern}
+	e.routes = append(e.routes, route)
+	return route
+}
+
+// ServeHTTP routes a request with the mux.
+// Requests no route accepts (unknown path, or method not allowed for that path) get a json error envelope,
+// with the status (and Allow header) the mux decided
+func (e *ProcessingEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := e.mux.Handler(r); pattern != "" {
+		e.mux.ServeHTTP(w, r)
+		return
 	}
+
+	recorder := &statusRecorder{header: make(http.Header), status: http.StatusOK}
+	e.mux.ServeHTTP(recorder, r)
+	headers := make(http.Header)
+	message := "no route matches this path"
+	if recorder.status == http.StatusMethodNotAllowed {
+		headers.Set("Allow", recorder.header.Get("Allow"))
+		message = "method not allowed for this path"
+	} else if recorder.status != http.StatusNotFound {
+		message = http.StatusText(recorder.status)
+	}
+
+	e.BuildHandlerFunc(func(c *HandlerContext) error {
+		c.BuildErrorMessage(recorder.status, message, headers)
+		return nil
+	})(w, r)
 }
 
-// AddProcessors links a (method + urlpattern) to a set of processors
-func (e *ProcessingEngine) AddProcessors(method string, urlPattern string, processors ...RequestProcessor) {
-	var allProcessors []RequestProcessor
-	allProcessors = append(allProcessors, ValidateQueryProcessor(method))
-	allProcessors = append(allProcessors, processors...)
-	e.mux.HandleFunc(urlPattern, BuildHandlerFunc(e.dao, allProcessors...))
+// statusRecorder keeps the status and headers of the default responses of the mux, and drops their body
+type statusRecorder struct {
+	header http.Header
+	status int
 }
 
-// Launch starts the engine
-func (e *ProcessingEngine) Launch(address string) {
-	http.ListenAndServe(address, e.mux)
+// Header returns the headers to send
+func (s *statusRecorder) Header() http.Header {
+	return s.header
+}
+
+// Write drops the body
+func (s *statusRecorder) Write(content []byte) (int, error) {
+	return len(content), nil
+}
+
+// WriteHeader keeps the status
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+}
+
+// Group returns a group of routes sharing that path prefix and those middlewares.
+// Middlewares run in order, before the processors of each route
+func (e *ProcessingEngine) Group(prefix string, middlewares ...RequestProcessor) *RouteGroup {
+	return &RouteGroup{engine: e, prefix: strings.TrimSuffix(prefix, "/"), middlewares: middlewares}
+}
+
+// optionsHandler answers OPTIONS requests for that pattern with the allowed methods
+func (e *ProcessingEngine) optionsHandler(urlPattern string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := []string{http.MethodOptions}
+		for _, method := range e.methods[urlPattern] {
+			allowed = append(allowed, method)
+			if method == http.MethodGet {
+				allowed = append(allowed, http.MethodHead)
+			}
+		}
+
+		slices.Sort(allowed)
+		w.Header().Set("Allow", strings.Join(slices.Compact(allowed), ", "))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Launch starts the engine and blocks until the server stops.
+// Server stops on SIGINT or SIGTERM: in-flight requests are drained (within the shutdown timeout), then shutdown hooks run.
+// It returns an error if server could not start (for instance, address already in use) or did not stop cleanly
+func (e *ProcessingEngine) Launch(address string) error {
+	server := &http.Server{
+		Addr:         address,
+		Handler:      e,
+		ReadTimeout:  e.options.ReadTimeout,
+		WriteTimeout: e.options.WriteTimeout,
+		IdleTimeout:  e.options.IdleTimeout,
+		ErrorLog:     e.logger,
+	}
+
+	// listen first, so that a bind failure is raised right now
+	listener, errListen := net.Listen("tcp", address)
+	if errListen != nil {
+		e.runShutdownHooks()
+		return errListen
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	failures := make(chan error, 1)
+	go func() {
+		failures <- server.Serve(listener)
+	}()
+
+	var result error
+	select {
+	case err := <-failures:
+		// server stopped by itself, no signal involved
+		if !errors.Is(err, http.ErrServerClosed) {
+			result = err
+		}
+	case <-signals.Done():
+		e.logger.Println("Stop signal received, draining in-flight requests")
+		deadline, cancel := context.WithTimeout(context.Background(), e.options.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(deadline); err != nil {
+			result = errors.Join(errors.New("failed to drain requests before deadline"), err)
+			server.Close()
+		}
+	}
+
+	e.runShutdownHooks()
+	return result
+}
+
+// runShutdownHooks performs the shutdown actions in registration order
+func (e *ProcessingEngine) runShutdownHooks() {
+	for _, hook := range e.hooks {
+		e.logger.Println("Shutdown: closing", hook.name)
+		hook.action()
+	}
 }
@@ -0,0 +1,195 @@
+package engines
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/zefrenchwan/scrutateur.git/storage"
+)
+
+// CORRELATION_HEADER is the header to send (or receive) the correlation id of a request
+const CORRELATION_HEADER = "X-Correlation-Id"
+
+// ErrorCode is a stable code for clients to deal with a failure (messages may change, codes do not)
+type ErrorCode string
+
+// Possible values are listed here
+const (
+	ErrorCodeBadRequest       ErrorCode = "bad_request"
+	ErrorCodeUnauthorized     ErrorCode = "unauthorized"
+	ErrorCodeForbidden        ErrorCode = "forbidden"
+	ErrorCodeMFARequired      ErrorCode = "mfa_required"
+	ErrorCodeNotFound         ErrorCode = "not_found"
+	ErrorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	ErrorCodeConflict         ErrorCode = "conflict"
+	ErrorCodeTooManyRequests  ErrorCode = "too_many_requests"
+	ErrorCodeUnavailable      ErrorCode = "unavailable"
+	ErrorCodeInternal         ErrorCode = "internal_error"
+)
+
+// ApiError is a failure as the client should see it: a code, an http status, a message with no internal detail.
+// Original error, if any, is kept to be logged
+type ApiError struct {
+	// Code is the stable error code
+	Code ErrorCode
+	// Status is the http status
+	Status int
+	// Message is safe to display to the user
+	Message string
+	// CorrelationID links the error to the server logs
+	CorrelationID string
+	// cause is the original error, if any
+	cause error
+}
+
+// NewApiError builds a new api error with no cause
+func NewApiError(status int, code ErrorCode, message string) ApiError {
+	return ApiError{Code: code, Status: status, Message: message}
+}
+
+// Error returns the message, and the cause if any
+func (a ApiError) Error() string {
+	if a.cause != nil {
+		return fmt.Sprintf("%s: %s (%s)", a.Code, a.Message, a.cause.Error())
+	}
+
+	return fmt.Sprintf("%s: %s", a.Code, a.Message)
+}
+
+// Unwrap returns the cause of the error
+func (a ApiError) Unwrap() error {
+	return a.cause
+}
+
+// WithCause returns the same error with that cause
+func (a ApiError) WithCause(cause error) ApiError {
+	a.cause = cause
+	return a
+}
+
+// ErrorCodeForStatus returns the default error code for an http status
+func ErrorCodeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeForbidden
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeMethodNotAllowed
+	case http.StatusConflict:
+		return ErrorCodeConflict
+	case http.StatusTooManyRequests:
+		return ErrorCodeTooManyRequests
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrorCodeUnavailable
+	}
+
+	if status >= 500 {
+		return ErrorCodeInternal
+	}
+
+	return ErrorCodeBadRequest
+}
+
+// AsApiError converts any failure to an api error.
+// Api errors remain as is, storage errors are mapped per kind.
+// For other errors, status is used, and message is the error message unless status is a server error (no internal detail)
+func AsApiError(status int, failure error) ApiError {
+	if failure == nil {
+		return NewApiError(status, ErrorCodeForStatus(status), http.StatusText(status))
+	}
+
+	if apiError, ok := failure.(ApiError); ok {
+		return apiError
+	}
+
+	switch storage.KindOf(failure) {
+	case storage.KindNotFound:
+		return NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching element").WithCause(failure)
+	case storage.KindConflict:
+		return NewApiError(http.StatusConflict, ErrorCodeConflict, "conflict with existing element").WithCause(failure)
+	case storage.KindInvalid:
+		return NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid parameters").WithCause(failure)
+	case storage.KindUnavailable:
+		return NewApiError(http.StatusServiceUnavailable, ErrorCodeUnavailable, "service unavailable, try again later").WithCause(failure)
+	}
+
+	if status < 400 {
+		status = http.StatusInternalServerError
+	}
+
+	if status >= 500 {
+		return NewApiError(status, ErrorCodeForStatus(status), "internal error").WithCause(failure)
+	}
+
+	return NewApiError(status, ErrorCodeForStatus(status), failure.Error()).WithCause(failure)
+}
+
+// ErrorHandler builds the response when processing a request fails.
+// Failure is either an error returned by a processor or a panic (then, stack is the stack trace of the panic)
+type ErrorHandler func(c *HandlerContext, failure error, stack []byte)
+
+// ErrorEnvelope is the json body sent to the client for any failure
+type ErrorEnvelope struct {
+	Error ErrorDetails `json:"error"`
+}
+
+// ErrorDetails describes a failure for the client, without any internal detail
+type ErrorDetails struct {
+	// Code is the stable error code
+	Code ErrorCode `json:"code"`
+	// Status is the http status of the response
+	Status int `json:"status"`
+	// Message is a message the client may display
+	Message string `json:"message"`
+	// CorrelationID is the id of the request, to find matching server logs
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// NewErrorEnvelope builds the json content to send for an api error
+func NewErrorEnvelope(apiError ApiError) ErrorEnvelope {
+	return ErrorEnvelope{
+		Error: ErrorDetails{
+			Code:          apiError.Code,
+			Status:        apiError.Status,
+			Message:       apiError.Message,
+			CorrelationID: apiError.CorrelationID,
+		},
+	}
+}
+
+// PanicError is the error built when a processor panics
+type PanicError struct {
+	// Value is the value passed to panic
+	Value any
+}
+
+// Error returns the panic value as a string
+func (p PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.Value)
+}
+
+// DefaultErrorHandler logs the failure (with stack trace for panics) and sends it as a json envelope
+func DefaultErrorHandler(logger *log.Logger) ErrorHandler {
+	return func(c *HandlerContext, failure error, stack []byte) {
+		if len(stack) != 0 {
+			logger.Printf("PANIC [%s] when processing %s %s: %s\n%s", c.GetCorrelationID(), c.GetRequestMethod(), c.GetRequestPath(), failure.Error(), stack)
+		}
+
+		c.BuildError(http.StatusInternalServerError, failure, nil)
+	}
+}
+
+// ErrorHandlerMiddleware returns a processor that sets the error handler for the rest of the chain.
+// Add it first when registering a route to override the engine error handler for that route
+func ErrorHandlerMiddleware(handler ErrorHandler) RequestProcessor {
+	return func(c *HandlerContext) error {
+		c.errorHandler = handler
+		return nil
+	}
+}
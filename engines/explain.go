@@ -0,0 +1,135 @@
+package engines
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// AccessQuestion is the request to explain: an user accessing a path with an http method
+type AccessQuestion struct {
+	User   string `query:"user" validate:"required,username"`
+	Method string `query:"method" validate:"required"`
+	Path   string `query:"path" validate:"required"`
+}
+
+// CandidateRule is how a resource applied to a request
+type CandidateRule struct {
+	// Resource is the candidate resource
+	Resource dto.Resource `json:"resource"`
+	// GrantedRoles are the roles of the user on that resource: user roles (and implied roles) intersected with resource roles
+	GrantedRoles []dto.GrantRole `json:"granted_roles"`
+	// MethodMatches is true if resource applies to the http method of the request
+	MethodMatches bool `json:"method_matches"`
+	// TemplateMatches is true if path of the request matches the template of the resource
+	TemplateMatches bool `json:"template_matches"`
+	// Captures are the named captures of the template, if it matches
+	Captures map[string]string `json:"captures,omitempty"`
+	// Applies is true if resource matches the request and user has a role on it
+	Applies bool `json:"applies"`
+	// Deciding is true for the resource that decides the access
+	Deciding bool `json:"deciding"`
+}
+
+// AccessExplanation is the decision for a request, and how each resource applied
+type AccessExplanation struct {
+	User   string `json:"user"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Candidates are all the resources, in resources order
+	Candidates []CandidateRule `json:"candidates"`
+	// Allowed is the final decision
+	Allowed bool `json:"allowed"`
+	// Roles are the roles of the user for that request, if allowed
+	Roles []dto.GrantRole `json:"roles"`
+	// RequiresMFA is true if an allowed user should have used a second factor
+	RequiresMFA bool `json:"requires_mfa"`
+	// Reason explains the decision
+	Reason string `json:"reason"`
+}
+
+// ExplainAccess explains the access decision of a request, for those resources and the roles of the user per resource id.
+// Decision is made by the rules engine on the resources the user has a role on, other resources are traced only
+func ExplainAccess(method, path string, resources []dto.Resource, granted map[int][]dto.GrantRole) AccessExplanation {
+	method = strings.ToUpper(method)
+	result := AccessExplanation{Method: method, Path: path, Candidates: make([]CandidateRule, len(resources))}
+
+	// conditions of the user, and conditions to trace only
+	var userEngine, otherEngine AuthRulesEngine
+	var userIndexes, otherIndexes []int
+	for index, resource := range resources {
+		condition := dto.GrantAccessForResource{Operator: resource.Operator, Template: resource.Template, UserRoles: granted[resource.ID], RequiresMFA: resource.RequiresMFA, Methods: resource.Methods, Effect: resource.Effect}
+		if len(condition.UserRoles) != 0 {
+			userEngine.Conditions = append(userEngine.Conditions, condition)
+			userIndexes = append(userIndexes, index)
+		} else {
+			otherEngine.Conditions = append(otherEngine.Conditions, condition)
+			otherIndexes = append(otherIndexes, index)
+		}
+	}
+
+	decision, userTraces := userEngine.Explain(method, path)
+	_, otherTraces := otherEngine.Explain(method, path)
+	var deciding *dto.Resource
+	for position, trace := range userTraces {
+		index := userIndexes[position]
+		result.Candidates[index] = candidateFromTrace(resources[index], trace)
+		if trace.Deciding {
+			deciding = &resources[index]
+		}
+	}
+
+	for position, trace := range otherTraces {
+		// user has no role on those resources, they decide nothing
+		index := otherIndexes[position]
+		result.Candidates[index] = candidateFromTrace(resources[index], trace)
+		result.Candidates[index].Applies = false
+		result.Candidates[index].Deciding = false
+	}
+
+	result.Allowed = decision.Allowed
+	result.Roles = decision.Roles
+	result.RequiresMFA = decision.RequiresMFA
+	if deciding == nil {
+		result.Reason = "no resource matching the request grants a role to the user"
+	} else if !decision.Allowed {
+		result.Reason = fmt.Sprintf("denied by resource %d (%s %s)", deciding.ID, deciding.Operator, deciding.Template)
+	} else {
+		result.Reason = fmt.Sprintf("allowed by resource %d (%s %s)", deciding.ID, deciding.Operator, deciding.Template)
+	}
+
+	return result
+}
+
+// candidateFromTrace builds the candidate rule of a resource from its trace
+func candidateFromTrace(resource dto.Resource, trace RuleTrace) CandidateRule {
+	return CandidateRule{
+		Resource:        resource,
+		GrantedRoles:    trace.Condition.UserRoles,
+		MethodMatches:   trace.MethodMatches,
+		TemplateMatches: trace.TemplateMatches,
+		Captures:        trace.Captures,
+		Applies:         trace.Matches(),
+		Deciding:        trace.Deciding,
+	}
+}
+
+// EndpointExplainAccess explains the access decision for an user, a method and a path
+var EndpointExplainAccess = JSON(explainAccess)
+
+// explainAccess explains the access decision for an user, from the resources and the grants in database
+func explainAccess(c *HandlerContext, request AccessQuestion) (AccessExplanation, error) {
+	if !strings.HasPrefix(request.Path, "/") {
+		return AccessExplanation{}, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "path should start with /")
+	} else if resources, err := c.Dao.GetResources(c.GetCurrentContext()); err != nil {
+		return AccessExplanation{}, err
+	} else if granted, err := c.Dao.GetUserGrantedResources(c.GetCurrentContext(), request.User); err != nil {
+		return AccessExplanation{}, err
+	} else {
+		result := ExplainAccess(request.Method, request.Path, resources, granted)
+		result.User = request.User
+		return result, nil
+	}
+}
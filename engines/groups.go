@@ -0,0 +1,53 @@
+package engines
+
+import "strings"
+
+// RouteGroup registers routes sharing a path prefix and a chain of middlewares.
+// For instance, engine.Group("/manage", auth, roles) then group.AddProcessors("GET", "/user/{username}", endpoint)
+// registers GET /manage/user/{username} with auth, roles, endpoint as processors
+type RouteGroup struct {
+	// engine to register routes into
+	engine *ProcessingEngine
+	// prefix of all the routes of the group (no trailing /)
+	prefix string
+	// middlewares to run before processors of each route
+	middlewares []RequestProcessor
+	// protected is true if access to routes of the group depends on auth.resources
+	protected bool
+}
+
+// Group returns a nested group: prefix is appended to the current one, middlewares run after the current ones
+func (g *RouteGroup) Group(prefix string, middlewares ...RequestProcessor) *RouteGroup {
+	var allMiddlewares []RequestProcessor
+	allMiddlewares = append(allMiddlewares, g.middlewares...)
+	allMiddlewares = append(allMiddlewares, middlewares...)
+	return &RouteGroup{
+		engine:      g.engine,
+		prefix:      g.prefix + strings.TrimSuffix(prefix, "/"),
+		middlewares: allMiddlewares,
+		protected:   g.protected,
+	}
+}
+
+// Protected flags routes of the group (and of its nested groups) as protected by auth.resources.
+// It does not change processing (middlewares do), it documents routes and allows checks on resources
+func (g *RouteGroup) Protected() *RouteGroup {
+	g.protected = true
+	return g
+}
+
+// AddProcessors links a (method + prefix + urlpattern) to group middlewares and then to processors
+func (g *RouteGroup) AddProcessors(method string, urlPattern string, processors ...RequestProcessor) *Route {
+	var allProcessors []RequestProcessor
+	allProcessors = append(allProcessors, g.middlewares...)
+	allProcessors = append(allProcessors, processors...)
+	route := g.engine.AddProcessors(method, g.prefix+urlPattern, allProcessors...)
+	route.Protected = g.protected
+	return route
+}
+
+// Override links a (method + prefix + urlpattern) to processors only: group middlewares do not apply to that route.
+// Route is then not flagged as protected
+func (g *RouteGroup) Override(method string, urlPattern string, processors ...RequestProcessor) *Route {
+	return g.engine.AddProcessors(method, g.prefix+urlPattern, processors...)
+}
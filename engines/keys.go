@@ -0,0 +1,417 @@
+package engines
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// Supported algorithms to sign tokens
+const (
+	ALGORITHM_HS256 = "HS256"
+	ALGORITHM_RS256 = "RS256"
+	ALGORITHM_EDDSA = "EdDSA"
+)
+
+// KEYS_TO_KEEP is the number of keys to verify tokens with: current one and previous ones, so that rotation does not invalidate tokens
+const KEYS_TO_KEEP = 3
+
+// keysReloadDelay is the minimum delay between two reloads when a token refers to an unknown key
+const keysReloadDelay = 10 * time.Second
+
+// KeyStore persists signing keys, so that instances share them and keys survive restarts
+type KeyStore interface {
+	// GetSigningKeys returns the keys, most recent first
+	GetSigningKeys(ctx context.Context) ([]dto.SigningKey, error)
+	// AddSigningKey adds a key that becomes the current one, and keeps the keep most recent keys
+	AddSigningKey(ctx context.Context, key dto.SigningKey, keep int) error
+}
+
+// signingKey is a parsed key, ready to sign and verify
+type signingKey struct {
+	// id is the kid header of tokens signed with that key
+	id string
+	// method signs and verifies tokens
+	method jwt.SigningMethod
+	// signing is the secret or private key
+	signing any
+	// verifying is the secret or public key
+	verifying any
+	// createdAt is the creation date of the key
+	createdAt time.Time
+}
+
+// KeyRing signs tokens with its current key and verifies tokens with any of its keys, based on the kid header.
+// Keys are stored in a key store, if any, and reloaded when a token refers to a key created by another instance
+type KeyRing struct {
+	// lock protects keys and lastReload
+	lock sync.RWMutex
+	// algorithm of the keys to create
+	algorithm string
+	// store to persist keys, nil to keep keys in memory
+	store KeyStore
+	// keys are the keys, current one first
+	keys []signingKey
+	// lastReload is the last time keys were loaded from the store
+	lastReload time.Time
+}
+
+// NewKeyRing builds an empty key ring creating keys for that algorithm.
+// Store may be nil, keys are then lost on restart. Call Load before use
+func NewKeyRing(algorithm string, store KeyStore) (*KeyRing, error) {
+	switch algorithm {
+	case ALGORITHM_HS256, ALGORITHM_RS256, ALGORITHM_EDDSA:
+		return &KeyRing{algorithm: algorithm, store: store}, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s", algorithm)
+	}
+}
+
+// Load loads the keys from the store. A key is created if there is none, or if current key does not use the expected algorithm.
+// For HS256, first key is secret, if not empty
+func (k *KeyRing) Load(ctx context.Context, secret string) error {
+	if err := k.reload(ctx); err != nil {
+		return err
+	}
+
+	k.lock.RLock()
+	var current *signingKey
+	if len(k.keys) != 0 {
+		current = &k.keys[0]
+	}
+	k.lock.RUnlock()
+
+	if current != nil && current.method.Alg() == k.algorithm {
+		return nil
+	} else if current == nil && k.algorithm == ALGORITHM_HS256 && secret != "" {
+		hash := sha256.Sum256([]byte(secret))
+		key := dto.SigningKey{ID: "secret-" + hex.EncodeToString(hash[:8]), Algorithm: ALGORITHM_HS256, Material: []byte(secret), CreatedAt: time.Now()}
+		return k.add(ctx, key)
+	} else if key, err := newSigningKey(k.algorithm); err != nil {
+		return err
+	} else {
+		return k.add(ctx, key)
+	}
+}
+
+// Rotate creates a new current key, and returns its id. Previous keys still verify tokens
+func (k *KeyRing) Rotate(ctx context.Context) (string, error) {
+	if key, err := newSigningKey(k.algorithm); err != nil {
+		return "", err
+	} else if err := k.add(ctx, key); err != nil {
+		return "", err
+	} else {
+		return key.ID, nil
+	}
+}
+
+// Schedule rotates keys once current key is older than period, until context is done.
+// Keys are also reloaded regularly, to use keys created by other instances
+func (k *KeyRing) Schedule(ctx context.Context, period time.Duration, logger *log.Logger) {
+	go func() {
+		ticker := time.NewTicker(min(period, time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.reload(ctx); err != nil {
+					logger.Println("KEYS: failed to reload keys:", err)
+				} else if k.CurrentKeyAge() < period {
+					continue
+				} else if id, err := k.Rotate(ctx); err != nil {
+					logger.Println("KEYS: failed to rotate keys:", err)
+				} else {
+					logger.Println("KEYS: rotated keys, current key is", id)
+				}
+			}
+		}
+	}()
+}
+
+// CurrentKeyAge returns the age of the current key
+func (k *KeyRing) CurrentKeyAge() time.Duration {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if len(k.keys) == 0 {
+		return 0
+	}
+
+	return time.Since(k.keys[0].createdAt)
+}
+
+// Sign signs claims with the current key, and sets the kid header
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	k.lock.RLock()
+	if len(k.keys) == 0 {
+		k.lock.RUnlock()
+		return "", errors.New("no signing key")
+	}
+
+	current := k.keys[0]
+	k.lock.RUnlock()
+
+	token := jwt.NewWithClaims(current.method, claims)
+	token.Header["kid"] = current.id
+	return token.SignedString(current.signing)
+}
+
+// Parse parses a token and verifies its signature with the key matching its kid header
+func (k *KeyRing) Parse(ctx context.Context, tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
+		if id, ok := token.Header["kid"].(string); !ok || id == "" {
+			return nil, errors.New("missing key id")
+		} else if key := k.find(ctx, id); key == nil {
+			return nil, errors.New("unknown key id")
+		} else if key.method.Alg() != token.Method.Alg() {
+			return nil, errors.New("algorithm mismatch for key")
+		} else {
+			return key.verifying, nil
+		}
+	}, jwt.WithValidMethods([]string{ALGORITHM_HS256, ALGORITHM_RS256, ALGORITHM_EDDSA}))
+}
+
+// find returns the key with that id, reloading keys from the store if key is unknown (nil if no such key)
+func (k *KeyRing) find(ctx context.Context, id string) *signingKey {
+	k.lock.RLock()
+	key, shouldReload := k.lookup(id), k.store != nil && time.Since(k.lastReload) > keysReloadDelay
+	k.lock.RUnlock()
+
+	if key != nil || !shouldReload {
+		return key
+	} else if err := k.reload(ctx); err != nil {
+		return nil
+	}
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.lookup(id)
+}
+
+// lookup returns the key with that id, nil if none. Caller holds the lock
+func (k *KeyRing) lookup(id string) *signingKey {
+	for index := range k.keys {
+		if k.keys[index].id == id {
+			return &k.keys[index]
+		}
+	}
+
+	return nil
+}
+
+// add stores a key that becomes the current one
+func (k *KeyRing) add(ctx context.Context, key dto.SigningKey) error {
+	if k.store != nil {
+		if err := k.store.AddSigningKey(ctx, key, KEYS_TO_KEEP); err != nil {
+			return err
+		}
+
+		return k.reload(ctx)
+	}
+
+	parsed, err := parseSigningKey(key)
+	if err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = append([]signingKey{parsed}, k.keys...)
+	if len(k.keys) > KEYS_TO_KEEP {
+		k.keys = k.keys[:KEYS_TO_KEEP]
+	}
+
+	return nil
+}
+
+// reload loads keys from the store, if any
+func (k *KeyRing) reload(ctx context.Context) error {
+	if k.store == nil {
+		return nil
+	}
+
+	stored, err := k.store.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]signingKey, 0, len(stored))
+	for _, value := range stored {
+		if parsed, err := parseSigningKey(value); err != nil {
+			return err
+		} else {
+			keys = append(keys, parsed)
+		}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = keys
+	k.lastReload = time.Now()
+	return nil
+}
+
+// newSigningKey creates a random key for that algorithm
+func newSigningKey(algorithm string) (dto.SigningKey, error) {
+	result := dto.SigningKey{ID: uuid.NewString(), Algorithm: algorithm, CreatedAt: time.Now()}
+	switch algorithm {
+	case ALGORITHM_HS256:
+		result.Material = make([]byte, 64)
+		if _, err := rand.Read(result.Material); err != nil {
+			return result, err
+		}
+	case ALGORITHM_RS256:
+		if privateKey, err := rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return result, err
+		} else if material, err := x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
+			return result, err
+		} else {
+			result.Material = material
+		}
+	case ALGORITHM_EDDSA:
+		if _, privateKey, err := ed25519.GenerateKey(rand.Reader); err != nil {
+			return result, err
+		} else if material, err := x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
+			return result, err
+		} else {
+			result.Material = material
+		}
+	default:
+		return result, fmt.Errorf("unsupported signing algorithm %s", algorithm)
+	}
+
+	return result, nil
+}
+
+// parseSigningKey parses a stored key
+func parseSigningKey(key dto.SigningKey) (signingKey, error) {
+	result := signingKey{id: key.ID, createdAt: key.CreatedAt}
+	switch key.Algorithm {
+	case ALGORITHM_HS256:
+		result.method = jwt.SigningMethodHS256
+		result.signing = key.Material
+		result.verifying = key.Material
+		return result, nil
+	case ALGORITHM_RS256:
+		if parsed, err := x509.ParsePKCS8PrivateKey(key.Material); err != nil {
+			return result, err
+		} else if privateKey, ok := parsed.(*rsa.PrivateKey); !ok {
+			return result, fmt.Errorf("key %s is not a RSA key", key.ID)
+		} else {
+			result.method = jwt.SigningMethodRS256
+			result.signing = privateKey
+			result.verifying = &privateKey.PublicKey
+			return result, nil
+		}
+	case ALGORITHM_EDDSA:
+		if parsed, err := x509.ParsePKCS8PrivateKey(key.Material); err != nil {
+			return result, err
+		} else if privateKey, ok := parsed.(ed25519.PrivateKey); !ok {
+			return result, fmt.Errorf("key %s is not an ed25519 key", key.ID)
+		} else {
+			result.method = jwt.SigningMethodEdDSA
+			result.signing = privateKey
+			result.verifying = privateKey.Public()
+			return result, nil
+		}
+	default:
+		return result, fmt.Errorf("unsupported signing algorithm %s for key %s", key.Algorithm, key.ID)
+	}
+}
+
+// JSONWebKey is a public key, as defined in RFC 7517
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// Modulus and Exponent are set for RSA keys
+	Modulus  string `json:"n,omitempty"`
+	Exponent string `json:"e,omitempty"`
+	// Curve and X are set for ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet is a set of public keys
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// PublicKeys returns the public keys of the ring. HS256 keys are secret, and then never published
+func (k *KeyRing) PublicKeys() JSONWebKeySet {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	result := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.keys {
+		webKey := JSONWebKey{KeyID: key.id, Algorithm: key.method.Alg(), Use: "sig"}
+		switch publicKey := key.verifying.(type) {
+		case *rsa.PublicKey:
+			webKey.KeyType = "RSA"
+			webKey.Modulus = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			webKey.Exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			webKey.KeyType = "OKP"
+			webKey.Curve = "Ed25519"
+			webKey.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+
+		result.Keys = append(result.Keys, webKey)
+	}
+
+	return result
+}
+
+// BuildJWKSHandler sends the public keys of the ring, for other services to verify tokens
+func BuildJWKSHandler(keys *KeyRing) RequestProcessor {
+	return func(c *HandlerContext) error {
+		headers := http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"max-age=300"}}
+		if err := c.BuildJson(http.StatusOK, keys.PublicKeys(), headers); err != nil {
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+		}
+
+		return nil
+	}
+}
+
+// KeyRotation is the result of a key rotation
+type KeyRotation struct {
+	// KeyID is the id of the new current key
+	KeyID string `json:"kid"`
+}
+
+// BuildRotateKeysHandler creates a new current key. Tokens signed with previous keys remain valid
+func BuildRotateKeysHandler(keys *KeyRing) RequestProcessor {
+	return JSON(func(c *HandlerContext, request NoContent) (KeyRotation, error) {
+		var result KeyRotation
+		if id, err := keys.Rotate(c.GetCurrentContext()); err != nil {
+			return result, err
+		} else {
+			result.KeyID = id
+		}
+
+		c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "keys", fmt.Sprintf("user %s rotates signing keys, current key is %s", c.GetLogin(), result.KeyID), nil)
+		return result, nil
+	})
+}
@@ -1,33 +1,65 @@
 package engines
 
 import (
-	"context"
+	"math"
 	"net/http"
-	"time"
+	"strconv"
 )
 
-// Login tests a POST content (username, password) and validates an user
-func BuildLoginHandler(secret string, tokenDuration time.Duration) RequestProcessor {
+// BuildLoginHandler tests a POST content (username, password) and validates an user.
+// Response contains an access token (also set in the Authorization header) and a refresh token.
+// Failed attempts are throttled per user and per client address.
+// If user enabled a second factor, response is a MFA challenge instead (see BuildMFALoginHandler)
+func BuildLoginHandler(tokens *TokenIssuer, throttle LoginThrottle) RequestProcessor {
 	return func(c *HandlerContext) error {
 		var auth UserInformation
 		if err := c.BindJsonBody(&auth); err != nil {
-			c.Build(http.StatusBadRequest, "expecting name and password", nil)
+			c.BuildErrorMessage(http.StatusBadRequest, "expecting name and password", nil)
+			return nil
+		} else if wait, err := throttle.blockedFor(c, auth.Username); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if wait > 0 {
+			retry := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+			c.BuildErrorMessage(http.StatusTooManyRequests, "too many failed attempts, retry later", http.Header{"Retry-After": {retry}})
 			return nil
 		} else if valid, err := c.Dao.ValidateUser(c.GetCurrentContext(), auth.Username, auth.Password); err != nil {
 			// validate user auth
 			c.BuildError(http.StatusInternalServerError, err, nil)
 			return nil
 		} else if !valid {
-			c.Build(http.StatusUnauthorized, "", nil)
+			if err := throttle.failure(c, auth.Username); err != nil {
+				c.BuildError(http.StatusInternalServerError, err, nil)
+			} else {
+				c.BuildErrorMessage(http.StatusUnauthorized, "invalid name or password", nil)
+			}
+
 			return nil
-		} else if token, err := CreateToken(auth.Username, secret, tokenDuration); err != nil {
+		} else if err := throttle.success(c, auth.Username); err != nil {
 			c.BuildError(http.StatusInternalServerError, err, nil)
 			return nil
-		} else {
+		} else if _, enabled, err := c.Dao.GetMFA(c.GetCurrentContext(), auth.Username); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if enabled {
+			// password is valid, user should now send the second factor
+			if challenge, err := tokens.CreateChallengeToken(auth.Username); err != nil {
+				c.BuildError(http.StatusInternalServerError, err, nil)
+			} else if err := c.BuildJson(http.StatusAccepted, MFAChallenge{MFARequired: true, MFAToken: challenge, ExpiresIn: int64(tokens.ChallengeDuration.Seconds())}, nil); err != nil {
+				c.ClearResponse()
+				c.BuildError(http.StatusInternalServerError, err, nil)
+			}
+
+			return nil
+		} else if pair, err := tokens.issueTokens(c, auth.Username, false); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if err := c.BuildJson(http.StatusAccepted, pair, http.Header{"Authorization": {"Bearer " + pair.AccessToken}}); err != nil {
 			// user auth is valid
-			c.SetResponseHeader("Authorization", "Bearer "+token)
-			c.SetResponseStatus(http.StatusAccepted)
-			c.Done()
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else {
 			return nil
 		}
 	}
@@ -36,12 +68,12 @@ func BuildLoginHandler(secret string, tokenDuration time.Duration) RequestProces
 // EndpointChangePassword changes current user's password
 func EndpointChangePassword(c *HandlerContext) error {
 	if login := c.GetLogin(); login == "" {
-		c.Build(http.StatusInternalServerError, "no user found", nil)
+		c.BuildErrorMessage(http.StatusInternalServerError, "no user found", nil)
 	} else if password, err := c.RequestBodyAsString(); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 	} else if !ValidateUserpasswordFormat(string(password)) {
-		c.Build(http.StatusForbidden, "invalid password format", nil)
-	} else if err := c.Dao.UpsertUser(context.Background(), login, password); err != nil {
+		c.BuildErrorMessage(http.StatusForbidden, "invalid password format", nil)
+	} else if err := c.Dao.UpsertUser(c.GetCurrentContext(), login, password); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 	} else {
 		c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
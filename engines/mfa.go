@@ -0,0 +1,196 @@
+package engines
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MFAChallenge is the login response when user enabled a second factor
+type MFAChallenge struct {
+	// MFARequired is always true, to distinguish from a token pair
+	MFARequired bool `json:"mfa_required"`
+	// MFAToken is the token to send with the second factor
+	MFAToken string `json:"mfa_token"`
+	// ExpiresIn is the validity of the challenge token, in seconds
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// MFAVerification is the body to send the second factor after a challenge
+type MFAVerification struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	// Code is either a TOTP code or a recovery code
+	Code string `json:"code" validate:"required"`
+}
+
+// MFACode is the body to send a TOTP code (or a recovery code to disable)
+type MFACode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// MFAEnrollment is the new secret of an user, to register in an authenticator app
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	// ProvisioningURI is the otpauth URI, to display as a QR code
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// RecoveryCodes are single use codes to use when authenticator app is lost. They are displayed once
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// verifyFactor returns true if code is a valid second factor for that user.
+// TOTP codes are used once, recovery codes are consumed
+func verifyFactor(c *HandlerContext, login, code string) (bool, error) {
+	if !IsTOTPCodeFormat(code) {
+		return c.Dao.ConsumeRecoveryCode(c.GetCurrentContext(), login, HashRecoveryCode(code))
+	} else if secret, enabled, err := c.Dao.GetMFA(c.GetCurrentContext(), login); err != nil {
+		return false, err
+	} else if !enabled || secret == "" {
+		return false, nil
+	} else if step, valid, err := ValidateTOTP(secret, code, time.Now()); err != nil || !valid {
+		return false, err
+	} else {
+		// a code is valid for a few periods, replaying it should fail
+		return c.Dao.MarkTOTPCodeUsed(c.GetCurrentContext(), login, step, (2*TOTP_SKEW+1)*TOTP_PERIOD)
+	}
+}
+
+// BuildMFALoginHandler exchanges a MFA challenge token and a second factor for a token pair.
+// Failed attempts are throttled as failed logins
+func BuildMFALoginHandler(tokens *TokenIssuer, throttle LoginThrottle) RequestProcessor {
+	return func(c *HandlerContext) error {
+		var request MFAVerification
+		if err := c.BindJsonBody(&request); err != nil || ValidateStruct(request) != nil {
+			c.BuildErrorMessage(http.StatusBadRequest, "expecting challenge token and code", nil)
+			return nil
+		} else if challenge, err := tokens.VerifyChallengeToken(c.GetCurrentContext(), request.MFAToken); err != nil {
+			c.BuildError(http.StatusUnauthorized, err, nil)
+			return nil
+		} else if revoked, err := c.Dao.IsTokenRevoked(c.GetCurrentContext(), challenge.ID, challenge.Username, challenge.IssuedAt); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if revoked {
+			c.BuildErrorMessage(http.StatusUnauthorized, "challenge already used", nil)
+			return nil
+		} else if wait, err := throttle.blockedFor(c, challenge.Username); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if wait > 0 {
+			retry := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+			c.BuildErrorMessage(http.StatusTooManyRequests, "too many failed attempts, retry later", http.Header{"Retry-After": {retry}})
+			return nil
+		} else if valid, err := verifyFactor(c, challenge.Username, request.Code); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if !valid {
+			if err := throttle.failure(c, challenge.Username); err != nil {
+				c.BuildError(http.StatusInternalServerError, err, nil)
+			} else {
+				c.BuildErrorMessage(http.StatusUnauthorized, "invalid code", nil)
+			}
+
+			return nil
+		} else if err := throttle.success(c, challenge.Username); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if err := c.Dao.RevokeToken(c.GetCurrentContext(), challenge.ID, challenge.ExpirationTime); err != nil {
+			// challenge is used once
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if pair, err := tokens.issueTokens(c, challenge.Username, true); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if err := c.BuildJson(http.StatusAccepted, pair, http.Header{"Authorization": {"Bearer " + pair.AccessToken}}); err != nil {
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else {
+			return nil
+		}
+	}
+}
+
+// BuildMFAEnrollHandler creates a new pending secret for current user. Secret is enabled once user sends a valid code.
+// Issuer is the name displayed in authenticator apps
+func BuildMFAEnrollHandler(issuer string) RequestProcessor {
+	return JSON(func(c *HandlerContext, request NoContent) (MFAEnrollment, error) {
+		var result MFAEnrollment
+		login := c.GetLogin()
+		if _, enabled, err := c.Dao.GetMFA(c.GetCurrentContext(), login); err != nil {
+			return result, err
+		} else if enabled {
+			return result, NewApiError(http.StatusConflict, ErrorCodeConflict, "second factor already enabled, disable it first")
+		} else if secret, err := NewTOTPSecret(); err != nil {
+			return result, err
+		} else if err := c.Dao.SetPendingMFA(c.GetCurrentContext(), login, secret); err != nil {
+			return result, err
+		} else {
+			result.Secret = secret
+			result.ProvisioningURI = TOTPProvisioningURI(issuer, login, secret)
+			return result, nil
+		}
+	})
+}
+
+// EndpointMFAActivate enables the pending secret of current user if code is valid, and returns recovery codes
+var EndpointMFAActivate = JSON(activateMFA)
+
+// activateMFA enables the pending secret of current user if code is valid, and returns recovery codes
+func activateMFA(c *HandlerContext, request MFACode) (RecoveryCodes, error) {
+	var result RecoveryCodes
+	login := c.GetLogin()
+	if secret, enabled, err := c.Dao.GetMFA(c.GetCurrentContext(), login); err != nil {
+		return result, err
+	} else if enabled {
+		return result, NewApiError(http.StatusConflict, ErrorCodeConflict, "second factor already enabled")
+	} else if secret == "" {
+		return result, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no pending secret, enroll first")
+	} else if step, valid, err := ValidateTOTP(secret, request.Code, time.Now()); err != nil {
+		return result, err
+	} else if !valid {
+		return result, NewApiError(http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid code")
+	} else if unused, err := c.Dao.MarkTOTPCodeUsed(c.GetCurrentContext(), login, step, (2*TOTP_SKEW+1)*TOTP_PERIOD); err != nil {
+		return result, err
+	} else if !unused {
+		// a code is valid for a few periods, replaying it should fail
+		return result, NewApiError(http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid code")
+	} else if codes, err := NewRecoveryCodes(RECOVERY_CODES_COUNT); err != nil {
+		return result, err
+	} else {
+		hashes := make([][]byte, 0, len(codes))
+		for _, code := range codes {
+			hashes = append(hashes, HashRecoveryCode(code))
+		}
+
+		if err := c.Dao.EnableMFA(c.GetCurrentContext(), login, hashes); err != nil {
+			return result, err
+		}
+
+		c.Dao.LogEvent(c.GetCurrentContext(), login, "security", fmt.Sprintf("user %s enables second factor", login), nil)
+		result.Codes = codes
+		return result, nil
+	}
+}
+
+// EndpointMFADisable removes the second factor of current user, given a valid code (TOTP or recovery)
+var EndpointMFADisable = JSON(disableMFA)
+
+// disableMFA removes the second factor of current user, given a valid code (TOTP or recovery)
+func disableMFA(c *HandlerContext, request MFACode) (NoContent, error) {
+	var result NoContent
+	login := c.GetLogin()
+	if valid, err := verifyFactor(c, login, request.Code); err != nil {
+		return result, err
+	} else if !valid {
+		return result, NewApiError(http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid code")
+	} else if err := c.Dao.DisableMFA(c.GetCurrentContext(), login); err != nil {
+		return result, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), login, "security", fmt.Sprintf("user %s disables second factor", login), nil)
+	return result, nil
+}
@@ -1,71 +1,93 @@
 package engines
 
 import (
-	"context"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
-)
 
-// ValidateQueryProcessor returns a processor that validates the query method type
-func ValidateQueryProcessor(requestMethod string) RequestProcessor {
-	return func(context *HandlerContext) error {
-		if !strings.EqualFold(requestMethod, context.GetRequestMethod()) {
-			context.Build(http.StatusMethodNotAllowed, "", nil)
-		}
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
 
+// TimeoutMiddleware returns a processor that limits the processing time of the rest of the chain.
+// Add it first when registering a route to set a timeout for that route.
+// A route may override a group timeout: the last timeout replaces the previous ones
+func TimeoutMiddleware(delay time.Duration) RequestProcessor {
+	return func(c *HandlerContext) error {
+		c.SetTimeout(delay)
 		return nil
 	}
 }
 
-// AuthenticationMiddleware builds a middleware to deal with auth
-func AuthenticationMiddleware(secret string, tokenDuration time.Duration) RequestProcessor {
+// AuthenticationMiddleware builds a middleware to deal with auth.
+// Access token should be valid and not revoked (see Dao.IsTokenRevoked). Token is not renewed, clients use refresh tokens.
+// Personal access tokens are also accepted, as long as they are not expired or revoked
+func AuthenticationMiddleware(tokens *TokenIssuer) RequestProcessor {
 	// this function tests the token and then sets main headers
 	return func(c *HandlerContext) error {
 		// get the bearer and token as a whole reading the header
 		tokenString := c.GetRequestHeaderFirstValue("Authorization")
 		if tokenString == "" {
-			c.Build(http.StatusUnauthorized, "missing authorization header", nil)
+			c.BuildErrorMessage(http.StatusUnauthorized, "missing authorization header", nil)
 			return nil
 		}
 
 		// get rid of "Bearer " to get only the token
-		tokenString = tokenString[len("Bearer "):]
+		tokenString, found := strings.CutPrefix(tokenString, "Bearer ")
+		if !found || tokenString == "" {
+			c.BuildErrorMessage(http.StatusUnauthorized, "expecting a bearer token", nil)
+			return nil
+		}
+
+		// personal access tokens are stored, no JWT
+		if IsAccessTokenFormat(tokenString) {
+			if id, login, err := c.Dao.UseAccessToken(c.GetCurrentContext(), HashAccessToken(tokenString)); err != nil {
+				c.BuildError(http.StatusInternalServerError, err, nil)
+			} else if id == "" {
+				c.BuildErrorMessage(http.StatusUnauthorized, "invalid, expired or revoked access token", nil)
+			} else {
+				c.SetLogin(login)
+				c.CurrentAuth.AccessTokenID = id
+			}
+
+			return nil
+		}
 
 		// Either token is valid and we know the user, or we stop right here.
-		// If token is valid, renew the token so that user has more time
-		if token, err := VerifyToken(secret, tokenString); err != nil {
+		if token, err := tokens.VerifyAccessToken(c.GetCurrentContext(), tokenString); err != nil {
 			c.BuildError(http.StatusUnauthorized, err, nil)
-			return nil
-		} else if newToken, err := CreateToken(token.Username, secret, tokenDuration); err != nil {
-			c.Build(http.StatusInternalServerError, fmt.Sprintf("cannot renew token: %s", err.Error()), nil)
-			return nil
+		} else if revoked, err := c.Dao.IsTokenRevoked(c.GetCurrentContext(), token.ID, token.Username, token.IssuedAt); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+		} else if revoked {
+			c.BuildErrorMessage(http.StatusUnauthorized, "revoked token", nil)
 		} else {
-			c.SetResponseHeader("Authorization", "Bearer "+newToken)
 			c.SetLogin(token.Username)
-			return nil
+			c.CurrentAuth.Token = token
 		}
+
+		return nil
 	}
 }
 
-// RolesBasedMiddleware tests if user may access this page or not, based on roles based conditions in database
+// RolesBasedMiddleware tests if user may access this page or not, based on roles based conditions in database.
+// Pages of features requiring a second factor need a token obtained with a second factor.
+// Personal access tokens have their own roles (see Dao.GetAccessTokenGrantedAccess)
 func RolesBasedMiddleware() RequestProcessor {
 	return func(c *HandlerContext) error {
 		if login := c.GetLogin(); login == "" {
-			c.Build(http.StatusInternalServerError, "no user found", nil)
-		} else if conditions, err := c.Dao.GetUserGrantedAccess(context.Background(), login); err != nil {
+			c.BuildErrorMessage(http.StatusInternalServerError, "no user found", nil)
+		} else if conditions, err := grantedAccess(c, login); err != nil {
 			c.BuildError(http.StatusInternalServerError, err, nil)
 		} else {
 			engine := AuthRulesEngine{Conditions: conditions}
-			if accept, roles, err := engine.CanAccessResource(c.GetRequestPath()); err != nil {
-				c.BuildError(http.StatusInternalServerError, err, nil)
-			} else if !accept {
-				c.Build(http.StatusUnauthorized, "cannot access resource due to missing permissions", nil)
-			} else if len(roles) == 0 {
-				c.Build(http.StatusUnauthorized, "no role set for resource", nil)
+			if decision := engine.Evaluate(c.GetRequestMethod(), c.GetRequestPath()); !decision.Allowed {
+				c.LogDenial(login, engine.ExplainCompact(c.GetRequestMethod(), c.GetRequestPath()))
+				c.BuildErrorMessage(http.StatusUnauthorized, "cannot access resource due to missing permissions", nil)
+			} else if len(decision.Roles) == 0 {
+				c.BuildErrorMessage(http.StatusUnauthorized, "no role set for resource", nil)
+			} else if decision.RequiresMFA && !c.CurrentAuth.Token.MFA {
+				c.BuildError(http.StatusForbidden, NewApiError(http.StatusForbidden, ErrorCodeMFARequired, "second factor required for this resource"), nil)
 			} else {
-				c.SetRoles(roles)
+				c.SetRoles(decision.Roles)
 			}
 		}
 
@@ -73,3 +95,22 @@ func RolesBasedMiddleware() RequestProcessor {
 		return nil
 	}
 }
+
+// grantedAccess returns the grant conditions of the request: the roles of the personal access token if any, of the user otherwise.
+// Permissions in the access token are used as long as they are not stale, database is used otherwise
+func grantedAccess(c *HandlerContext, login string) ([]dto.GrantAccessForResource, error) {
+	if c.CurrentAuth.AccessTokenID != "" {
+		return c.Dao.GetAccessTokenGrantedAccess(c.GetCurrentContext(), c.CurrentAuth.AccessTokenID)
+	} else if permissions := c.CurrentAuth.Token.Permissions; permissions == nil {
+		return c.Dao.GetUserGrantedAccess(c.GetCurrentContext(), login)
+	} else if version, err := c.Dao.GetPermissionsVersion(c.GetCurrentContext(), login); err != nil {
+		return nil, err
+	} else if version != permissions.Version {
+		// grants changed since token was issued
+		return c.Dao.GetUserGrantedAccess(c.GetCurrentContext(), login)
+	} else if resources, err := c.Dao.GetCachedResources(c.GetCurrentContext()); err != nil {
+		return nil, err
+	} else {
+		return ConditionsFromPermissions(permissions.Roles, resources), nil
+	}
+}
@@ -0,0 +1,271 @@
+package engines
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// OPENAPI_VERSION is the version of the OpenAPI specification for generated documents
+const OPENAPI_VERSION = "3.1.0"
+
+// OpenAPIHandler returns a processor sending the OpenAPI document of the routes registered in the engine.
+// Feature and roles of protected routes are read from the resources in database when the document is requested
+func (e *ProcessingEngine) OpenAPIHandler(title, version string) RequestProcessor {
+	return func(c *HandlerContext) error {
+		if resources, err := c.Dao.GetResources(c.GetCurrentContext()); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+		} else if err := c.BuildJson(http.StatusOK, BuildOpenAPIDocument(title, version, e.Routes(), resources), http.Header{"Content-Type": {"application/json"}}); err != nil {
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+		}
+
+		return nil
+	}
+}
+
+// BuildOpenAPIDocument builds an OpenAPI document for those routes.
+// Protected routes get a bearer security requirement, and matching resources set the x-feature and x-roles extensions
+func BuildOpenAPIDocument(title, version string, routes []Route, resources []dto.Resource) map[string]any {
+	schemas := make(map[string]any)
+	builder := schemaBuilder{schemas: schemas}
+	paths := make(map[string]any)
+
+	for _, route := range routes {
+		path := route.OpenAPIPath()
+		operations, found := paths[path].(map[string]any)
+		if !found {
+			operations = make(map[string]any)
+			paths[path] = operations
+		}
+
+		operations[strings.ToLower(route.Method)] = builder.operation(route, resources)
+	}
+
+	schemas["ErrorEnvelope"] = builder.schemaOf(reflect.TypeOf(ErrorEnvelope{}))
+
+	return map[string]any{
+		"openapi": OPENAPI_VERSION,
+		"info":    map[string]any{"title": title, "version": version},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// schemaBuilder builds json schemas from go types, named structs going to components
+type schemaBuilder struct {
+	schemas map[string]any
+}
+
+// operation builds the OpenAPI operation for a route
+func (b *schemaBuilder) operation(route Route, resources []dto.Resource) map[string]any {
+	result := map[string]any{
+		"operationId": operationId(route),
+	}
+
+	if route.Summary != "" {
+		result["summary"] = route.Summary
+	}
+
+	// parameters: path first, then query
+	var parameters []any
+	for _, name := range route.Parameters() {
+		parameters = append(parameters, map[string]any{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]any{"type": "string"},
+		})
+	}
+
+	if route.RequestType != nil {
+		requestType := indirect(route.RequestType)
+		if requestType.Kind() == reflect.Struct && requestType != reflect.TypeOf(time.Time{}) {
+			for _, field := range reflect.VisibleFields(requestType) {
+				if name := field.Tag.Get("query"); name != "" && field.IsExported() {
+					parameters = append(parameters, map[string]any{
+						"name":   name,
+						"in":     "query",
+						"schema": b.schemaOf(field.Type),
+					})
+				}
+			}
+		}
+
+		if body := b.requestBody(requestType); body != nil {
+			result["requestBody"] = body
+		}
+	}
+
+	if len(parameters) != 0 {
+		result["parameters"] = parameters
+	}
+
+	// responses: success, then any error as an envelope
+	success := map[string]any{"description": "success"}
+	if route.ResponseType != nil {
+		success["content"] = b.content(route.ResponseType)
+	}
+
+	result["responses"] = map[string]any{
+		"200": success,
+		"default": map[string]any{
+			"description": "error",
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/ErrorEnvelope"}},
+			},
+		},
+	}
+
+	// auth information for protected routes
+	if route.Protected {
+		result["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+		var features []string
+		var roles []string
+		samplePath := route.SamplePath()
+		for _, resource := range resources {
+			if resource.Effect != dto.EffectDeny && MatchesMethod(resource.Methods, route.Method) && MatchesTemplate(resource.Operator, resource.Template, samplePath) {
+				features = append(features, resource.Feature)
+				for _, role := range resource.Roles {
+					roles = append(roles, string(role))
+				}
+			}
+		}
+
+		slices.Sort(features)
+		slices.Sort(roles)
+		result["x-feature"] = slices.Compact(features)
+		result["x-roles"] = slices.Compact(roles)
+	}
+
+	return result
+}
+
+// requestBody returns the request body of a request type, nil if request has no body.
+// For structs, body is either the field tagged body:"true", or the fields that are neither path nor query parameters
+func (b *schemaBuilder) requestBody(requestType reflect.Type) map[string]any {
+	if requestType.Kind() != reflect.Struct || requestType == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"required": true, "content": b.content(requestType)}
+	}
+
+	for _, field := range reflect.VisibleFields(requestType) {
+		if field.Tag.Get("body") == "true" {
+			return map[string]any{"required": true, "content": b.content(field.Type)}
+		}
+	}
+
+	schema := b.objectSchema(requestType, true)
+	if properties, _ := schema["properties"].(map[string]any); len(properties) == 0 {
+		return nil
+	}
+
+	return map[string]any{
+		"required": true,
+		"content":  map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+// content returns the content for a body of that type: text for strings, json otherwise
+func (b *schemaBuilder) content(valueType reflect.Type) map[string]any {
+	if indirect(valueType).Kind() == reflect.String {
+		return map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+	}
+
+	return map[string]any{"application/json": map[string]any{"schema": b.schemaOf(valueType)}}
+}
+
+// schemaOf returns the json schema of a type. Named structs are added to components and referenced
+func (b *schemaBuilder) schemaOf(valueType reflect.Type) map[string]any {
+	valueType = indirect(valueType)
+	if valueType == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch valueType.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schemaOf(valueType.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schemaOf(valueType.Elem())}
+	case reflect.Struct:
+		name := valueType.Name()
+		if name == "" {
+			return b.objectSchema(valueType, false)
+		}
+
+		if _, found := b.schemas[name]; !found {
+			// reserve name first, for recursive types
+			b.schemas[name] = map[string]any{}
+			b.schemas[name] = b.objectSchema(valueType, false)
+		}
+
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	return map[string]any{}
+}
+
+// objectSchema returns the schema of a struct, with json fields as properties.
+// If bodyOnly, path and query parameters are excluded
+func (b *schemaBuilder) objectSchema(valueType reflect.Type, bodyOnly bool) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	for _, field := range reflect.VisibleFields(valueType) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		} else if bodyOnly && (field.Tag.Get("path") != "" || field.Tag.Get("query") != "") {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = b.schemaOf(field.Type)
+		if slices.Contains(strings.Split(field.Tag.Get("validate"), ","), "required") && !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	result := map[string]any{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		result["required"] = required
+	}
+
+	return result
+}
+
+// indirect returns the type pointed by pointers
+func indirect(valueType reflect.Type) reflect.Type {
+	for valueType.Kind() == reflect.Pointer {
+		valueType = valueType.Elem()
+	}
+
+	return valueType
+}
+
+// operationId builds a unique id for a route, for instance GET /manage/user/{username} gives get_manage_user_username
+func operationId(route Route) string {
+	replacer := strings.NewReplacer("/", "_", "{", "", "}", "", ".", "", "-", "_")
+	return strings.ToLower(route.Method) + replacer.Replace(strings.TrimSuffix(route.Pattern, "/"))
+}
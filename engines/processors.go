@@ -1,17 +1,23 @@
 package engines
 
 import (
-	"context"
 	"net/http"
+	"regexp"
+	"runtime/debug"
 
-	"github.com/zefrenchwan/scrutateur.git/storage"
+	"github.com/google/uuid"
 )
 
+// validCorrelationID accepts correlation ids sent by clients (anything else is replaced)
+var validCorrelationID = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,64}$`)
+
 // RequestProcessor is the general type to deal with http requests
 type RequestProcessor func(context *HandlerContext) error
 
-// BuildHandlerFunc links processors to process a request
-func BuildHandlerFunc(dao storage.Dao, processors ...RequestProcessor) func(http.ResponseWriter, *http.Request) {
+// BuildHandlerFunc links processors to process a request.
+// Processors run in order until one fails (error or panic) or builds a response ready to be sent.
+// Failures are delegated to the error handler (engine one, unless a processor overrides it)
+func (e *ProcessingEngine) BuildHandlerFunc(processors ...RequestProcessor) func(http.ResponseWriter, *http.Request) {
 	// no handler, default action
 	if len(processors) == 0 {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -20,27 +26,66 @@ func BuildHandlerFunc(dao storage.Dao, processors ...RequestProcessor) func(http
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		// request context is cancelled when client disconnects, so are storage calls using it
 		sharedContext := HandlerContext{
-			context:  context.Background(),
-			request:  NewRequestDecorator(r),
-			response: AbstractResponse{},
-			Dao:      dao,
+			context:       r.Context(),
+			request:       NewRequestDecorator(r),
+			response:      AbstractResponse{},
+			errorHandler:  e.errorHandler,
+			correlationID: correlationID(r),
+			logger:        e.logger,
+			routes:        e.Routes,
+			Dao:           e.dao,
 		}
 
-		for _, processor := range processors {
-			if err := processor(&sharedContext); err != nil {
-				w.Write([]byte(err.Error()))
-				w.WriteHeader(http.StatusInternalServerError)
-			} else if sharedContext.response.ShouldSend() {
-				sharedContext.response.Write(w)
-			}
-		}
+		// release resources linked to context (timeouts for instance) once request is processed
+		defer sharedContext.release()
+
+		runProcessors(&sharedContext, processors)
 
 		// write answer anyway, but do not assume it is ready
 		if !sharedContext.response.ShouldSend() {
 			sharedContext.ClearResponse()
 			sharedContext.SetResponseStatus(http.StatusPartialContent)
-			sharedContext.response.Write(w)
+			sharedContext.Done()
+		}
+
+		w.Header().Set(CORRELATION_HEADER, sharedContext.correlationID)
+		sharedContext.response.Write(w)
+	}
+}
+
+// correlationID returns the correlation id sent by the client if valid, a new one otherwise
+func correlationID(r *http.Request) string {
+	if value := r.Header.Get(CORRELATION_HEADER); validCorrelationID.MatchString(value) {
+		return value
+	}
+
+	return uuid.NewString()
+}
+
+// runProcessors runs processors until one fails or response is ready to be sent
+func runProcessors(c *HandlerContext, processors []RequestProcessor) {
+	defer func() {
+		if value := recover(); value != nil {
+			// aborting handler is the expected way to stop, let http server deal with it
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+
+			stack := debug.Stack()
+			c.ClearResponse()
+			c.errorHandler(c, PanicError{Value: value}, stack)
+		}
+	}()
+
+	for _, processor := range processors {
+		if err := processor(c); err != nil {
+			c.ClearResponse()
+			c.errorHandler(c, err, nil)
+			return
+		} else if c.response.ShouldSend() {
+			return
 		}
 	}
 }
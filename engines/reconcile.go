@@ -0,0 +1,139 @@
+package engines
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// RouteReference designates a registered route in a reconciliation report
+type RouteReference struct {
+	// Method of the route
+	Method string `json:"method"`
+	// Pattern of the route, for instance /manage/user/{username}/delete
+	Pattern string `json:"pattern"`
+}
+
+// ResourcesOverlap is a protected route matched by resources of several features:
+// a role on any of those features gives access to the route
+type ResourcesOverlap struct {
+	// Route is the route the resources match
+	Route RouteReference `json:"route"`
+	// Resources are the ids of the matching resources
+	Resources []int `json:"resources"`
+	// Features are the features of the matching resources, ordered by name
+	Features []string `json:"features"`
+}
+
+// ReconciliationReport compares the protected routes of the engine with the resources
+type ReconciliationReport struct {
+	// UnprotectedRoutes are the protected routes no allow resource matches: nobody may access them
+	UnprotectedRoutes []RouteReference `json:"unprotected_routes"`
+	// OrphanResources are the resources matching no protected route
+	OrphanResources []dto.Resource `json:"orphan_resources"`
+	// Overlaps are the protected routes matched by resources of several features
+	Overlaps []ResourcesOverlap `json:"overlaps"`
+	// InvalidResources are the resources with an invalid template (inserted in database directly): they match nothing
+	InvalidResources []dto.Resource `json:"invalid_resources"`
+}
+
+// Consistent returns true if each protected route has a resource, and each resource a valid template and a protected route.
+// Overlaps may be intended, they are only reported
+func (r ReconciliationReport) Consistent() bool {
+	return len(r.UnprotectedRoutes) == 0 && len(r.OrphanResources) == 0 && len(r.InvalidResources) == 0
+}
+
+// Describe returns a line per problem in the report, to log them
+func (r ReconciliationReport) Describe() []string {
+	var result []string
+	for _, route := range r.UnprotectedRoutes {
+		result = append(result, fmt.Sprintf("unprotected route: %s %s matches no resource", route.Method, route.Pattern))
+	}
+
+	for _, resource := range r.OrphanResources {
+		result = append(result, fmt.Sprintf("orphan resource: %d (%s %s in %s) matches no protected route", resource.ID, resource.Operator, resource.Template, resource.Feature))
+	}
+
+	for _, overlap := range r.Overlaps {
+		result = append(result, fmt.Sprintf("overlapping resources: %s %s matches resources %v of features %v", overlap.Route.Method, overlap.Route.Pattern, overlap.Resources, overlap.Features))
+	}
+
+	for _, resource := range r.InvalidResources {
+		result = append(result, fmt.Sprintf("invalid resource: %d (%s %s in %s) has an invalid template", resource.ID, resource.Operator, resource.Template, resource.Feature))
+	}
+
+	return result
+}
+
+// Reconcile compares protected routes with resources.
+// A route matches a resource if the sample path of the route (see Route.SamplePath) matches the resource, for the method of the route.
+// Resources with an invalid template are reported as invalid, not as orphans
+func Reconcile(routes []Route, resources []dto.Resource) ReconciliationReport {
+	var result ReconciliationReport
+	used := make([]bool, len(resources))
+	for index, resource := range resources {
+		if err := ValidateTemplate(resource.Operator, resource.Template); err != nil {
+			used[index] = true
+			result.InvalidResources = append(result.InvalidResources, resource)
+		}
+	}
+
+	for _, route := range routes {
+		if !route.Protected {
+			continue
+		}
+
+		path := route.SamplePath()
+		allowed := false
+		var ids []int
+		var features []string
+		for index, resource := range resources {
+			if !MatchesMethod(resource.Methods, route.Method) || !MatchesTemplate(resource.Operator, resource.Template, path) {
+				continue
+			}
+
+			used[index] = true
+			allowed = allowed || resource.Effect != dto.EffectDeny
+			ids = append(ids, resource.ID)
+			if !slices.Contains(features, resource.Feature) {
+				features = append(features, resource.Feature)
+			}
+		}
+
+		reference := RouteReference{Method: route.Method, Pattern: route.Pattern}
+		if !allowed {
+			result.UnprotectedRoutes = append(result.UnprotectedRoutes, reference)
+		}
+
+		if len(features) > 1 {
+			slices.Sort(features)
+			result.Overlaps = append(result.Overlaps, ResourcesOverlap{Route: reference, Resources: ids, Features: features})
+		}
+	}
+
+	for index, resource := range resources {
+		if !used[index] {
+			result.OrphanResources = append(result.OrphanResources, resource)
+		}
+	}
+
+	return result
+}
+
+// Reconcile compares the routes registered in the engine with the resources in database
+func (e *ProcessingEngine) Reconcile(ctx context.Context) (ReconciliationReport, error) {
+	if resources, err := e.dao.GetResources(ctx); err != nil {
+		return ReconciliationReport{}, err
+	} else {
+		return Reconcile(e.Routes(), resources), nil
+	}
+}
+
+// ReconciliationHandler returns a processor sending the reconciliation report of the engine
+func (e *ProcessingEngine) ReconciliationHandler() RequestProcessor {
+	return JSON(func(c *HandlerContext, request NoContent) (ReconciliationReport, error) {
+		return e.Reconcile(c.GetCurrentContext())
+	})
+}
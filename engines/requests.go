@@ -1,8 +1,10 @@
 package engines
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"regexp"
 	"slices"
@@ -20,6 +22,20 @@ func NewRequestDecorator(r *http.Request) RequestDecorator {
 	return RequestDecorator{request: r}
 }
 
+// Context returns the context of the request
+func (r *RequestDecorator) Context() context.Context {
+	return r.request.Context()
+}
+
+// RemoteAddress returns the address of the client (no port), as seen by the server
+func (r *RequestDecorator) RemoteAddress() string {
+	if host, _, err := net.SplitHostPort(r.request.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.request.RemoteAddr
+}
+
 // GetPath returns the path of the request
 func (r *RequestDecorator) GetPath() string {
 	return r.request.URL.Path
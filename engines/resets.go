@@ -0,0 +1,129 @@
+package engines
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/mails"
+	"github.com/zefrenchwan/scrutateur.git/storage"
+)
+
+// DEFAULT_RESET_DURATION is the validity of a password reset token
+const DEFAULT_RESET_DURATION = 30 * time.Minute
+
+// mailTimeout is the maximum time to find the user and send a mail, once response is sent
+const mailTimeout = 30 * time.Second
+
+// ForgotPasswordRequest is the body to ask for a password reset
+type ForgotPasswordRequest struct {
+	Username string `json:"name" validate:"required"`
+}
+
+// ResetPasswordRequest is the body to reset a password with a token received by mail
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,password"`
+}
+
+// UserEmail is the body to set the email of current user
+type UserEmail struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// BuildForgotPasswordHandler sends a password reset token, valid for that duration, to the email of the user.
+// Requests are throttled per client address (as failed logins), and mails per user.
+// Response is the same whether user exists (with an email) or not: user is looked up and mail is sent once response is built
+func BuildForgotPasswordHandler(mailer mails.Mailer, validity time.Duration, throttle LoginThrottle) RequestProcessor {
+	return JSON(func(c *HandlerContext, request ForgotPasswordRequest) (NoContent, error) {
+		var result NoContent
+		if wait, err := throttle.blockedFor(c, ""); err != nil {
+			return result, err
+		} else if wait > 0 {
+			retry := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+			c.BuildErrorMessage(http.StatusTooManyRequests, "too many requests, retry later", http.Header{"Retry-After": {retry}})
+			return result, nil
+		} else if allowed, err := throttle.request(c, request.Username); err != nil {
+			return result, err
+		} else if allowed && ValidateUsernameFormat(request.Username) {
+			// work depends on user existence, its time should not tell whether user exists.
+			// Context is released once response is sent: background work uses captured values only
+			ctx, dao, address, logError := context.WithoutCancel(c.GetCurrentContext()), c.Dao, c.GetClientAddress(), c.BackgroundErrorLogger()
+			go func() {
+				ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+				defer cancel()
+				if err := sendResetToken(ctx, dao, mailer, request.Username, validity, address); err != nil {
+					logError(err)
+				}
+			}()
+		}
+
+		return result, nil
+	})
+}
+
+// sendResetToken creates a reset token for an user with an email, mails it and logs the event.
+// Nothing happens for an unknown user or an user with no email
+func sendResetToken(ctx context.Context, dao storage.Dao, mailer mails.Mailer, login string, validity time.Duration, address string) error {
+	if email, err := dao.GetUserEmail(ctx, login); err != nil {
+		return err
+	} else if email == "" {
+		// no user or no way to reach user
+		return nil
+	} else if token, hash, err := NewResetToken(); err != nil {
+		return err
+	} else if err := dao.AddPasswordReset(ctx, login, hash, time.Now().Add(validity)); err != nil {
+		return err
+	} else {
+		message := mails.Message{
+			To:      email,
+			Subject: "Password reset",
+			Body: fmt.Sprintf("Someone (hopefully you) asked to reset the password of %s.\n"+
+				"Send this token with your new password to /password/reset within %s:\n\n%s\n\n"+
+				"If you did not ask for it, ignore this mail: your password is unchanged.\n",
+				login, validity.String(), token),
+		}
+
+		dao.LogEvent(ctx, login, "security", fmt.Sprintf("password reset asked for user %s", login), []string{address})
+		return mailer.Send(ctx, message)
+	}
+}
+
+// BuildResetPasswordHandler changes the password of the user of a reset token (used once).
+// All the sessions of that user are then revoked, and failed logins cleared
+func BuildResetPasswordHandler(tokens *TokenIssuer) RequestProcessor {
+	return JSON(func(c *HandlerContext, request ResetPasswordRequest) (NoContent, error) {
+		var result NoContent
+		if login, err := c.Dao.ConsumePasswordReset(c.GetCurrentContext(), HashResetToken(request.Token)); err != nil {
+			return result, err
+		} else if login == "" {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid or expired reset token")
+		} else if err := c.Dao.UpsertUser(c.GetCurrentContext(), login, request.Password); err != nil {
+			return result, err
+		} else if err := c.Dao.RevokeUserTokens(c.GetCurrentContext(), login, tokens.AccessDuration); err != nil {
+			return result, err
+		} else if err := c.Dao.ClearLoginFailures(c.GetCurrentContext(), userSubject(login)); err != nil {
+			return result, err
+		} else {
+			c.Dao.LogEvent(c.GetCurrentContext(), login, "security", fmt.Sprintf("user %s resets password", login), []string{c.GetClientAddress()})
+			return result, nil
+		}
+	})
+}
+
+// EndpointSetUserEmail sets the email of current user, to receive password reset tokens
+var EndpointSetUserEmail = JSON(setUserEmail)
+
+// setUserEmail sets the email of current user
+func setUserEmail(c *HandlerContext, request UserEmail) (NoContent, error) {
+	login := c.GetLogin()
+	if err := c.Dao.SetUserEmail(c.GetCurrentContext(), login, request.Email); err != nil {
+		return NoContent{}, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), login, "security", fmt.Sprintf("user %s changes email", login), nil)
+	return NoContent{}, nil
+}
@@ -0,0 +1,283 @@
+package engines
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// ResourceEdition is the request to create or change a resource (no id to create)
+type ResourceEdition struct {
+	ID       string `path:"resourceId"`
+	Operator string `json:"operator" validate:"required"`
+	Template string `json:"template" validate:"required"`
+	Feature  string `json:"feature" validate:"required,feature_name"`
+	// Roles are the roles the resource applies to
+	Roles []string `json:"roles" validate:"required,role"`
+	// Methods are the http methods the resource applies to, empty for any method
+	Methods []string `json:"methods"`
+	// Effect is ALLOW (default) or DENY
+	Effect string `json:"effect"`
+	// DryRun is true to preview the change: changes of access of all users are sent, nothing is committed
+	DryRun string `query:"dry_run" validate:"boolean"`
+}
+
+// ResourceID is a resource designated by the resourceId path parameter
+type ResourceID struct {
+	ID string `path:"resourceId" validate:"required"`
+	// DryRun is true to preview the deletion: changes of access of all users are sent, nothing is committed
+	DryRun string `query:"dry_run" validate:"boolean"`
+}
+
+// ResourceCreated is the id of the created resource
+type ResourceCreated struct {
+	ID int `json:"id"`
+}
+
+// FeatureEdition is the request to create or change a feature
+type FeatureEdition struct {
+	Name        string `path:"feature" validate:"required,feature_name"`
+	Description string `json:"description"`
+	// RequiresMFA applies to all the resources of the feature. Absent to keep the current policy (no MFA for a new feature)
+	RequiresMFA *bool `json:"requires_mfa"`
+}
+
+// FeatureName is a feature designated by the feature path parameter
+type FeatureName struct {
+	Name string `path:"feature" validate:"required,feature_name"`
+}
+
+// ValidateFeatureNameFormat tests if a feature name is valid or not
+func ValidateFeatureNameFormat(name string) bool {
+	if res, err := regexp.MatchString(`^[a-z][a-z0-9_\-]{1,31}$`, name); err != nil {
+		panic(err)
+	} else {
+		return res
+	}
+}
+
+// resourceMethods are the http methods a resource may apply to
+var resourceMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// ParseResourceEdition validates a resource edition against the protected routes: template should be valid,
+// and match at least one of those routes for its methods. Methods are upper cased, and effect is ALLOW by default
+func ParseResourceEdition(request ResourceEdition, routes []Route) (dto.Resource, error) {
+	var result dto.Resource
+	if request.ID != "" {
+		if id, err := strconv.Atoi(request.ID); err != nil || id <= 0 {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid resource id")
+		} else {
+			result.ID = id
+		}
+	}
+
+	if operator, err := dto.ParseGrantOperator(request.Operator); err != nil {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+	} else if err := ValidateTemplate(operator, request.Template); err != nil {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+	} else {
+		result.Operator = operator
+		result.Template = request.Template
+	}
+
+	if request.Effect == "" {
+		result.Effect = dto.EffectAllow
+	} else if effect, err := dto.ParseGrantEffect(request.Effect); err != nil {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+	} else {
+		result.Effect = effect
+	}
+
+	for _, method := range request.Methods {
+		method = strings.ToUpper(method)
+		if !slices.Contains(resourceMethods, method) {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("%s is not an http method", method))
+		} else if !slices.Contains(result.Methods, method) {
+			result.Methods = append(result.Methods, method)
+		}
+	}
+
+	matching := slices.ContainsFunc(routes, func(route Route) bool {
+		return route.Protected && MatchesMethod(result.Methods, route.Method) && MatchesTemplate(result.Operator, result.Template, route.SamplePath())
+	})
+
+	if !matching {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "template matches no protected route")
+	}
+
+	result.Feature = request.Feature
+	for _, role := range request.Roles {
+		result.Roles = append(result.Roles, dto.GrantRole(role))
+	}
+
+	return result, nil
+}
+
+// EndpointListResources lists the protected resources
+var EndpointListResources = JSON(listResources)
+
+// listResources lists the protected resources, with their id
+func listResources(c *HandlerContext, request NoContent) ([]dto.Resource, error) {
+	return c.Dao.GetResources(c.GetCurrentContext())
+}
+
+// CreateResourceHandler returns a processor to create a resource in an existing feature.
+// Template is validated against the routes registered in the engine when the request is processed
+func (e *ProcessingEngine) CreateResourceHandler() RequestProcessor {
+	return JSON(func(c *HandlerContext, request ResourceEdition) (ResourceCreated, error) {
+		request.ID = ""
+		if resource, err := ParseResourceEdition(request, e.Routes()); err != nil {
+			return ResourceCreated{}, err
+		} else if isDryRun(request.DryRun) {
+			return ResourceCreated{}, previewResources(c, func(current []dto.Resource) ([]dto.Resource, error) {
+				return append(slices.Clone(current), resource), nil
+			})
+		} else if id, err := c.Dao.CreateResource(c.GetCurrentContext(), resource); err != nil {
+			return ResourceCreated{}, err
+		} else {
+			c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "resources", fmt.Sprintf("user %s creates resource %d", c.GetLogin(), id), describeResource(resource))
+			return ResourceCreated{ID: id}, nil
+		}
+	})
+}
+
+// UpdateResourceHandler returns a processor to change a resource.
+// Template is validated against the routes registered in the engine when the request is processed
+func (e *ProcessingEngine) UpdateResourceHandler() RequestProcessor {
+	return JSON(func(c *HandlerContext, request ResourceEdition) (NoContent, error) {
+		if request.ID == "" {
+			return NoContent{}, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "missing value for resourceId")
+		} else if resource, err := ParseResourceEdition(request, e.Routes()); err != nil {
+			return NoContent{}, err
+		} else if isDryRun(request.DryRun) {
+			return NoContent{}, previewResources(c, func(current []dto.Resource) ([]dto.Resource, error) {
+				return replaceResource(current, resource.ID, &resource)
+			})
+		} else if updated, err := c.Dao.UpdateResource(c.GetCurrentContext(), resource); err != nil {
+			return NoContent{}, err
+		} else if !updated {
+			return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching resource")
+		} else {
+			c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "resources", fmt.Sprintf("user %s updates resource %d", c.GetLogin(), resource.ID), describeResource(resource))
+			return NoContent{}, nil
+		}
+	})
+}
+
+// EndpointDeleteResource deletes a resource
+var EndpointDeleteResource = JSON(deleteResource)
+
+// deleteResource deletes a resource, and logs the event
+func deleteResource(c *HandlerContext, request ResourceID) (NoContent, error) {
+	if id, err := strconv.Atoi(request.ID); err != nil || id <= 0 {
+		return NoContent{}, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid resource id")
+	} else if isDryRun(request.DryRun) {
+		return NoContent{}, previewResources(c, func(current []dto.Resource) ([]dto.Resource, error) {
+			return replaceResource(current, id, nil)
+		})
+	} else if deleted, err := c.Dao.DeleteResource(c.GetCurrentContext(), id); err != nil {
+		return NoContent{}, err
+	} else if !deleted {
+		return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching resource")
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "resources", fmt.Sprintf("user %s deletes resource %s", c.GetLogin(), request.ID), nil)
+	return NoContent{}, nil
+}
+
+// EndpointListFeatures lists the features and their number of resources
+var EndpointListFeatures = JSON(listFeatures)
+
+// listFeatures lists the features and their number of resources
+func listFeatures(c *HandlerContext, request NoContent) ([]dto.Feature, error) {
+	return c.Dao.ListFeatures(c.GetCurrentContext())
+}
+
+// EndpointUpsertFeature creates or changes a feature
+var EndpointUpsertFeature = JSON(upsertFeature)
+
+// upsertFeature creates or changes a feature, and logs the event
+func upsertFeature(c *HandlerContext, request FeatureEdition) (NoContent, error) {
+	if err := c.Dao.UpsertFeature(c.GetCurrentContext(), request.Name, request.Description, request.RequiresMFA); err != nil {
+		return NoContent{}, err
+	}
+
+	policy := "unchanged"
+	if request.RequiresMFA != nil {
+		policy = strconv.FormatBool(*request.RequiresMFA)
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "resources", fmt.Sprintf("user %s sets feature %s", c.GetLogin(), request.Name), []string{policy})
+	return NoContent{}, nil
+}
+
+// EndpointDeleteFeature deletes a feature with no resource
+var EndpointDeleteFeature = JSON(deleteFeature)
+
+// deleteFeature deletes a feature (and grants on it), and logs the event
+func deleteFeature(c *HandlerContext, request FeatureName) (NoContent, error) {
+	if deleted, err := c.Dao.DeleteFeature(c.GetCurrentContext(), request.Name); err != nil {
+		return NoContent{}, err
+	} else if !deleted {
+		return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching feature")
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "resources", fmt.Sprintf("user %s deletes feature %s", c.GetLogin(), request.Name), nil)
+	return NoContent{}, nil
+}
+
+// previewResources sends the changes of access of all users if current resources were changed by change
+func previewResources(c *HandlerContext, change func([]dto.Resource) ([]dto.Resource, error)) error {
+	if current, err := c.Dao.GetResources(c.GetCurrentContext()); err != nil {
+		return err
+	} else if proposed, err := change(current); err != nil {
+		return err
+	} else if users, err := c.Dao.GetAllRolesPerFeature(c.GetCurrentContext()); err != nil {
+		return err
+	} else {
+		diffs := DiffResources(c.GetRoutes(), users, current, proposed)
+		if diffs == nil {
+			diffs = []AccessDiff{}
+		}
+
+		return c.BuildJson(http.StatusOK, diffs, nil)
+	}
+}
+
+// replaceResource returns resources with the resource of that id replaced (or removed if replacement is nil).
+// Error if there is no such resource
+func replaceResource(resources []dto.Resource, id int, replacement *dto.Resource) ([]dto.Resource, error) {
+	index := slices.IndexFunc(resources, func(resource dto.Resource) bool { return resource.ID == id })
+	if index < 0 {
+		return nil, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching resource")
+	} else if replacement == nil {
+		return slices.Delete(slices.Clone(resources), index, index+1), nil
+	}
+
+	result := slices.Clone(resources)
+	result[index] = *replacement
+	result[index].RequiresMFA = resources[index].RequiresMFA
+	return result, nil
+}
+
+// describeResource returns the audit parameters of a resource
+func describeResource(resource dto.Resource) []string {
+	roles := make([]string, 0, len(resource.Roles))
+	for _, role := range resource.Roles {
+		roles = append(roles, string(role))
+	}
+
+	return []string{
+		string(resource.Operator),
+		resource.Template,
+		resource.Feature,
+		strings.Join(roles, ","),
+		strings.Join(resource.Methods, ","),
+		string(resource.Effect),
+	}
+}
@@ -36,8 +36,8 @@ func (ar *AbstractResponse) Write(w http.ResponseWriter) error {
 		}
 	}
 
-	// Write status
-	if ar.Code != http.StatusOK {
+	// Write status (no code means ok)
+	if ar.Code != 0 && ar.Code != http.StatusOK {
 		w.WriteHeader(ar.Code)
 	}
 
@@ -140,8 +140,3 @@ func (ar *AbstractResponse) BuildJson(code int, body any, headers http.Header) e
 		return nil
 	}
 }
-
-// BuildError sets all values in parameters and flags the response to be ready
-func (ar *AbstractResponse) BuildError(code int, failure error, headers http.Header) {
-	ar.Build(code, failure.Error(), headers)
-}
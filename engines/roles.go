@@ -0,0 +1,74 @@
+package engines
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// RoleEdition is the request to create or change a role that is not built-in
+type RoleEdition struct {
+	Name        string `path:"name" validate:"required,role_name"`
+	Description string `json:"description" validate:"required"`
+	// Implies are the roles this role includes
+	Implies []string `json:"implies" validate:"role"`
+	// CanGrant is true if role may grant itself and the roles it implies
+	CanGrant bool `json:"can_grant"`
+}
+
+// RoleName is a role designated by the name path parameter
+type RoleName struct {
+	Name string `path:"name" validate:"required,role_name"`
+}
+
+// ValidateRoleNameFormat tests if a role name is valid or not
+func ValidateRoleNameFormat(name string) bool {
+	if res, err := regexp.MatchString(`^[a-z][a-z0-9_\-]{1,31}$`, name); err != nil {
+		panic(err)
+	} else {
+		return res
+	}
+}
+
+// EndpointListRoles lists the roles and the roles they imply
+var EndpointListRoles = JSON(listRoles)
+
+// listRoles lists the roles and the roles they imply
+func listRoles(c *HandlerContext, request NoContent) ([]dto.Role, error) {
+	return c.Dao.ListRoles(c.GetCurrentContext())
+}
+
+// EndpointUpsertRole creates or changes a role that is not built-in
+var EndpointUpsertRole = JSON(upsertRole)
+
+// upsertRole creates or changes a role, and logs the event
+func upsertRole(c *HandlerContext, request RoleEdition) (NoContent, error) {
+	role := dto.Role{Name: dto.GrantRole(request.Name), Description: request.Description, CanGrant: request.CanGrant}
+	for _, implied := range request.Implies {
+		role.Implies = append(role.Implies, dto.GrantRole(implied))
+	}
+
+	if err := c.Dao.UpsertRole(c.GetCurrentContext(), role); err != nil {
+		return NoContent{}, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "roles", fmt.Sprintf("user %s sets role %s", c.GetLogin(), request.Name), request.Implies)
+	return NoContent{}, nil
+}
+
+// EndpointDeleteRole deletes a role that is not built-in and not used
+var EndpointDeleteRole = JSON(deleteRole)
+
+// deleteRole deletes a role, and logs the event
+func deleteRole(c *HandlerContext, request RoleName) (NoContent, error) {
+	if deleted, err := c.Dao.DeleteRole(c.GetCurrentContext(), request.Name); err != nil {
+		return NoContent{}, err
+	} else if !deleted {
+		return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching role")
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "roles", fmt.Sprintf("user %s deletes role %s", c.GetLogin(), request.Name), nil)
+	return NoContent{}, nil
+}
@@ -0,0 +1,75 @@
+package engines
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// routeParameter finds parameters in an url pattern, for instance {username} or {path...}
+var routeParameter = regexp.MustCompile(`\{([a-zA-Z]+)(\.\.\.)?\}`)
+
+// Route describes a registered route, for documentation and checks
+type Route struct {
+	// Method is the http method of the route (GET, POST, etc)
+	Method string
+	// Pattern is the url pattern, for instance /manage/user/{username}/delete
+	Pattern string
+	// Summary is a short description of the route
+	Summary string
+	// Protected is true when access to that route depends on auth.resources
+	Protected bool
+	// RequestType is the type of the request (see JSON), nil for no request content
+	RequestType reflect.Type
+	// ResponseType is the type of the response body, nil for no body
+	ResponseType reflect.Type
+}
+
+// Describe sets the summary of the route
+func (r *Route) Describe(summary string) *Route {
+	r.Summary = summary
+	return r
+}
+
+// Accepts sets the request type from a sample value of that type
+func (r *Route) Accepts(sample any) *Route {
+	r.RequestType = reflect.TypeOf(sample)
+	return r
+}
+
+// Returns sets the response type from a sample value of that type
+func (r *Route) Returns(sample any) *Route {
+	r.ResponseType = reflect.TypeOf(sample)
+	return r
+}
+
+// Parameters returns the names of the path parameters of the route
+func (r *Route) Parameters() []string {
+	var result []string
+	for _, match := range routeParameter.FindAllStringSubmatch(r.Pattern, -1) {
+		result = append(result, match[1])
+	}
+
+	return result
+}
+
+// SamplePath returns an url matching the route, each parameter replaced by its name.
+// For instance, /manage/user/{username}/delete becomes /manage/user/username/delete
+func (r *Route) SamplePath() string {
+	return routeParameter.ReplaceAllString(r.Pattern, "$1")
+}
+
+// Routes returns the routes registered so far, in registration order
+func (e *ProcessingEngine) Routes() []Route {
+	result := make([]Route, 0, len(e.routes))
+	for _, route := range e.routes {
+		result = append(result, *route)
+	}
+
+	return result
+}
+
+// OpenAPIPath returns the pattern as an OpenAPI path ({path...} becomes {path})
+func (r *Route) OpenAPIPath() string {
+	return strings.ReplaceAll(r.Pattern, "...}", "}")
+}
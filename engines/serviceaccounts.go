@@ -0,0 +1,397 @@
+package engines
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// CLIENT_SECRET_PREFIX starts any client secret of a service account
+const CLIENT_SECRET_PREFIX = "scr_cs_"
+
+// GRANT_CLIENT_CREDENTIALS is the only OAuth2 grant type of the token endpoint
+const GRANT_CLIENT_CREDENTIALS = "client_credentials"
+
+// ASSERTION_TYPE_JWT_BEARER is the client assertion type for signed JWT (RFC 7523)
+const ASSERTION_TYPE_JWT_BEARER = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// MAX_ASSERTION_LIFETIME is the maximum validity of a client assertion, to limit replays
+const MAX_ASSERTION_LIFETIME = 5 * time.Minute
+
+// assertionMethods are the accepted algorithms for client assertions (asymmetric only)
+var assertionMethods = []string{"RS256", "ES256", "EdDSA"}
+
+// ServiceAccountCreation is the request to create a service account
+type ServiceAccountCreation struct {
+	Name string `json:"name" validate:"required,username"`
+}
+
+// ServiceAccountName is a service account designated by the name path parameter
+type ServiceAccountName struct {
+	Name string `path:"name" validate:"required,username"`
+}
+
+// ServiceAccountRolesEdition is the request to set roles of a service account, per feature.
+// Empty roles for a feature removes access to that feature
+type ServiceAccountRolesEdition struct {
+	Name   string              `path:"name" validate:"required,username"`
+	Access map[string][]string `body:"true" validate:"required,role"`
+	// DryRun is true to preview the change: changes of access are sent, nothing is committed
+	DryRun string `query:"dry_run" validate:"boolean"`
+}
+
+// ServiceSecretCreation is the request to create a client secret for a service account
+type ServiceSecretCreation struct {
+	Name string `path:"name" validate:"required,username"`
+	// ExpiresInDays is the validity of the secret, no expiration if not set
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// ServiceSecretCreated is the created secret. Secret is displayed once
+type ServiceSecretCreated struct {
+	ID           string `json:"id"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// ServiceKeyAddition is the request to add a public key (PEM, PKIX) to verify assertions of a service account
+type ServiceKeyAddition struct {
+	Name      string `path:"name" validate:"required,username"`
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// ServiceKeyAdded is the added key. Its id is the kid header to set in assertions
+type ServiceKeyAdded struct {
+	ID       string `json:"kid"`
+	ClientID string `json:"client_id"`
+}
+
+// ServiceCredentialID is a credential of a service account, designated by path parameters
+type ServiceCredentialID struct {
+	Name string `path:"name" validate:"required,username"`
+	ID   string `path:"credentialId" validate:"required"`
+}
+
+// ServiceToken is the response of the token endpoint. There is no refresh token, services ask for a new token instead
+type ServiceToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// NewClientSecret returns a random client secret and its hash (to store)
+func NewClientSecret() (string, []byte, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", nil, err
+	}
+
+	secret := CLIENT_SECRET_PREFIX + base64.RawURLEncoding.EncodeToString(value)
+	return secret, HashClientSecret(secret), nil
+}
+
+// HashClientSecret returns the hash of a client secret, as stored. Secrets are random and long, a fast hash is enough
+func HashClientSecret(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// ParsePublicKeyPEM returns the DER content of a PEM public key (PKIX), if key is RSA, ECDSA or Ed25519
+func ParsePublicKeyPEM(value string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(value))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expecting a PEM public key")
+	} else if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+
+	return block.Bytes, nil
+}
+
+// BuildClientCredentialsHandler is the OAuth2 token endpoint for service accounts (client_credentials grant).
+// Service authenticates with a client secret (basic auth or form) or a signed JWT assertion whose audience is audience.
+// Failures are throttled per client address only: services are never locked
+func BuildClientCredentialsHandler(tokens *TokenIssuer, throttle LoginThrottle, audience string) RequestProcessor {
+	return func(c *HandlerContext) error {
+		var form url.Values
+		if body, err := c.RequestBodyAsString(); err != nil {
+			c.BuildError(http.StatusBadRequest, err, nil)
+			return nil
+		} else if values, err := url.ParseQuery(body); err != nil {
+			c.BuildErrorMessage(http.StatusBadRequest, "expecting a form body", nil)
+			return nil
+		} else {
+			form = values
+		}
+
+		if form.Get("grant_type") != GRANT_CLIENT_CREDENTIALS {
+			c.BuildErrorMessage(http.StatusBadRequest, "unsupported grant type, expecting client_credentials", nil)
+			return nil
+		} else if wait, err := throttle.blockedFor(c, ""); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if wait > 0 {
+			retry := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+			c.BuildErrorMessage(http.StatusTooManyRequests, "too many failed attempts, retry later", http.Header{"Retry-After": {retry}})
+			return nil
+		} else if name, err := authenticateClient(c, form, audience); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if name == "" {
+			if err := throttle.failure(c, ""); err != nil {
+				c.BuildError(http.StatusInternalServerError, err, nil)
+			} else {
+				c.BuildErrorMessage(http.StatusUnauthorized, "invalid client credentials", nil)
+			}
+
+			return nil
+		} else if accessToken, err := tokens.accessToken(c, name, false); err != nil {
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else if err := c.BuildJson(http.StatusOK, ServiceToken{AccessToken: accessToken, TokenType: "Bearer", ExpiresIn: int64(tokens.AccessDuration.Seconds())}, http.Header{"Cache-Control": {"no-store"}}); err != nil {
+			c.ClearResponse()
+			c.BuildError(http.StatusInternalServerError, err, nil)
+			return nil
+		} else {
+			return nil
+		}
+	}
+}
+
+// authenticateClient returns the service account of valid client credentials, empty for invalid credentials
+func authenticateClient(c *HandlerContext, form url.Values, audience string) (string, error) {
+	if assertion := form.Get("client_assertion"); assertion != "" {
+		if form.Get("client_assertion_type") != ASSERTION_TYPE_JWT_BEARER {
+			return "", nil
+		}
+
+		return verifyClientAssertion(c, assertion, audience)
+	}
+
+	clientID, secret := form.Get("client_id"), form.Get("client_secret")
+	if value, found := strings.CutPrefix(c.GetRequestHeaderFirstValue("Authorization"), "Basic "); found {
+		// RFC 6749: id and secret are form encoded, then basic auth encoded
+		if decoded, err := base64.StdEncoding.DecodeString(value); err != nil {
+			return "", nil
+		} else if rawID, rawSecret, found := strings.Cut(string(decoded), ":"); !found {
+			return "", nil
+		} else {
+			clientID, _ = url.QueryUnescape(rawID)
+			secret, _ = url.QueryUnescape(rawSecret)
+		}
+	}
+
+	if clientID == "" || secret == "" || !ValidateUsernameFormat(clientID) {
+		return "", nil
+	} else if credentials, err := c.Dao.GetServiceCredentials(c.GetCurrentContext(), clientID); err != nil {
+		return "", err
+	} else {
+		hash := HashClientSecret(secret)
+		valid := false
+		for _, credential := range credentials {
+			if credential.Type == dto.CredentialSecret && subtle.ConstantTimeCompare(credential.Material, hash) == 1 {
+				valid = true
+			}
+		}
+
+		if !valid {
+			return "", nil
+		}
+
+		return clientID, nil
+	}
+}
+
+// verifyClientAssertion returns the service account of a valid assertion, empty for an invalid assertion.
+// Assertion is a JWT signed by a key of the service (kid header), with service as issuer and subject, a short validity and an id used once
+func verifyClientAssertion(c *HandlerContext, assertion, audience string) (string, error) {
+	var storageError error
+	parser := jwt.NewParser(jwt.WithValidMethods(assertionMethods), jwt.WithAudience(audience), jwt.WithExpirationRequired(), jwt.WithLeeway(30*time.Second))
+	token, err := parser.Parse(assertion, func(token *jwt.Token) (any, error) {
+		issuer, _ := token.Claims.GetIssuer()
+		subject, _ := token.Claims.GetSubject()
+		kid, _ := token.Header["kid"].(string)
+		if issuer == "" || issuer != subject || !ValidateUsernameFormat(issuer) {
+			return nil, errors.New("issuer and subject should be the service account")
+		}
+
+		credentials, err := c.Dao.GetServiceCredentials(c.GetCurrentContext(), issuer)
+		if err != nil {
+			storageError = err
+			return nil, err
+		}
+
+		for _, credential := range credentials {
+			if credential.Type == dto.CredentialPublicKey && credential.ID == kid {
+				return x509.ParsePKIXPublicKey(credential.Material)
+			}
+		}
+
+		return nil, errors.New("unknown key")
+	})
+
+	if storageError != nil {
+		return "", storageError
+	} else if err != nil || !token.Valid {
+		return "", nil
+	}
+
+	name, _ := token.Claims.GetIssuer()
+	expiration, _ := token.Claims.GetExpirationTime()
+	claims, _ := token.Claims.(jwt.MapClaims)
+	assertionId, _ := claims["jti"].(string)
+	if assertionId == "" || time.Until(expiration.Time) > MAX_ASSERTION_LIFETIME {
+		return "", nil
+	} else if unused, err := c.Dao.MarkAssertionUsed(c.GetCurrentContext(), name, assertionId, time.Until(expiration.Time)+time.Minute); err != nil {
+		return "", err
+	} else if !unused {
+		return "", nil
+	}
+
+	return name, nil
+}
+
+// EndpointCreateServiceAccount creates a service account with no credential and no role
+var EndpointCreateServiceAccount = JSON(createServiceAccount)
+
+// createServiceAccount creates a service account, and logs the event
+func createServiceAccount(c *HandlerContext, request ServiceAccountCreation) (NoContent, error) {
+	if err := c.Dao.CreateServiceAccount(c.GetCurrentContext(), request.Name); err != nil {
+		return NoContent{}, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "services", fmt.Sprintf("user %s creates service account %s", c.GetLogin(), request.Name), nil)
+	return NoContent{}, nil
+}
+
+// EndpointListServiceAccounts lists service accounts and their credentials (never secrets)
+var EndpointListServiceAccounts = JSON(listServiceAccounts)
+
+// listServiceAccounts lists service accounts and their credentials
+func listServiceAccounts(c *HandlerContext, request NoContent) ([]dto.ServiceAccount, error) {
+	return c.Dao.ListServiceAccounts(c.GetCurrentContext())
+}
+
+// EndpointDeleteServiceAccount deletes a service account and its credentials
+var EndpointDeleteServiceAccount = JSON(deleteServiceAccount)
+
+// deleteServiceAccount deletes a service account, and logs the event
+func deleteServiceAccount(c *HandlerContext, request ServiceAccountName) (NoContent, error) {
+	if deleted, err := c.Dao.DeleteServiceAccount(c.GetCurrentContext(), request.Name); err != nil {
+		return NoContent{}, err
+	} else if !deleted {
+		return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching service account")
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "services", fmt.Sprintf("user %s deletes service account %s", c.GetLogin(), request.Name), nil)
+	return NoContent{}, nil
+}
+
+// EndpointEditServiceAccountRoles sets roles of a service account, if current user may grant them
+var EndpointEditServiceAccountRoles = JSON(editServiceAccountRoles)
+
+// editServiceAccountRoles sets roles of a service account, if current user may grant them
+func editServiceAccountRoles(c *HandlerContext, request ServiceAccountRolesEdition) (NoContent, error) {
+	if err := ensureServiceAccount(c, request.Name); err != nil {
+		return NoContent{}, err
+	}
+
+	return adminEditUserRoles(c, UserRolesEdition{Username: request.Name, Access: request.Access, DryRun: request.DryRun})
+}
+
+// EndpointCreateServiceSecret creates a client secret for a service account
+var EndpointCreateServiceSecret = JSON(createServiceSecret)
+
+// createServiceSecret creates a client secret for a service account, displayed once
+func createServiceSecret(c *HandlerContext, request ServiceSecretCreation) (ServiceSecretCreated, error) {
+	var result ServiceSecretCreated
+	credential := dto.ServiceCredential{ID: uuid.NewString(), Type: dto.CredentialSecret}
+	if request.ExpiresInDays < 0 {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "validity should be positive")
+	} else if request.ExpiresInDays > 0 {
+		expiration := time.Now().UTC().AddDate(0, 0, request.ExpiresInDays)
+		credential.ExpiresAt = &expiration
+	}
+
+	secret, hash, err := NewClientSecret()
+	if err != nil {
+		return result, err
+	}
+
+	credential.Material = hash
+	if err := c.Dao.AddServiceCredential(c.GetCurrentContext(), request.Name, credential); err != nil {
+		return result, err
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "services", fmt.Sprintf("user %s creates a secret for service account %s", c.GetLogin(), request.Name), []string{credential.ID})
+	result.ID = credential.ID
+	result.ClientID = request.Name
+	result.ClientSecret = secret
+	return result, nil
+}
+
+// EndpointAddServiceKey adds a public key to verify assertions of a service account
+var EndpointAddServiceKey = JSON(addServiceKey)
+
+// addServiceKey adds a public key to a service account
+func addServiceKey(c *HandlerContext, request ServiceKeyAddition) (ServiceKeyAdded, error) {
+	var result ServiceKeyAdded
+	if material, err := ParsePublicKeyPEM(request.PublicKey); err != nil {
+		return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "invalid public key")
+	} else {
+		credential := dto.ServiceCredential{ID: uuid.NewString(), Type: dto.CredentialPublicKey, Material: material}
+		if err := c.Dao.AddServiceCredential(c.GetCurrentContext(), request.Name, credential); err != nil {
+			return result, err
+		}
+
+		c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "services", fmt.Sprintf("user %s adds a key to service account %s", c.GetLogin(), request.Name), []string{credential.ID})
+		result.ID = credential.ID
+		result.ClientID = request.Name
+		return result, nil
+	}
+}
+
+// EndpointRevokeServiceCredential revokes a secret or a key of a service account
+var EndpointRevokeServiceCredential = JSON(revokeServiceCredential)
+
+// revokeServiceCredential revokes a credential of a service account, and logs the event
+func revokeServiceCredential(c *HandlerContext, request ServiceCredentialID) (NoContent, error) {
+	if deleted, err := c.Dao.DeleteServiceCredential(c.GetCurrentContext(), request.Name, request.ID); err != nil {
+		return NoContent{}, err
+	} else if !deleted {
+		return NoContent{}, NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching credential")
+	}
+
+	c.Dao.LogEvent(c.GetCurrentContext(), c.GetLogin(), "services", fmt.Sprintf("user %s revokes a credential of service account %s", c.GetLogin(), request.Name), []string{request.ID})
+	return NoContent{}, nil
+}
+
+// ensureServiceAccount returns a not found error if name is not a service account
+func ensureServiceAccount(c *HandlerContext, name string) error {
+	if accounts, err := c.Dao.ListServiceAccounts(c.GetCurrentContext()); err != nil {
+		return err
+	} else {
+		for _, account := range accounts {
+			if account.Name == name {
+				return nil
+			}
+		}
+	}
+
+	return NewApiError(http.StatusNotFound, ErrorCodeNotFound, "no matching service account")
+}
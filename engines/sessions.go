@@ -0,0 +1,117 @@
+package engines
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TokenPair is the result of a login or of a refresh
+type TokenPair struct {
+	// AccessToken is the JWT to set as a bearer in the Authorization header
+	AccessToken string `json:"access_token"`
+	// RefreshToken is the opaque token to get a new pair once access token expires (used once)
+	RefreshToken string `json:"refresh_token"`
+	// TokenType is always Bearer
+	TokenType string `json:"token_type"`
+	// ExpiresIn is the validity of the access token, in seconds
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// RefreshRequest is the body to refresh tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// LogoutRequest is the body to logout. Refresh token is optional, and revoked if set
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens creates an access token and a refresh token for that user, and stores the refresh token.
+// Flag mfa is true if user used a second factor, and remains for refreshed tokens
+func (t *TokenIssuer) issueTokens(c *HandlerContext, username string, mfa bool) (TokenPair, error) {
+	var result TokenPair
+	if accessToken, err := t.accessToken(c, username, mfa); err != nil {
+		return result, err
+	} else if refreshToken, hash, err := NewRefreshToken(); err != nil {
+		return result, err
+	} else if err := c.Dao.AddRefreshToken(c.GetCurrentContext(), username, hash, time.Now().Add(t.RefreshDuration), mfa); err != nil {
+		return result, err
+	} else {
+		result.AccessToken = accessToken
+		result.RefreshToken = refreshToken
+		result.TokenType = "Bearer"
+		result.ExpiresIn = int64(t.AccessDuration.Seconds())
+		return result, nil
+	}
+}
+
+// accessToken creates an access token for that user, with user's permissions if issuer embeds them
+func (t *TokenIssuer) accessToken(c *HandlerContext, username string, mfa bool) (string, error) {
+	if !t.EmbedPermissions {
+		return t.CreateAccessToken(username, mfa)
+	}
+
+	// version first: if grants change meanwhile, token is stale rather than wrong
+	if version, err := c.Dao.GetPermissionsVersion(c.GetCurrentContext(), username); err != nil {
+		return "", err
+	} else if roles, err := c.Dao.GetUserRolesPerFeature(c.GetCurrentContext(), username); err != nil {
+		return "", err
+	} else {
+		return t.CreateAccessTokenWithPermissions(username, mfa, Permissions{Version: version, Roles: roles})
+	}
+}
+
+// BuildRefreshHandler exchanges a refresh token for a new token pair. Refresh token is then consumed
+func BuildRefreshHandler(tokens *TokenIssuer) RequestProcessor {
+	return JSON(func(c *HandlerContext, request RefreshRequest) (TokenPair, error) {
+		var result TokenPair
+		if login, mfa, err := c.Dao.ConsumeRefreshToken(c.GetCurrentContext(), HashRefreshToken(request.RefreshToken)); err != nil {
+			return result, err
+		} else if login == "" {
+			return result, NewApiError(http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid refresh token")
+		} else {
+			return tokens.issueTokens(c, login, mfa)
+		}
+	})
+}
+
+// BuildLogoutHandler revokes the access token of the request, and the refresh token in the body, if any
+func BuildLogoutHandler() RequestProcessor {
+	return JSON(func(c *HandlerContext, request LogoutRequest) (NoContent, error) {
+		var result NoContent
+		token := c.CurrentAuth.Token
+		if c.CurrentAuth.AccessTokenID != "" {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "personal access tokens are revoked with /self/tokens/{tokenId}/revoke")
+		} else if token.ID == "" {
+			return result, NewApiError(http.StatusInternalServerError, ErrorCodeInternal, "no token found")
+		} else if err := c.Dao.RevokeToken(c.GetCurrentContext(), token.ID, token.ExpirationTime); err != nil {
+			return result, err
+		} else if request.RefreshToken == "" {
+			return result, nil
+		} else {
+			return result, c.Dao.DeleteRefreshToken(c.GetCurrentContext(), HashRefreshToken(request.RefreshToken))
+		}
+	})
+}
+
+// BuildLogoutAllHandler revokes all the tokens of current user, on any device
+func BuildLogoutAllHandler(tokens *TokenIssuer) RequestProcessor {
+	return JSON(func(c *HandlerContext, request NoContent) (NoContent, error) {
+		var result NoContent
+		token := c.CurrentAuth.Token
+		if c.CurrentAuth.AccessTokenID != "" {
+			return result, NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, "personal access tokens are revoked with /self/tokens/{tokenId}/revoke")
+		} else if token.ID == "" {
+			return result, NewApiError(http.StatusInternalServerError, ErrorCodeInternal, "no token found")
+		} else if err := c.Dao.RevokeToken(c.GetCurrentContext(), token.ID, token.ExpirationTime); err != nil {
+			return result, err
+		} else if err := c.Dao.RevokeUserTokens(c.GetCurrentContext(), token.Username, tokens.AccessDuration); err != nil {
+			return result, err
+		}
+
+		c.Dao.LogEvent(c.GetCurrentContext(), token.Username, "sessions", fmt.Sprintf("user %s revokes all tokens", token.Username), nil)
+		return result, nil
+	})
+}
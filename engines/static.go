@@ -47,7 +47,7 @@ func BuildStaticHandlerForLocalResource(mappedUrl, localPath string) RequestProc
 				context.BuildRaw(http.StatusOK, body, context.RequestHeaderByNames("Authorization"))
 			}
 		} else {
-			context.Build(http.StatusNotFound, "", nil)
+			context.BuildErrorMessage(http.StatusNotFound, "resource not found", nil)
 		}
 
 		return nil
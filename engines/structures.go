@@ -2,6 +2,20 @@ package engines
 
 // UserInformation is the json data definition to define an user
 type UserInformation struct {
-	Username string `json:"name"`
-	Password string `json:"password"`
+	Username string `json:"name" validate:"required,username"`
+	Password string `json:"password" validate:"required,password"`
+}
+
+// UserRolesEdition is the request to set roles of an user, per feature.
+// Empty roles for a feature removes access to that feature
+type UserRolesEdition struct {
+	Username string              `path:"username" validate:"required,username"`
+	Access   map[string][]string `body:"true" validate:"required,role"`
+	// DryRun is true to preview the change: changes of access are sent, nothing is committed
+	DryRun string `query:"dry_run" validate:"boolean"`
+}
+
+// UserName is an user designated by the username path parameter
+type UserName struct {
+	Username string `path:"username" validate:"required,username"`
 }
@@ -0,0 +1,130 @@
+package engines
+
+import (
+	"fmt"
+	"time"
+)
+
+// LoginThrottle limits failed logins per user and per client address.
+// Each failure for an user blocks that user for an exponential delay, and too many failures lock the user (or the address)
+type LoginThrottle struct {
+	// MaxUserFailures is the number of failures within Window that locks an user
+	MaxUserFailures int64
+	// MaxAddressFailures is the number of failures within Window that locks a client address
+	MaxAddressFailures int64
+	// BaseDelay is the delay after the first failure, doubled after each failure
+	BaseDelay time.Duration
+	// MaxDelay is the maximum delay between two attempts before lockout
+	MaxDelay time.Duration
+	// LockoutDuration is the duration of a lockout
+	LockoutDuration time.Duration
+	// Window is the duration failures are counted, from the first failure (fixed window)
+	Window time.Duration
+}
+
+// DefaultLoginThrottle returns a throttle locking an user after 5 failures, or an address after 20 failures, for 15 minutes
+func DefaultLoginThrottle() LoginThrottle {
+	return LoginThrottle{
+		MaxUserFailures:    5,
+		MaxAddressFailures: 20,
+		BaseDelay:          time.Second,
+		MaxDelay:           30 * time.Second,
+		LockoutDuration:    15 * time.Minute,
+		Window:             15 * time.Minute,
+	}
+}
+
+// userSubject is the throttling subject of an user
+func userSubject(login string) string {
+	return "user:" + login
+}
+
+// addressSubject is the throttling subject of a client address
+func addressSubject(address string) string {
+	return "address:" + address
+}
+
+// resetSubject is the throttling subject of password reset requests for an user
+func resetSubject(login string) string {
+	return "reset:" + login
+}
+
+// Backoff returns the delay before next attempt after that number of failures
+func (t LoginThrottle) Backoff(failures int64) time.Duration {
+	delay := t.BaseDelay
+	for index := int64(1); index < failures && delay < t.MaxDelay; index++ {
+		delay = delay * 2
+	}
+
+	return min(delay, t.MaxDelay)
+}
+
+// blockedFor returns the time to wait before user may try to log in from that address, 0 for no wait.
+// Empty login tests the address only
+func (t LoginThrottle) blockedFor(c *HandlerContext, login string) (time.Duration, error) {
+	var wait time.Duration
+	subjects := []string{addressSubject(c.GetClientAddress())}
+	if login != "" {
+		subjects = append(subjects, userSubject(login))
+	}
+
+	for _, subject := range subjects {
+		if until, err := c.Dao.GetLoginBlockedUntil(c.GetCurrentContext(), subject); err != nil {
+			return 0, err
+		} else if remaining := time.Until(until); remaining > wait {
+			wait = remaining
+		}
+	}
+
+	return wait, nil
+}
+
+// failure registers a failed login, and blocks user and address as needed. Lockouts are logged as events.
+// Empty login counts a failure for the address only
+func (t LoginThrottle) failure(c *HandlerContext, login string) error {
+	ctx := c.GetCurrentContext()
+	address := c.GetClientAddress()
+	if failures, err := c.Dao.CountLoginFailure(ctx, addressSubject(address), t.Window); err != nil {
+		return err
+	} else if failures >= t.MaxAddressFailures {
+		if err := c.Dao.BlockLogin(ctx, addressSubject(address), time.Now().Add(t.LockoutDuration)); err != nil {
+			return err
+		}
+
+		c.Dao.LogEvent(ctx, login, "security", fmt.Sprintf("address %s locked after %d failed logins", address, failures), []string{address})
+	}
+
+	// invalid names are not users, no need to count
+	if !ValidateUsernameFormat(login) {
+		return nil
+	}
+
+	if failures, err := c.Dao.CountLoginFailure(ctx, userSubject(login), t.Window); err != nil {
+		return err
+	} else if failures < t.MaxUserFailures {
+		return c.Dao.BlockLogin(ctx, userSubject(login), time.Now().Add(t.Backoff(failures)))
+	} else if err := c.Dao.BlockLogin(ctx, userSubject(login), time.Now().Add(t.LockoutDuration)); err != nil {
+		return err
+	} else {
+		c.Dao.LogEvent(ctx, login, "security", fmt.Sprintf("user %s locked after %d failed logins", login, failures), []string{address})
+		return nil
+	}
+}
+
+// request counts a request to a rate limited endpoint (password reset) for an user.
+// Requests count as failed logins of the client address (and may lock it).
+// Result is false if user got more than MaxUserFailures requests within Window
+func (t LoginThrottle) request(c *HandlerContext, login string) (bool, error) {
+	if err := t.failure(c, ""); err != nil {
+		return false, err
+	} else if requests, err := c.Dao.CountLoginFailure(c.GetCurrentContext(), resetSubject(login), t.Window); err != nil {
+		return false, err
+	} else {
+		return requests <= t.MaxUserFailures, nil
+	}
+}
+
+// success clears the failures of an user
+func (t LoginThrottle) success(c *HandlerContext, login string) error {
+	return c.Dao.ClearLoginFailures(c.GetCurrentContext(), userSubject(login))
+}
@@ -1,58 +1,195 @@
 package engines
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/zefrenchwan/scrutateur.git/dto"
 )
 
 // Content of the token when using JWT
 type TokenContent struct {
+	// ID is the unique id of the token (jti), to revoke it
+	ID             string
 	Username       string
+	IssuedAt       time.Time
 	ExpirationTime time.Time
+	// MFA is true if user used a second factor to get the token
+	MFA bool
+	// Permissions are the roles of the user when token was issued, nil if token has none
+	Permissions *Permissions
 }
 
+// Permissions are the roles of an user per feature, embedded in access tokens to avoid database lookups.
+// Version is the permissions version of the user (see Dao.GetPermissionsVersion): once it changes, permissions are stale
+type Permissions struct {
+	Version int64                      `json:"v"`
+	Roles   map[string][]dto.GrantRole `json:"roles"`
+}
+
+// Possible uses of a token, set in the use claim.
+// An access token gives access to protected pages, a challenge token only allows to send the second factor
+const (
+	TOKEN_USE_ACCESS    = "access"
+	TOKEN_USE_CHALLENGE = "mfa_challenge"
+)
+
 // Thanks to
 // https://medium.com/@cheickzida/golang-implementing-jwt-token-authentication-bba9bfd84d60
 // for the JWT token management
 
-// CreateToken creates a string token for a given user, based on a secret.
-// NOTE THAT secret is not the user's password
-// Token is valid for a given duration
-func CreateToken(username, secret string, delay time.Duration) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"username": username,
-			"exp":      time.Now().UTC().Add(delay.Abs()).Unix(),
-		})
-
-	tokenString, err := token.SignedString([]byte(secret))
-	if err != nil {
-		return "", err
+// TokenIssuer creates access tokens (short-lived JWT) and refresh tokens (opaque, long-lived, stored server side)
+type TokenIssuer struct {
+	// keys sign and verify access tokens
+	keys *KeyRing
+	// AccessDuration is the validity of an access token
+	AccessDuration time.Duration
+	// RefreshDuration is the validity of a refresh token
+	RefreshDuration time.Duration
+	// ChallengeDuration is the validity of a MFA challenge token
+	ChallengeDuration time.Duration
+	// EmbedPermissions is true to set permissions of users in access tokens
+	EmbedPermissions bool
+}
+
+// DEFAULT_CHALLENGE_DURATION is the time an user has to send the second factor after password validation
+const DEFAULT_CHALLENGE_DURATION = 5 * time.Minute
+
+// NewTokenIssuer builds a token issuer signing access tokens with keys of that ring
+func NewTokenIssuer(keys *KeyRing, accessDuration, refreshDuration time.Duration) *TokenIssuer {
+	return &TokenIssuer{keys: keys, AccessDuration: accessDuration, RefreshDuration: refreshDuration, ChallengeDuration: DEFAULT_CHALLENGE_DURATION}
+}
+
+// Keys returns the key ring of the issuer
+func (t *TokenIssuer) Keys() *KeyRing {
+	return t.keys
+}
+
+// CreateAccessToken creates an access token for that user, signed with the current key.
+// Flag mfa is true if user used a second factor
+func (t *TokenIssuer) CreateAccessToken(username string, mfa bool) (string, error) {
+	return t.createToken(username, TOKEN_USE_ACCESS, mfa, nil, t.AccessDuration)
+}
+
+// CreateAccessTokenWithPermissions creates an access token for that user, with those permissions as a claim
+func (t *TokenIssuer) CreateAccessTokenWithPermissions(username string, mfa bool, permissions Permissions) (string, error) {
+	return t.createToken(username, TOKEN_USE_ACCESS, mfa, &permissions, t.AccessDuration)
+}
+
+// CreateChallengeToken creates a token proving that user sent a valid password, to exchange with the second factor
+func (t *TokenIssuer) CreateChallengeToken(username string) (string, error) {
+	return t.createToken(username, TOKEN_USE_CHALLENGE, false, nil, t.ChallengeDuration)
+}
+
+// createToken creates a signed token for that use, with permissions if any
+func (t *TokenIssuer) createToken(username, use string, mfa bool, permissions *Permissions, duration time.Duration) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"jti":      uuid.NewString(),
+		"username": username,
+		"use":      use,
+		"mfa":      mfa,
+		"iat":      now.Unix(),
+		"exp":      now.Add(duration.Abs()).Unix(),
+	}
+
+	if permissions != nil {
+		claims["perms"] = permissions
 	}
 
-	return tokenString, nil
+	return t.keys.Sign(claims)
 }
 
-// VerifyToken uses the secret to check for a token and returns either the token content,nil or empty, and error for invalid token
-func VerifyToken(secret string, tokenString string) (TokenContent, error) {
-	var content TokenContent
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		return []byte(secret), nil
-	})
+// VerifyAccessToken checks an access token signature and expiration, and returns its content.
+// It does not check revocation (see AuthenticationMiddleware)
+func (t *TokenIssuer) VerifyAccessToken(ctx context.Context, tokenString string) (TokenContent, error) {
+	return t.verifyToken(ctx, tokenString, TOKEN_USE_ACCESS)
+}
 
-	if err != nil {
+// VerifyChallengeToken checks a MFA challenge token signature and expiration, and returns its content
+func (t *TokenIssuer) VerifyChallengeToken(ctx context.Context, tokenString string) (TokenContent, error) {
+	return t.verifyToken(ctx, tokenString, TOKEN_USE_CHALLENGE)
+}
+
+// verifyToken checks a token signature, expiration and use, and returns its content
+func (t *TokenIssuer) verifyToken(ctx context.Context, tokenString, expectedUse string) (TokenContent, error) {
+	var content TokenContent
+	if token, err := t.keys.Parse(ctx, tokenString); err != nil {
 		return content, err
 	} else if !token.Valid {
 		return content, errors.New("invalid token")
 	} else if claims, ok := token.Claims.(jwt.MapClaims); !ok {
 		return content, errors.New("unsupported claim type for JWT token")
-	} else if timeValue, err := claims.GetExpirationTime(); err != nil {
+	} else if timeValue, err := claims.GetExpirationTime(); err != nil || timeValue == nil {
 		return content, errors.New("cannot read token expiration time")
+	} else if issuedAt, err := claims.GetIssuedAt(); err != nil || issuedAt == nil {
+		return content, errors.New("cannot read token issue time")
+	} else if username, ok := claims["username"].(string); !ok || username == "" {
+		return content, errors.New("missing username in token")
+	} else if id, ok := claims["jti"].(string); !ok || id == "" {
+		return content, errors.New("missing id in token")
+	} else if use, _ := claims["use"].(string); use != expectedUse {
+		return content, errors.New("unexpected token use")
+	} else if permissions, err := parsePermissions(claims["perms"]); err != nil {
+		return content, err
 	} else {
+		content.Permissions = permissions
+		content.MFA, _ = claims["mfa"].(bool)
+		content.ID = id
+		content.Username = username
+		content.IssuedAt = issuedAt.Time
 		content.ExpirationTime = timeValue.Time
-		content.Username = claims["username"].(string)
 		return content, nil
 	}
 }
+
+// parsePermissions reads the permissions claim, nil if there is none
+func parsePermissions(claim any) (*Permissions, error) {
+	if claim == nil {
+		return nil, nil
+	}
+
+	var result Permissions
+	if raw, err := json.Marshal(claim); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, errors.New("invalid permissions in token")
+	}
+
+	return &result, nil
+}
+
+// NewRefreshToken returns a random opaque refresh token and its hash (to store)
+func NewRefreshToken() (string, []byte, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", nil, err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(value)
+	return token, HashRefreshToken(token), nil
+}
+
+// NewResetToken returns a random opaque password reset token and its hash (to store), as refresh tokens
+func NewResetToken() (string, []byte, error) {
+	return NewRefreshToken()
+}
+
+// HashRefreshToken returns the hash of a refresh token, as stored.
+// Refresh tokens are random and long, a fast hash is then enough
+func HashRefreshToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// HashResetToken returns the hash of a password reset token, as stored
+func HashResetToken(token string) []byte {
+	return HashRefreshToken(token)
+}
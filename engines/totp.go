@@ -0,0 +1,136 @@
+package engines
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP_PERIOD is the validity of a TOTP code (RFC 6238 default)
+const TOTP_PERIOD = 30 * time.Second
+
+// TOTP_DIGITS is the number of digits of a TOTP code
+const TOTP_DIGITS = 6
+
+// TOTP_SKEW is the number of periods before and after current one to accept, for clocks drift
+const TOTP_SKEW = 1
+
+// RECOVERY_CODES_COUNT is the number of recovery codes to generate
+const RECOVERY_CODES_COUNT = 10
+
+// totpEncoding encodes TOTP secrets, as expected by authenticator apps
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random TOTP secret (160 bits), base32 encoded
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI returns the otpauth URI to set in a QR code, for authenticator apps to register the secret
+func TOTPProvisioningURI(issuer, login, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	values.Set("period", fmt.Sprint(int(TOTP_PERIOD.Seconds())))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(login)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// TOTPStep returns the time step of a moment
+func TOTPStep(moment time.Time) int64 {
+	return moment.Unix() / int64(TOTP_PERIOD.Seconds())
+}
+
+// TOTPCode returns the code of a secret for a time step (RFC 4226 dynamic truncation)
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for index := 0; index < TOTP_DIGITS; index++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo), nil
+}
+
+// ValidateTOTP returns the time step matching code at that moment (with skew), and true if code is valid.
+// Comparison is constant-time
+func ValidateTOTP(secret, code string, moment time.Time) (int64, bool, error) {
+	current := TOTPStep(moment)
+	var matchingStep int64
+	matches := false
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if expected, err := TOTPCode(secret, step); err != nil {
+			return 0, false, err
+		} else if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			matchingStep = step
+			matches = true
+		}
+	}
+
+	return matchingStep, matches, nil
+}
+
+// IsTOTPCodeFormat returns true if value looks like a TOTP code (digits only), false for recovery codes
+func IsTOTPCodeFormat(value string) bool {
+	if len(value) != TOTP_DIGITS {
+		return false
+	}
+
+	for _, character := range value {
+		if character < '0' || character > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewRecoveryCodes returns random single use codes, as xxxxx-xxxxx
+func NewRecoveryCodes(count int) ([]string, error) {
+	result := make([]string, 0, count)
+	for len(result) < count {
+		value := make([]byte, 7)
+		if _, err := rand.Read(value); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(value))[:10]
+		result = append(result, code[:5]+"-"+code[5:])
+	}
+
+	return result, nil
+}
+
+// HashRecoveryCode returns the hash of a recovery code, as stored. Case, spaces and dashes do not matter
+func HashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
@@ -1,7 +1,15 @@
 package engines
 
 import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
 )
 
 // REGEXP_URL_PART defines what is acceptable for an url part: /part1/part2/part3
@@ -33,3 +41,121 @@ func ValidateDateFormat(input string) bool {
 		return res
 	}
 }
+
+// ValidateEmailFormat tests if an email is a bare address (no display name)
+func ValidateEmailFormat(email string) bool {
+	if address, err := mail.ParseAddress(email); err != nil {
+		return false
+	} else {
+		return address.Address == email && len(email) <= 254
+	}
+}
+
+// validators are the rules to use in validate tags, per name
+var validators = map[string]func(string) bool{
+	"username":     ValidateUsernameFormat,
+	"password":     ValidateUserpasswordFormat,
+	"date":         ValidateDateFormat,
+	"email":        ValidateEmailFormat,
+	"token_name":   ValidateTokenNameFormat,
+	"role_name":    ValidateRoleNameFormat,
+	"feature_name": ValidateFeatureNameFormat,
+	"boolean": func(value string) bool {
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	},
+	"role": func(value string) bool {
+		_, err := dto.ParseGrantRole(value)
+		return err == nil
+	},
+}
+
+// RegisterValidator adds a rule to use in validate tags. Register rules at startup, before serving requests
+func RegisterValidator(name string, rule func(string) bool) {
+	validators[name] = rule
+}
+
+// ValidateStruct applies the rules of validate tags on the fields of value (if value is a struct).
+// Tag is a list of rules, for instance validate:"required,username":
+//   - required refuses empty values (empty string, nil or empty slice or map)
+//   - any other rule is a registered validator applied to non empty strings, to elements of slices and to values of maps
+func ValidateStruct(value any) error {
+	structValue := reflect.ValueOf(value)
+	if structValue.Kind() == reflect.Pointer {
+		structValue = structValue.Elem()
+	}
+
+	if structValue.Kind() != reflect.Struct {
+		return nil
+	}
+
+	structType := structValue.Type()
+	for index := 0; index < structType.NumField(); index++ {
+		field := structType.Field(index)
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+
+		name := fieldName(field)
+		fieldValue := structValue.Field(index)
+		for _, rule := range strings.Split(tag, ",") {
+			if rule == "required" {
+				if fieldValue.IsZero() || (isCollection(fieldValue) && fieldValue.Len() == 0) {
+					return NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("missing value for %s", name))
+				}
+			} else if validator, found := validators[rule]; !found {
+				panic(fmt.Sprintf("no validator named %s", rule))
+			} else if !applyValidator(validator, fieldValue) {
+				return NewApiError(http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("invalid value for %s: expecting %s format", name, rule))
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyValidator applies rule to value (strings, and recursively to slices elements and map values)
+func applyValidator(rule func(string) bool, value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return value.String() == "" || rule(value.String())
+	case reflect.Slice, reflect.Array:
+		for index := 0; index < value.Len(); index++ {
+			if !applyValidator(rule, value.Index(index)) {
+				return false
+			}
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			if !applyValidator(rule, value.MapIndex(key)) {
+				return false
+			}
+		}
+	case reflect.Pointer:
+		return value.IsNil() || applyValidator(rule, value.Elem())
+	}
+
+	return true
+}
+
+// isCollection returns true for values with a length (slices, maps)
+func isCollection(value reflect.Value) bool {
+	kind := value.Kind()
+	return kind == reflect.Slice || kind == reflect.Map || kind == reflect.Array
+}
+
+// fieldName returns the name of the field as the client knows it
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"path", "query", "json"} {
+		if name, _, _ := strings.Cut(field.Tag.Get(tag), ","); name != "" && name != "-" {
+			return name
+		}
+	}
+
+	if field.Tag.Get("body") == "true" {
+		return "body"
+	}
+
+	return field.Name
+}
@@ -1,6 +1,8 @@
 package services_test
 
 import (
+	"net/http"
+	"slices"
 	"testing"
 
 	"github.com/zefrenchwan/scrutateur.git/dto"
@@ -10,7 +12,7 @@ import (
 func TestMatchesAccept(t *testing.T) {
 	rule := dto.GrantAccessForResource{Operator: dto.OperatorMatches, Template: "/root/admin/*", UserRoles: []dto.GrantRole{dto.RoleRoot}}
 	engine := engines.AuthRulesEngine{Conditions: []dto.GrantAccessForResource{rule}}
-	if access, roles, err := engine.CanAccessResource("/root/admin/popo"); err != nil {
+	if access, roles, err := engine.CanAccessResource(http.MethodGet, "/root/admin/popo"); err != nil {
 		t.Fatal(err)
 	} else if !access {
 		t.Fail()
@@ -24,7 +26,7 @@ func TestMatchesAccept(t *testing.T) {
 func TestMatchesRefuse(t *testing.T) {
 	rule := dto.GrantAccessForResource{Operator: dto.OperatorMatches, Template: "/root/admin/*", UserRoles: []dto.GrantRole{dto.RoleRoot}}
 	engine := engines.AuthRulesEngine{Conditions: []dto.GrantAccessForResource{rule}}
-	if access, roles, err := engine.CanAccessResource("/root/admin/popo/"); err != nil {
+	if access, roles, err := engine.CanAccessResource(http.MethodGet, "/root/admin/popo/"); err != nil {
 		t.Fatal(err)
 	} else if access {
 		t.Fail()
@@ -32,7 +34,7 @@ func TestMatchesRefuse(t *testing.T) {
 		t.Fail()
 	}
 
-	if access, roles, err := engine.CanAccessResource("/root/admin/"); err != nil {
+	if access, roles, err := engine.CanAccessResource(http.MethodGet, "/root/admin/"); err != nil {
 		t.Fatal(err)
 	} else if access {
 		t.Fail()
@@ -40,7 +42,7 @@ func TestMatchesRefuse(t *testing.T) {
 		t.Fail()
 	}
 
-	if access, roles, err := engine.CanAccessResource("/root/admin/popo/wawa"); err != nil {
+	if access, roles, err := engine.CanAccessResource(http.MethodGet, "/root/admin/popo/wawa"); err != nil {
 		t.Fatal(err)
 	} else if access {
 		t.Fail()
@@ -115,3 +117,248 @@ func TestGrant(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestConditionsFromPermissions(t *testing.T) {
+	resources := []dto.Resource{
+		{Operator: dto.OperatorStartsWith, Template: "/manage/", Feature: "management", Roles: []dto.GrantRole{dto.RoleAdmin, dto.RoleRoot}, RequiresMFA: true},
+		{Operator: dto.OperatorEquals, Template: "/self/user/whoami", Feature: "self", Roles: []dto.GrantRole{dto.RoleReader}},
+	}
+
+	roles := map[string][]dto.GrantRole{"management": {dto.RoleAdmin, dto.RoleReader}, "other": {dto.RoleRoot}}
+	conditions := engines.ConditionsFromPermissions(roles, resources)
+	if len(conditions) != 1 {
+		t.Log("expecting one condition, got", conditions)
+		t.Fail()
+	} else if conditions[0].Template != "/manage/" || !conditions[0].RequiresMFA {
+		t.Log("invalid condition", conditions[0])
+		t.Fail()
+	} else if len(conditions[0].UserRoles) != 1 || conditions[0].UserRoles[0] != dto.RoleAdmin {
+		t.Log("expecting admin role only, got", conditions[0].UserRoles)
+		t.Fail()
+	}
+}
+
+func TestContainsOperator(t *testing.T) {
+	if operator, err := dto.ParseGrantOperator("CONTAINS"); err != nil || operator != dto.OperatorContains {
+		t.Log("CONTAINS not parsed", err)
+		t.Fail()
+	} else if !engines.MatchesTemplate(operator, "/reports/", "/api/reports/2024") {
+		t.Log("CONTAINS should match")
+		t.Fail()
+	} else if engines.MatchesTemplate(operator, "/reports/", "/api/report/2024") {
+		t.Log("CONTAINS should not match")
+		t.Fail()
+	}
+}
+
+func TestRegexOperator(t *testing.T) {
+	template := `/manage/user/(?P<login>[a-z]+)/(delete|unlock)`
+	if err := engines.ValidateTemplate(dto.OperatorRegex, template); err != nil {
+		t.Log("valid template refused", err)
+		t.Fail()
+	} else if err := engines.ValidateTemplate(dto.OperatorRegex, `/manage/(\w+)/\1`); err == nil {
+		t.Log("backreference accepted, not RE2")
+		t.Fail()
+	} else if err := engines.ValidateTemplate(dto.OperatorRegex, `/self/user/whoami)|(.*`); err == nil {
+		t.Log("unbalanced groups accepted, template would match any url")
+		t.Fail()
+	} else if engines.MatchesTemplate(dto.OperatorRegex, `/self/user/whoami)|(.*`, "/manage/keys/rotate") {
+		t.Log("unbalanced groups should match nothing")
+		t.Fail()
+	} else if matches, captures := engines.MatchTemplate(dto.OperatorRegex, template, "/manage/user/bob/unlock"); !matches || captures["login"] != "bob" {
+		t.Log("regex should match and capture", captures)
+		t.Fail()
+	} else if engines.MatchesTemplate(dto.OperatorRegex, template, "/manage/user/bob/unlock/now") {
+		t.Log("regex should match the whole url")
+		t.Fail()
+	} else if engines.MatchesTemplate(dto.OperatorRegex, `/manage/(`, "/manage/(") {
+		t.Log("invalid regex should match nothing")
+		t.Fail()
+	}
+}
+
+func TestMatchesWildcards(t *testing.T) {
+	accepted := map[string]string{
+		"/files/**":           "/files/a/b/c",
+		"/files/**/content":   "/files/a/b/content",
+		"/files/**/raw":       "/files/raw",
+		"/groups/{group}/*":   "/groups/team/list",
+		"/a/**/b/**/c":        "/a/x/b/y/z/c",
+		"/manage/user/*/edit": "/manage/user/bob/edit",
+	}
+
+	for template, url := range accepted {
+		if !engines.MatchesTemplate(dto.OperatorMatches, template, url) {
+			t.Log(template, "should match", url)
+			t.Fail()
+		}
+	}
+
+	refused := map[string]string{
+		"/files/**":         "/files/a/",
+		"/files/**/content": "/files/a/b",
+		"/groups/{group}/*": "/groups/team",
+		"/a/*/c":            "/a/x/y/c",
+	}
+
+	for template, url := range refused {
+		if engines.MatchesTemplate(dto.OperatorMatches, template, url) {
+			t.Log(template, "should not match", url)
+			t.Fail()
+		}
+	}
+
+	if matches, captures := engines.MatchTemplate(dto.OperatorMatches, "/groups/{group}/revoke/user/{user}", "/groups/team/revoke/user/bob"); !matches {
+		t.Log("named captures should match")
+		t.Fail()
+	} else if captures["group"] != "team" || captures["user"] != "bob" {
+		t.Log("invalid captures", captures)
+		t.Fail()
+	} else if err := engines.ValidateTemplate(dto.OperatorMatches, "/groups/{gr-oup}"); err == nil {
+		t.Log("invalid capture name accepted")
+		t.Fail()
+	}
+}
+
+func TestMethodConditions(t *testing.T) {
+	readOnly := dto.GrantAccessForResource{Operator: dto.OperatorMatches, Template: "/manage/user/*/access/list", UserRoles: []dto.GrantRole{dto.RoleReader}, Methods: []string{http.MethodGet}}
+	anyMethod := dto.GrantAccessForResource{Operator: dto.OperatorEquals, Template: "/self/user/whoami", UserRoles: []dto.GrantRole{dto.RoleReader}}
+	engine := engines.AuthRulesEngine{Conditions: []dto.GrantAccessForResource{readOnly, anyMethod}}
+	if access, _, _ := engine.CanAccessResource(http.MethodGet, "/manage/user/bob/access/list"); !access {
+		t.Log("GET should be accepted")
+		t.Fail()
+	} else if access, _, _ := engine.CanAccessResource(http.MethodHead, "/manage/user/bob/access/list"); !access {
+		t.Log("HEAD should be accepted as GET")
+		t.Fail()
+	} else if access, roles, _ := engine.CanAccessResource(http.MethodDelete, "/manage/user/bob/access/list"); access || roles != nil {
+		t.Log("DELETE should be refused")
+		t.Fail()
+	} else if access, _, _ := engine.CanAccessResource(http.MethodPut, "/self/user/whoami"); !access {
+		t.Log("condition with no method should apply to any method")
+		t.Fail()
+	}
+}
+
+func TestRulesPrecedence(t *testing.T) {
+	allow := func(operator dto.GrantOperator, template string, roles ...dto.GrantRole) dto.GrantAccessForResource {
+		return dto.GrantAccessForResource{Operator: operator, Template: template, UserRoles: roles, Effect: dto.EffectAllow}
+	}
+
+	deny := func(operator dto.GrantOperator, template string, roles ...dto.GrantRole) dto.GrantAccessForResource {
+		return dto.GrantAccessForResource{Operator: operator, Template: template, UserRoles: roles, Effect: dto.EffectDeny}
+	}
+
+	mfa := func(condition dto.GrantAccessForResource) dto.GrantAccessForResource {
+		condition.RequiresMFA = true
+		return condition
+	}
+
+	tests := []struct {
+		name       string
+		conditions []dto.GrantAccessForResource
+		url        string
+		allowed    bool
+		roles      []dto.GrantRole
+		mfa        bool
+		template   string
+	}{
+		{
+			name:       "no matching condition",
+			conditions: []dto.GrantAccessForResource{allow(dto.OperatorEquals, "/a", dto.RoleReader)},
+			url:        "/b",
+		},
+		{
+			name:       "roles merged across matching conditions",
+			conditions: []dto.GrantAccessForResource{allow(dto.OperatorStartsWith, "/manage/", dto.RoleAdmin), allow(dto.OperatorMatches, "/manage/user/*/edit", dto.RoleEditor)},
+			url:        "/manage/user/bob/edit",
+			allowed:    true,
+			roles:      []dto.GrantRole{dto.RoleAdmin, dto.RoleEditor},
+			template:   "/manage/user/*/edit",
+		},
+		{
+			name:       "deny wins over a more specific allow",
+			conditions: []dto.GrantAccessForResource{allow(dto.OperatorEquals, "/manage/keys", dto.RoleAdmin), deny(dto.OperatorStartsWith, "/manage/", dto.RoleAdmin)},
+			url:        "/manage/keys",
+			template:   "/manage/",
+		},
+		{
+			name:       "deny not matching does not apply",
+			conditions: []dto.GrantAccessForResource{allow(dto.OperatorStartsWith, "/manage/", dto.RoleAdmin), deny(dto.OperatorEquals, "/manage/keys", dto.RoleAdmin)},
+			url:        "/manage/users",
+			allowed:    true,
+			roles:      []dto.GrantRole{dto.RoleAdmin},
+			template:   "/manage/",
+		},
+		{
+			name:       "any allow giving roles requires MFA",
+			conditions: []dto.GrantAccessForResource{mfa(allow(dto.OperatorStartsWith, "/manage/", dto.RoleAdmin)), allow(dto.OperatorEquals, "/manage/x", dto.RoleReader)},
+			url:        "/manage/x",
+			allowed:    true,
+			roles:      []dto.GrantRole{dto.RoleAdmin, dto.RoleReader},
+			mfa:        true,
+			template:   "/manage/x",
+		},
+		{
+			name:       "longer literal part is more specific",
+			conditions: []dto.GrantAccessForResource{allow(dto.OperatorMatches, "/groups/*/list", dto.RoleReader), mfa(allow(dto.OperatorMatches, "/groups/admins/*", dto.RoleAdmin))},
+			url:        "/groups/admins/list",
+			allowed:    true,
+			roles:      []dto.GrantRole{dto.RoleAdmin, dto.RoleReader},
+			mfa:        true,
+			template:   "/groups/admins/*",
+		},
+	}
+
+	for _, test := range tests {
+		// result should not depend on conditions order
+		reversed := slices.Clone(test.conditions)
+		slices.Reverse(reversed)
+		for _, conditions := range [][]dto.GrantAccessForResource{test.conditions, reversed} {
+			engine := engines.AuthRulesEngine{Conditions: conditions}
+			decision := engine.Evaluate(http.MethodGet, test.url)
+			if decision.Allowed != test.allowed || !slices.Equal(decision.Roles, test.roles) || decision.RequiresMFA != test.mfa {
+				t.Log(test.name, ": unexpected decision", decision)
+				t.Fail()
+			} else if test.template == "" && decision.Rule != nil {
+				t.Log(test.name, ": unexpected rule", decision.Rule)
+				t.Fail()
+			} else if test.template != "" && (decision.Rule == nil || decision.Rule.Template != test.template) {
+				t.Log(test.name, ": unexpected rule", decision.Rule)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestRolesHierarchy(t *testing.T) {
+	auditor := dto.Role{Name: "auditor", Description: "reads audits", Implies: []dto.GrantRole{dto.RoleReader}}
+	owner := dto.Role{Name: "owner", Description: "owns a feature", Implies: []dto.GrantRole{dto.RoleAdmin, "auditor"}}
+	dto.SetKnownRoles([]dto.Role{auditor, owner})
+	defer dto.SetKnownRoles(nil)
+
+	if _, err := dto.ParseGrantRole("auditor"); err != nil {
+		t.Log("custom role not parsed", err)
+		t.Fail()
+	} else if roles := dto.ExpandRoles([]dto.GrantRole{"owner"}); !slices.Equal(roles, []dto.GrantRole{dto.RoleAdmin, "auditor", dto.RoleEditor, "owner", dto.RoleReader}) {
+		t.Log("invalid expanded roles", roles)
+		t.Fail()
+	} else if !dto.MayGrantRole([]dto.GrantRole{dto.RoleAdmin}, dto.RoleReader) || dto.MayGrantRole([]dto.GrantRole{dto.RoleAdmin}, dto.RoleRoot) {
+		t.Log("admin grants admin and below")
+		t.Fail()
+	} else if dto.MayGrantRole([]dto.GrantRole{dto.RoleAdmin}, "auditor") {
+		t.Log("admin does not imply auditor, cannot grant it")
+		t.Fail()
+	} else if !dto.MayGrantRole([]dto.GrantRole{"owner"}, dto.RoleEditor) || dto.MayGrantRole([]dto.GrantRole{"owner"}, "owner") {
+		t.Log("owner grants as admin, but cannot grant owner")
+		t.Fail()
+	} else if err := engines.MayGrant(map[string][]dto.GrantRole{"audit": {"auditor"}}, map[string][]dto.GrantRole{"audit": {dto.RoleReader}}); err == nil {
+		t.Log("auditor cannot grant")
+		t.Fail()
+	}
+
+	dto.SetKnownRoles(nil)
+	if _, err := dto.ParseGrantRole("auditor"); err == nil {
+		t.Log("removed role still parsed")
+		t.Fail()
+	}
+}
@@ -0,0 +1,81 @@
+package services_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+// diffRoutes are the protected routes to compare access with
+var diffRoutes = []engines.Route{
+	{Method: "GET", Pattern: "/login"},
+	{Method: "GET", Pattern: "/groups/{groupName}/list", Protected: true},
+	{Method: "DELETE", Pattern: "/groups/delete/{groupName}", Protected: true},
+	{Method: "POST", Pattern: "/manage/user/create", Protected: true},
+}
+
+// diffResources are the resources to compare access with
+var diffResources = []dto.Resource{
+	{ID: 1, Operator: dto.OperatorMatches, Template: "/groups/*/list", Feature: "groups", Roles: []dto.GrantRole{dto.RoleReader}},
+	{ID: 2, Operator: dto.OperatorMatches, Template: "/groups/delete/*", Feature: "groups", Roles: []dto.GrantRole{dto.RoleAdmin}},
+	{ID: 3, Operator: dto.OperatorEquals, Template: "/manage/user/create", Feature: "management", Roles: []dto.GrantRole{dto.RoleAdmin}},
+}
+
+func TestDiffGrants(t *testing.T) {
+	current := map[string][]dto.GrantRole{"groups": {dto.RoleReader}, "management": {dto.RoleAdmin}}
+	change := map[string][]dto.GrantRole{"groups": {dto.RoleAdmin}, "management": {}}
+	// admin implies reader: same roles to list groups, no change
+	changes := engines.DiffGrants(diffRoutes, diffResources, current, change)
+	if len(changes) != 2 {
+		t.Log("invalid changes", changes)
+		t.Fail()
+	} else if deletion := changes[0]; deletion.AllowedBefore || !deletion.AllowedAfter || !slices.Equal(deletion.GainedRoles, []dto.GrantRole{dto.RoleAdmin}) {
+		t.Log("deletion should be gained", deletion)
+		t.Fail()
+	} else if creation := changes[1]; !creation.AllowedBefore || creation.AllowedAfter || !slices.Equal(creation.LostRoles, []dto.GrantRole{dto.RoleAdmin}) {
+		t.Log("creation should be lost", creation)
+		t.Fail()
+	}
+
+	if len(current["management"]) != 1 {
+		t.Log("current grants should not change")
+		t.Fail()
+	} else if changes := engines.DiffGrants(diffRoutes, diffResources, current, nil); len(changes) != 0 {
+		t.Log("no change expected", changes)
+		t.Fail()
+	}
+}
+
+func TestDiffResources(t *testing.T) {
+	users := map[string]map[string][]dto.GrantRole{
+		"bob":   {"groups": {dto.RoleReader}},
+		"alice": {"groups": {dto.RoleAdmin}},
+		"carol": {"management": {dto.RoleAdmin}},
+	}
+
+	proposed := slices.Clone(diffResources)
+	proposed[1] = dto.Resource{ID: 2, Operator: dto.OperatorMatches, Template: "/groups/delete/*", Feature: "groups", Roles: []dto.GrantRole{dto.RoleReader}}
+	diffs := engines.DiffResources(diffRoutes, users, diffResources, proposed)
+	if len(diffs) != 2 || diffs[0].User != "alice" || diffs[1].User != "bob" {
+		t.Log("alice and bob should change, carol should not", diffs)
+		t.Fail()
+	} else if alice := diffs[0].Changes; len(alice) != 1 || !alice[0].AllowedAfter || !slices.Equal(alice[0].GainedRoles, []dto.GrantRole{dto.RoleReader}) || !slices.Equal(alice[0].LostRoles, []dto.GrantRole{dto.RoleAdmin}) {
+		t.Log("alice should delete groups as reader", alice)
+		t.Fail()
+	} else if bob := diffs[1].Changes; len(bob) != 1 || bob[0].AllowedBefore || !bob[0].AllowedAfter {
+		t.Log("bob should gain group deletion", bob)
+		t.Fail()
+	}
+
+	proposed = append(slices.Clone(diffResources), dto.Resource{Operator: dto.OperatorStartsWith, Template: "/groups/", Feature: "groups", Roles: []dto.GrantRole{dto.RoleReader}, Effect: dto.EffectDeny})
+	diffs = engines.DiffResources(diffRoutes, users, diffResources, proposed)
+	if len(diffs) != 2 || diffs[0].User != "alice" || diffs[1].User != "bob" {
+		t.Log("deny resource should remove groups access, ordered by login", diffs)
+		t.Fail()
+	} else if changes := diffs[0].Changes; len(changes) != 2 || changes[0].AllowedAfter || changes[1].AllowedAfter {
+		t.Log("alice should lose groups access", changes)
+		t.Fail()
+	}
+}
@@ -0,0 +1,55 @@
+package services_test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/engines"
+	"github.com/zefrenchwan/scrutateur.git/storage"
+)
+
+func TestRoutingErrorsEnvelope(t *testing.T) {
+	server := engines.NewProcessingEngine(storage.Dao{}, log.Default())
+	server.AddProcessors("GET", "/status", func(c *engines.HandlerContext) error {
+		c.Build(http.StatusOK, "ok", nil)
+		return nil
+	})
+
+	expectations := []struct {
+		method, path string
+		status       int
+		code         engines.ErrorCode
+	}{
+		{"POST", "/status", http.StatusMethodNotAllowed, engines.ErrorCodeMethodNotAllowed},
+		{"GET", "/unknown", http.StatusNotFound, engines.ErrorCodeNotFound},
+	}
+
+	for _, expected := range expectations {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(expected.method, expected.path, nil))
+		var envelope engines.ErrorEnvelope
+		if recorder.Code != expected.status {
+			t.Log("unexpected status", expected.method, expected.path, recorder.Code)
+			t.Fail()
+		} else if err := json.Unmarshal(recorder.Body.Bytes(), &envelope); err != nil {
+			t.Log("expecting a json envelope", recorder.Body.String())
+			t.Fail()
+		} else if envelope.Error.Code != expected.code || envelope.Error.CorrelationID == "" {
+			t.Log("invalid envelope", envelope)
+			t.Fail()
+		} else if expected.status == http.StatusMethodNotAllowed && recorder.Header().Get("Allow") == "" {
+			t.Log("missing Allow header")
+			t.Fail()
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	if recorder.Code != http.StatusOK {
+		t.Log("route should be served", recorder.Code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,71 @@
+package services_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+func TestExplainAccess(t *testing.T) {
+	resources := []dto.Resource{
+		{ID: 1, Operator: dto.OperatorMatches, Template: "/groups/{group}/list", Feature: "groups", Roles: []dto.GrantRole{dto.RoleReader}, Methods: []string{"GET"}},
+		{ID: 2, Operator: dto.OperatorStartsWith, Template: "/groups/", Feature: "groups", Roles: []dto.GrantRole{dto.RoleEditor}},
+		{ID: 3, Operator: dto.OperatorEquals, Template: "/groups/secret/list", Feature: "groups", Roles: []dto.GrantRole{dto.RoleReader}, Effect: dto.EffectDeny},
+		{ID: 4, Operator: dto.OperatorStartsWith, Template: "/manage/", Feature: "management", Roles: []dto.GrantRole{dto.RoleAdmin}},
+	}
+
+	granted := map[int][]dto.GrantRole{1: {dto.RoleReader}, 3: {dto.RoleReader}}
+	explanation := engines.ExplainAccess("get", "/groups/public/list", resources, granted)
+	if !explanation.Allowed || !slices.Equal(explanation.Roles, []dto.GrantRole{dto.RoleReader}) || explanation.Method != "GET" {
+		t.Log("reader should access", explanation)
+		t.Fail()
+	} else if len(explanation.Candidates) != 4 {
+		t.Log("all resources are candidates", explanation.Candidates)
+		t.Fail()
+	} else if first := explanation.Candidates[0]; !first.Applies || !first.Deciding || first.Captures["group"] != "public" {
+		t.Log("invalid deciding candidate", first)
+		t.Fail()
+	} else if second := explanation.Candidates[1]; !second.TemplateMatches || second.Applies || len(second.GrantedRoles) != 0 {
+		t.Log("matching resource with no role should not apply", second)
+		t.Fail()
+	} else if fourth := explanation.Candidates[3]; fourth.TemplateMatches || !fourth.MethodMatches {
+		t.Log("invalid trace of other resource", fourth)
+		t.Fail()
+	}
+
+	explanation = engines.ExplainAccess("GET", "/groups/secret/list", resources, granted)
+	if explanation.Allowed || !explanation.Candidates[2].Deciding || !strings.HasPrefix(explanation.Reason, "denied by resource 3") {
+		t.Log("deny resource should decide", explanation)
+		t.Fail()
+	}
+
+	explanation = engines.ExplainAccess("POST", "/groups/public/list", resources, granted)
+	if explanation.Allowed || explanation.Candidates[0].MethodMatches || slices.ContainsFunc(explanation.Candidates, func(c engines.CandidateRule) bool { return c.Deciding }) {
+		t.Log("no resource should decide", explanation)
+		t.Fail()
+	}
+}
+
+func TestExplainCompact(t *testing.T) {
+	engine := engines.AuthRulesEngine{Conditions: []dto.GrantAccessForResource{
+		{Operator: dto.OperatorStartsWith, Template: "/groups/", UserRoles: []dto.GrantRole{dto.RoleReader}},
+		{Operator: dto.OperatorEquals, Template: "/groups/secret", UserRoles: []dto.GrantRole{dto.RoleReader}, Effect: dto.EffectDeny},
+	}}
+
+	if trace := engine.ExplainCompact("GET", "/groups/secret"); trace != "2 conditions, 2 matching, denied by EQUALS /groups/secret (methods [], roles [reader])" {
+		t.Log("invalid denied trace:", trace)
+		t.Fail()
+	} else if trace := engine.ExplainCompact("GET", "/manage/"); trace != "2 conditions, none matches" {
+		t.Log("invalid trace:", trace)
+		t.Fail()
+	}
+
+	decision, traces := engine.Explain("GET", "/groups/other")
+	if !decision.Allowed || len(traces) != 2 || !traces[0].Deciding || traces[1].Matches() {
+		t.Log("invalid traces", traces)
+		t.Fail()
+	}
+}
@@ -0,0 +1,74 @@
+package services_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+func TestKeyRotation(t *testing.T) {
+	for _, algorithm := range []string{engines.ALGORITHM_HS256, engines.ALGORITHM_RS256, engines.ALGORITHM_EDDSA} {
+		issuer := engines.NewTokenIssuer(newKeyRing(t, algorithm), time.Minute, time.Hour)
+		if before, err := issuer.CreateAccessToken("user", false); err != nil {
+			t.Log(algorithm, "failed to create token", err)
+			t.Fail()
+		} else if _, err := issuer.Keys().Rotate(context.Background()); err != nil {
+			t.Log(algorithm, "failed to rotate", err)
+			t.Fail()
+		} else if after, err := issuer.CreateAccessToken("user", false); err != nil {
+			t.Log(algorithm, "failed to create token", err)
+			t.Fail()
+		} else if _, err := issuer.VerifyAccessToken(context.Background(), before); err != nil {
+			t.Log(algorithm, "token signed with previous key should be valid", err)
+			t.Fail()
+		} else if _, err := issuer.VerifyAccessToken(context.Background(), after); err != nil {
+			t.Log(algorithm, "token signed with current key should be valid", err)
+			t.Fail()
+		}
+
+		// previous keys are dropped after KEYS_TO_KEEP rotations
+		before, _ := issuer.CreateAccessToken("user", false)
+		for index := 0; index < engines.KEYS_TO_KEEP; index++ {
+			issuer.Keys().Rotate(context.Background())
+		}
+
+		if _, err := issuer.VerifyAccessToken(context.Background(), before); err == nil {
+			t.Log(algorithm, "token signed with dropped key should be refused")
+			t.Fail()
+		}
+	}
+}
+
+func TestPublicKeys(t *testing.T) {
+	if keys := newKeyRing(t, engines.ALGORITHM_HS256).PublicKeys(); len(keys.Keys) != 0 {
+		t.Log("secret keys should not be published")
+		t.Fail()
+	}
+
+	rsaKeys := newKeyRing(t, engines.ALGORITHM_RS256).PublicKeys()
+	if len(rsaKeys.Keys) != 1 {
+		t.Log("expecting one rsa key")
+		t.FailNow()
+	} else if key := rsaKeys.Keys[0]; key.KeyType != "RSA" || key.Algorithm != "RS256" || key.Modulus == "" || key.Exponent != "AQAB" {
+		t.Log("invalid rsa key", key)
+		t.Fail()
+	}
+
+	edKeys := newKeyRing(t, engines.ALGORITHM_EDDSA).PublicKeys()
+	if len(edKeys.Keys) != 1 {
+		t.Log("expecting one ed25519 key")
+		t.FailNow()
+	} else if key := edKeys.Keys[0]; key.KeyType != "OKP" || key.Curve != "Ed25519" || key.X == "" || key.KeyID == "" {
+		t.Log("invalid ed25519 key", key)
+		t.Fail()
+	}
+}
+
+func TestUnsupportedAlgorithm(t *testing.T) {
+	if _, err := engines.NewKeyRing("none", nil); err == nil {
+		t.Log("none algorithm should be refused")
+		t.Fail()
+	}
+}
@@ -0,0 +1,54 @@
+package services_test
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+	"github.com/zefrenchwan/scrutateur.git/engines"
+	"github.com/zefrenchwan/scrutateur.git/storage"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	server := engines.NewProcessingEngine(storage.Dao{}, log.Default())
+	noop := func(c *engines.HandlerContext) error { return nil }
+	server.AddProcessors("POST", "/login", noop).Accepts(engines.UserInformation{})
+	protected := server.Group("/manage", noop).Protected()
+	protected.AddProcessors("PUT", "/user/{username}/access/edit", noop).Accepts(engines.UserRolesEdition{})
+
+	resources := []dto.Resource{
+		{Operator: dto.OperatorMatches, Template: "/manage/user/*/access/edit", Feature: "management", Roles: []dto.GrantRole{dto.RoleAdmin, dto.RoleRoot}},
+	}
+
+	document := engines.BuildOpenAPIDocument("test", "1.0", server.Routes(), resources)
+	if _, err := json.Marshal(document); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := document["paths"].(map[string]any)
+	login := paths["/login"].(map[string]any)["post"].(map[string]any)
+	if _, found := login["security"]; found {
+		t.Log("login should not be protected")
+		t.Fail()
+	} else if _, found := login["requestBody"]; !found {
+		t.Log("login expects a body")
+		t.Fail()
+	}
+
+	edit := paths["/manage/user/{username}/access/edit"].(map[string]any)["put"].(map[string]any)
+	if _, found := edit["security"]; !found {
+		t.Log("edit should be protected")
+		t.Fail()
+	} else if features := edit["x-feature"].([]string); !slices.Equal(features, []string{"management"}) {
+		t.Log("invalid feature", features)
+		t.Fail()
+	} else if roles := edit["x-roles"].([]string); !slices.Equal(roles, []string{"admin", "root"}) {
+		t.Log("invalid roles", roles)
+		t.Fail()
+	} else if parameters := edit["parameters"].([]any); len(parameters) != 2 {
+		t.Log("expecting username and dry_run as parameters", parameters)
+		t.Fail()
+	}
+}
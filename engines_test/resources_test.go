@@ -0,0 +1,119 @@
+package services_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+func TestResourceEditionMatchesRoutes(t *testing.T) {
+	routes := []engines.Route{
+		{Method: "GET", Pattern: "/login"},
+		{Method: "GET", Pattern: "/manage/roles/list", Protected: true},
+		{Method: "DELETE", Pattern: "/manage/user/{username}/delete", Protected: true},
+	}
+
+	valid := engines.ResourceEdition{ID: "12", Operator: "MATCHES", Template: "/manage/user/*/delete", Feature: "management", Roles: []string{"root"}, Methods: []string{"delete"}}
+	if resource, err := engines.ParseResourceEdition(valid, routes); err != nil {
+		t.Log("valid resource refused", err)
+		t.Fail()
+	} else if resource.ID != 12 || resource.Effect != dto.EffectAllow || !slices.Equal(resource.Methods, []string{"DELETE"}) {
+		t.Log("invalid parsed resource", resource)
+		t.Fail()
+	}
+
+	invalids := map[string]engines.ResourceEdition{
+		"unprotected route": {Operator: "EQUALS", Template: "/login", Feature: "management", Roles: []string{"root"}},
+		"no such route":     {Operator: "STARTS_WITH", Template: "/manage/groups/", Feature: "management", Roles: []string{"root"}},
+		"other method":      {Operator: "EQUALS", Template: "/manage/roles/list", Feature: "management", Roles: []string{"root"}, Methods: []string{"POST"}},
+		"invalid method":    {Operator: "EQUALS", Template: "/manage/roles/list", Feature: "management", Roles: []string{"root"}, Methods: []string{"FETCH"}},
+		"invalid template":  {Operator: "REGEX", Template: "/manage/(", Feature: "management", Roles: []string{"root"}},
+		"invalid effect":    {Operator: "EQUALS", Template: "/manage/roles/list", Feature: "management", Roles: []string{"root"}, Effect: "MAYBE"},
+		"invalid id":        {ID: "first", Operator: "EQUALS", Template: "/manage/roles/list", Feature: "management", Roles: []string{"root"}},
+	}
+
+	for name, edition := range invalids {
+		if _, err := engines.ParseResourceEdition(edition, routes); err == nil {
+			t.Log("accepted resource:", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestFeatureNameFormat(t *testing.T) {
+	for _, name := range []string{"management", "self", "audits-v2"} {
+		if !engines.ValidateFeatureNameFormat(name) {
+			t.Log("refused feature name", name)
+			t.Fail()
+		}
+	}
+
+	for _, name := range []string{"", "a", "Management", "2fa", "with space"} {
+		if engines.ValidateFeatureNameFormat(name) {
+			t.Log("accepted feature name", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestReconcileRoutesAndResources(t *testing.T) {
+	routes := []engines.Route{
+		{Method: "GET", Pattern: "/login"},
+		{Method: "GET", Pattern: "/self/user/whoami", Protected: true},
+		{Method: "DELETE", Pattern: "/manage/user/{username}/delete", Protected: true},
+		{Method: "POST", Pattern: "/manage/keys/rotate", Protected: true},
+		{Method: "PUT", Pattern: "/groups/{groupName}/upsert/user/{userName}", Protected: true},
+	}
+
+	resources := []dto.Resource{
+		{ID: 1, Operator: dto.OperatorEquals, Template: "/self/user/whoami", Feature: "self", Roles: []dto.GrantRole{dto.RoleReader}},
+		{ID: 2, Operator: dto.OperatorMatches, Template: "/manage/user/*/delete", Feature: "management", Roles: []dto.GrantRole{dto.RoleRoot}},
+		{ID: 3, Operator: dto.OperatorEquals, Template: "/manage/keys/rotate", Feature: "management", Roles: []dto.GrantRole{dto.RoleAdmin}, Effect: dto.EffectDeny},
+		{ID: 4, Operator: dto.OperatorStartsWith, Template: "/groups/", Feature: "groups", Roles: []dto.GrantRole{dto.RoleEditor}},
+		{ID: 5, Operator: dto.OperatorMatches, Template: "/groups/*/upsert/**", Feature: "management", Roles: []dto.GrantRole{dto.RoleAdmin}},
+		{ID: 6, Operator: dto.OperatorEquals, Template: "/login", Feature: "self", Roles: []dto.GrantRole{dto.RoleReader}},
+		{ID: 7, Operator: dto.OperatorEquals, Template: "/self/user/whoami", Feature: "self", Roles: []dto.GrantRole{dto.RoleReader}, Methods: []string{"POST"}},
+	}
+
+	report := engines.Reconcile(routes, resources)
+	if report.Consistent() {
+		t.Log("inconsistent report expected")
+		t.Fail()
+	} else if len(report.UnprotectedRoutes) != 1 || report.UnprotectedRoutes[0].Pattern != "/manage/keys/rotate" {
+		t.Log("deny only route should be unprotected", report.UnprotectedRoutes)
+		t.Fail()
+	} else if len(report.OrphanResources) != 2 || report.OrphanResources[0].ID != 6 || report.OrphanResources[1].ID != 7 {
+		t.Log("invalid orphan resources", report.OrphanResources)
+		t.Fail()
+	} else if len(report.Overlaps) != 1 || !slices.Equal(report.Overlaps[0].Resources, []int{4, 5}) || !slices.Equal(report.Overlaps[0].Features, []string{"groups", "management"}) {
+		t.Log("invalid overlaps", report.Overlaps)
+		t.Fail()
+	} else if len(report.Describe()) != 4 {
+		t.Log("invalid description", report.Describe())
+		t.Fail()
+	}
+
+	if report := engines.Reconcile(routes[:3], resources[:2]); !report.Consistent() || len(report.Overlaps) != 0 {
+		t.Log("consistent report expected", report)
+		t.Fail()
+	}
+
+	// word boundaries are PostgreSQL regex syntax, not RE2: resource matches nothing
+	invalid := append(slices.Clone(resources[:2]),
+		dto.Resource{ID: 8, Operator: dto.OperatorRegex, Template: `/self/user/[[:<:]]whoami`, Feature: "self", Roles: []dto.GrantRole{dto.RoleReader}},
+		dto.Resource{ID: 9, Operator: dto.OperatorRegex, Template: `/self/user/(?P<login>[a-z]+)`, Feature: "self", Roles: []dto.GrantRole{dto.RoleReader}},
+	)
+
+	if report := engines.Reconcile(routes[:3], invalid); report.Consistent() {
+		t.Log("inconsistent report expected", report)
+		t.Fail()
+	} else if len(report.InvalidResources) != 1 || report.InvalidResources[0].ID != 8 || len(report.OrphanResources) != 0 {
+		t.Log("invalid resource expected", report.InvalidResources, report.OrphanResources)
+		t.Fail()
+	} else if len(report.Describe()) != 1 {
+		t.Log("invalid description", report.Describe())
+		t.Fail()
+	}
+}
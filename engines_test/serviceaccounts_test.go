@@ -0,0 +1,52 @@
+package services_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+func TestClientSecrets(t *testing.T) {
+	if secret, hash, err := engines.NewClientSecret(); err != nil {
+		t.Log("failed to create secret", err)
+		t.Fail()
+	} else if !strings.HasPrefix(secret, engines.CLIENT_SECRET_PREFIX) || !bytes.Equal(hash, engines.HashClientSecret(secret)) {
+		t.Log("invalid secret", secret)
+		t.Fail()
+	} else if other, _, _ := engines.NewClientSecret(); other == secret {
+		t.Log("secrets should be random")
+		t.Fail()
+	}
+}
+
+func TestParsePublicKeyPEM(t *testing.T) {
+	public, private, errKey := ed25519.GenerateKey(rand.Reader)
+	if errKey != nil {
+		t.Log("failed to create key", errKey)
+		t.FailNow()
+	}
+
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(private)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+	if material, err := engines.ParsePublicKeyPEM(string(publicPEM)); err != nil {
+		t.Log("failed to parse public key", err)
+		t.Fail()
+	} else if !bytes.Equal(material, publicDER) {
+		t.Log("invalid key material")
+		t.Fail()
+	} else if _, err := engines.ParsePublicKeyPEM(string(privatePEM)); err == nil {
+		t.Log("private key accepted as a public key")
+		t.Fail()
+	} else if _, err := engines.ParsePublicKeyPEM("not a key"); err == nil {
+		t.Log("invalid key accepted")
+		t.Fail()
+	}
+}
@@ -0,0 +1,19 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	throttle := engines.DefaultLoginThrottle()
+	expected := map[int64]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 16 * time.Second, 6: 30 * time.Second, 100: 30 * time.Second}
+	for failures, delay := range expected {
+		if value := throttle.Backoff(failures); value != delay {
+			t.Log("after", failures, "failures, expected", delay, "got", value)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+// newKeyRing returns a loaded key ring with no store, for that algorithm
+func newKeyRing(t *testing.T, algorithm string) *engines.KeyRing {
+	keys, err := engines.NewKeyRing(algorithm, nil)
+	if err != nil {
+		t.Log("failed to create key ring", err)
+		t.FailNow()
+	} else if err := keys.Load(context.Background(), "secret"); err != nil {
+		t.Log("failed to load key ring", err)
+		t.FailNow()
+	}
+
+	return keys
+}
+
+func TestAccessTokens(t *testing.T) {
+	issuer := engines.NewTokenIssuer(newKeyRing(t, engines.ALGORITHM_HS256), time.Minute, time.Hour)
+	foreignKeys, _ := engines.NewKeyRing(engines.ALGORITHM_HS256, nil)
+	if err := foreignKeys.Load(context.Background(), "other"); err != nil {
+		t.Log("failed to load key ring", err)
+		t.FailNow()
+	}
+
+	foreign := engines.NewTokenIssuer(foreignKeys, time.Minute, time.Hour)
+
+	if token, err := issuer.CreateAccessToken("user", false); err != nil {
+		t.Log("failed to create token", err)
+		t.Fail()
+	} else if content, err := issuer.VerifyAccessToken(context.Background(), token); err != nil {
+		t.Log("failed to verify token", err)
+		t.Fail()
+	} else if content.Username != "user" || content.ID == "" {
+		t.Log("invalid token content", content)
+		t.Fail()
+	} else if content.ExpirationTime.Sub(content.IssuedAt) != time.Minute {
+		t.Log("invalid token duration", content)
+		t.Fail()
+	} else if other, _ := issuer.CreateAccessToken("user", false); other == token {
+		t.Log("tokens should have distinct ids")
+		t.Fail()
+	} else if _, err := foreign.VerifyAccessToken(context.Background(), token); err == nil {
+		t.Log("token accepted with another key")
+		t.Fail()
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	if token, hash, err := engines.NewRefreshToken(); err != nil {
+		t.Log("failed to create refresh token", err)
+		t.Fail()
+	} else if !bytes.Equal(hash, engines.HashRefreshToken(token)) {
+		t.Log("hash mismatch")
+		t.Fail()
+	} else if other, _, _ := engines.NewRefreshToken(); other == token {
+		t.Log("refresh tokens should be random")
+		t.Fail()
+	}
+}
+
+func TestChallengeTokens(t *testing.T) {
+	issuer := engines.NewTokenIssuer(newKeyRing(t, engines.ALGORITHM_HS256), time.Minute, time.Hour)
+	if challenge, err := issuer.CreateChallengeToken("user"); err != nil {
+		t.Log("failed to create challenge token", err)
+		t.Fail()
+	} else if _, err := issuer.VerifyAccessToken(context.Background(), challenge); err == nil {
+		t.Log("challenge token accepted as an access token")
+		t.Fail()
+	} else if content, err := issuer.VerifyChallengeToken(context.Background(), challenge); err != nil || content.Username != "user" {
+		t.Log("failed to verify challenge token", err)
+		t.Fail()
+	} else if access, err := issuer.CreateAccessToken("user", true); err != nil {
+		t.Log("failed to create token", err)
+		t.Fail()
+	} else if _, err := issuer.VerifyChallengeToken(context.Background(), access); err == nil {
+		t.Log("access token accepted as a challenge token")
+		t.Fail()
+	} else if content, err := issuer.VerifyAccessToken(context.Background(), access); err != nil || !content.MFA {
+		t.Log("missing mfa flag in access token", err)
+		t.Fail()
+	}
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	issuer := engines.NewTokenIssuer(newKeyRing(t, engines.ALGORITHM_HS256), time.Minute, time.Hour)
+	if token, hash, err := engines.NewAccessToken(); err != nil {
+		t.Log("failed to create access token", err)
+		t.Fail()
+	} else if !engines.IsAccessTokenFormat(token) || !bytes.Equal(hash, engines.HashAccessToken(token)) {
+		t.Log("invalid access token", token)
+		t.Fail()
+	} else if jwt, _ := issuer.CreateAccessToken("user", false); engines.IsAccessTokenFormat(jwt) {
+		t.Log("JWT taken for a personal access token")
+		t.Fail()
+	} else if !engines.ValidateTokenNameFormat("ci-deploy.v2") || engines.ValidateTokenNameFormat("ci deploy") {
+		t.Log("invalid token name validation")
+		t.Fail()
+	} else if err := engines.ValidateStruct(engines.AccessTokenCreation{Name: "ci", Roles: map[string][]string{"self": {"boss"}}}); err == nil {
+		t.Log("invalid role accepted")
+		t.Fail()
+	}
+}
+
+func TestPermissionsClaims(t *testing.T) {
+	issuer := engines.NewTokenIssuer(newKeyRing(t, engines.ALGORITHM_HS256), time.Minute, time.Hour)
+	permissions := engines.Permissions{Version: 3, Roles: map[string][]dto.GrantRole{"self": {dto.RoleReader, dto.RoleEditor}}}
+	if plain, _ := issuer.CreateAccessToken("user", false); plain == "" {
+		t.Log("failed to create access token")
+		t.Fail()
+	} else if content, err := issuer.VerifyAccessToken(context.Background(), plain); err != nil || content.Permissions != nil {
+		t.Log("unexpected permissions", err)
+		t.Fail()
+	} else if token, err := issuer.CreateAccessTokenWithPermissions("user", false, permissions); err != nil {
+		t.Log("failed to create access token with permissions", err)
+		t.Fail()
+	} else if content, err := issuer.VerifyAccessToken(context.Background(), token); err != nil {
+		t.Log("failed to verify access token with permissions", err)
+		t.Fail()
+	} else if content.Permissions == nil || content.Permissions.Version != 3 {
+		t.Log("invalid permissions version", content.Permissions)
+		t.Fail()
+	} else if roles := content.Permissions.Roles["self"]; len(roles) != 2 || roles[0] != dto.RoleReader || roles[1] != dto.RoleEditor {
+		t.Log("invalid permissions roles", roles)
+		t.Fail()
+	}
+}
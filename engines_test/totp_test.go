@@ -0,0 +1,71 @@
+package services_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+// RFC 6238 secret for SHA1 test vectors ("12345678901234567890")
+const RFC_TOTP_SECRET = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 codes have 8 digits, 6 last digits are expected
+	expected := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for seconds, code := range expected {
+		if value, err := engines.TOTPCode(RFC_TOTP_SECRET, engines.TOTPStep(time.Unix(seconds, 0))); err != nil {
+			t.Log("failed to compute code", err)
+			t.Fail()
+		} else if value != code {
+			t.Log("invalid code at", seconds, value, "expecting", code)
+			t.Fail()
+		}
+	}
+}
+
+func TestTOTPValidation(t *testing.T) {
+	moment := time.Unix(1111111111, 0)
+	previous, _ := engines.TOTPCode(RFC_TOTP_SECRET, engines.TOTPStep(moment)-1)
+	if step, valid, err := engines.ValidateTOTP(RFC_TOTP_SECRET, "050471", moment); err != nil || !valid {
+		t.Log("failed to validate code", err)
+		t.Fail()
+	} else if step != engines.TOTPStep(moment) {
+		t.Log("invalid step", step)
+		t.Fail()
+	} else if _, valid, _ := engines.ValidateTOTP(RFC_TOTP_SECRET, previous, moment); !valid {
+		t.Log("previous code should be accepted for clock drift")
+		t.Fail()
+	} else if _, valid, _ := engines.ValidateTOTP(RFC_TOTP_SECRET, "050471", moment.Add(5*engines.TOTP_PERIOD)); valid {
+		t.Log("old code accepted")
+		t.Fail()
+	} else if !engines.IsTOTPCodeFormat("050471") || engines.IsTOTPCodeFormat("abcde-fghij") {
+		t.Log("invalid code format detection")
+		t.Fail()
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	if codes, err := engines.NewRecoveryCodes(engines.RECOVERY_CODES_COUNT); err != nil {
+		t.Log("failed to create recovery codes", err)
+		t.Fail()
+	} else if len(codes) != engines.RECOVERY_CODES_COUNT || codes[0] == codes[1] {
+		t.Log("invalid recovery codes", codes)
+		t.Fail()
+	} else if engines.IsTOTPCodeFormat(codes[0]) {
+		t.Log("recovery code looks like a TOTP code", codes[0])
+		t.Fail()
+	} else if typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")); !bytes.Equal(engines.HashRecoveryCode(typed), engines.HashRecoveryCode(codes[0])) {
+		t.Log("recovery code hash should not depend on case or dashes")
+		t.Fail()
+	}
+}
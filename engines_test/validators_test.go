@@ -34,3 +34,62 @@ func TestInvalidUsername(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestEmailFormat(t *testing.T) {
+	if !engines.ValidateEmailFormat("user@example.com") {
+		t.Log("valid email refused")
+		t.Fail()
+	}
+
+	if engines.ValidateEmailFormat("User <user@example.com>") {
+		t.Log("should refuse display names")
+		t.Fail()
+	}
+
+	if engines.ValidateEmailFormat("user@example.com\r\nBcc: other@example.com") {
+		t.Log("should refuse line breaks")
+		t.Fail()
+	}
+}
+
+func TestValidateStructAccepts(t *testing.T) {
+	request := engines.UserRolesEdition{
+		Username: "popo",
+		Access:   map[string][]string{"self": {"reader", "admin"}, "management": {}},
+	}
+
+	if err := engines.ValidateStruct(request); err != nil {
+		t.Log("valid request refused", err)
+		t.Fail()
+	}
+
+	information := engines.UserInformation{Username: "popo01", Password: "secret"}
+	if err := engines.ValidateStruct(&information); err != nil {
+		t.Log("valid pointer to request refused", err)
+		t.Fail()
+	}
+}
+
+func TestValidateStructRefuses(t *testing.T) {
+	if err := engines.ValidateStruct(engines.UserInformation{Username: "popo"}); err == nil {
+		t.Log("missing password should be refused")
+		t.Fail()
+	}
+
+	if err := engines.ValidateStruct(engines.UserInformation{Username: "01popo", Password: "secret"}); err == nil {
+		t.Log("invalid username should be refused")
+		t.Fail()
+	}
+
+	request := engines.UserRolesEdition{Username: "popo", Access: map[string][]string{"self": {"reader", "king"}}}
+	if err := engines.ValidateStruct(request); err == nil {
+		t.Log("invalid role should be refused")
+		t.Fail()
+	}
+
+	request = engines.UserRolesEdition{Username: "popo"}
+	if err := engines.ValidateStruct(request); err == nil {
+		t.Log("empty access should be refused")
+		t.Fail()
+	}
+}
@@ -0,0 +1,47 @@
+package mails
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileMailer appends mails to a file instead of sending them. Use it for local tests only
+type FileMailer struct {
+	// lock serializes writes
+	lock *sync.Mutex
+	// path is the file to append mails to
+	path string
+	// from is the sender of the mails
+	from string
+}
+
+// NewFileMailer builds a mailer appending mails to the file at path (created if needed)
+func NewFileMailer(path, from string) FileMailer {
+	return FileMailer{lock: &sync.Mutex{}, path: path, from: from}
+}
+
+// Send appends the message to the file
+func (f FileMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	if _, err := file.Write(message.format(f.from, time.Now())); err != nil {
+		return err
+	} else if _, err := file.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	return nil
+}
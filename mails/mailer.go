@@ -0,0 +1,47 @@
+package mails
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mails
+type Mailer interface {
+	// Send sends a message, or returns an error
+	Send(ctx context.Context, message Message) error
+}
+
+// format returns the message as a RFC 5322 mail, from that sender
+func (m Message) format(from string, moment time.Time) []byte {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "From: %s\r\n", from)
+	fmt.Fprintf(&builder, "To: %s\r\n", m.To)
+	fmt.Fprintf(&builder, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&builder, "Date: %s\r\n", moment.Format(time.RFC1123Z))
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	builder.WriteString("\r\n")
+	return []byte(builder.String())
+}
+
+// validate refuses messages with line breaks in headers (header injection)
+func (m Message) validate() error {
+	if m.To == "" {
+		return fmt.Errorf("no recipient for message")
+	} else if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return fmt.Errorf("invalid line break in message headers")
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package mails
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// MemoryMailer keeps mails in memory instead of sending them. Use it for tests only
+type MemoryMailer struct {
+	// lock protects messages
+	lock sync.Mutex
+	// messages are the sent messages, in order
+	messages []Message
+}
+
+// NewMemoryMailer builds a mailer with no message
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send keeps the message
+func (m *MemoryMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// Messages returns a copy of the sent messages, in order
+func (m *MemoryMailer) Messages() []Message {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return slices.Clone(m.messages)
+}
@@ -0,0 +1,43 @@
+package mails
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends mails with a SMTP server
+type SMTPMailer struct {
+	// address is host:port of the server
+	address string
+	// from is the sender of the mails
+	from string
+	// auth is the authentication to the server, nil for none
+	auth smtp.Auth
+}
+
+// NewSMTPMailer builds a mailer for a server at address (host:port), sending mails from that sender.
+// If user is not empty, mailer authenticates with user and password (PLAIN, needs TLS unless server is localhost)
+func NewSMTPMailer(address, from, user, password string) (SMTPMailer, error) {
+	result := SMTPMailer{address: address, from: from}
+	if host, _, err := net.SplitHostPort(address); err != nil {
+		return result, err
+	} else if user != "" {
+		result.auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	return result, nil
+}
+
+// Send sends a message with the SMTP server.
+// Context is not used by net/smtp, the call ends with the server connection
+func (s SMTPMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return smtp.SendMail(s.address, s.auth, s.from, []string{message.To}, message.format(s.from, time.Now()))
+}
@@ -0,0 +1,48 @@
+package mails_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/mails"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := mails.NewMemoryMailer()
+	message := mails.Message{To: "user@example.com", Subject: "Password reset", Body: "token"}
+	if err := mailer.Send(context.Background(), message); err != nil {
+		t.Log("failed to send message", err)
+		t.Fail()
+	} else if messages := mailer.Messages(); len(messages) != 1 || messages[0] != message {
+		t.Log("invalid messages", messages)
+		t.Fail()
+	} else if err := mailer.Send(context.Background(), mails.Message{To: "user@example.com", Subject: "reset\r\nBcc: other@example.com"}); err == nil {
+		t.Log("header injection accepted")
+		t.Fail()
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mails.log")
+	mailer := mails.NewFileMailer(path, "server@example.com")
+	for _, body := range []string{"first token", "second token"} {
+		if err := mailer.Send(context.Background(), mails.Message{To: "user@example.com", Subject: "Password reset", Body: body}); err != nil {
+			t.Log("failed to send message", err)
+			t.Fail()
+		}
+	}
+
+	if content, err := os.ReadFile(path); err != nil {
+		t.Log("failed to read mails", err)
+		t.Fail()
+	} else if text := string(content); !strings.Contains(text, "first token") || !strings.Contains(text, "second token") {
+		t.Log("missing messages in file", text)
+		t.Fail()
+	} else if !strings.Contains(text, "From: server@example.com\r\n") || !strings.Contains(text, "To: user@example.com\r\n") {
+		t.Log("missing headers in file", text)
+		t.Fail()
+	}
+}
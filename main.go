@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"os"
 	"time"
 
 	"github.com/zefrenchwan/scrutateur.git/engines"
+	"github.com/zefrenchwan/scrutateur.git/mails"
 	"github.com/zefrenchwan/scrutateur.git/services"
 	"github.com/zefrenchwan/scrutateur.git/storage"
 )
@@ -18,27 +20,146 @@ func main() {
 
 	////////////////////////
 	// Launch storage system
-	options := storage.DaoOptions{PostgresqlURL: os.Getenv("POSTGRESQL_URL")}
+	// Create cache, if any
+	var cache *storage.CacheStorage
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		if value, err := storage.NewCacheStorage(redisURL); err != nil {
+			logger.Println("Cannot start cache:", err)
+			os.Exit(1)
+		} else {
+			cache = &value
+		}
+	}
+
+	options := storage.DaoOptions{
+		PostgresqlURL:   os.Getenv("POSTGRESQL_URL"),
+		Cache:           cache,
+		PasswordHashing: os.Getenv("PASSWORD_HASHING"),
+	}
 	// Create DAO
 	var dao storage.Dao
 	if db, err := storage.NewDao(options, logger); err != nil {
-		panic(err)
+		logger.Println("Cannot start storage:", err)
+		cache.Close()
+		os.Exit(1)
 	} else {
 		dao = db
 	}
 
-	defer dao.Close()
+	// roles are defined in database, and may change while running
+	rolesContext, stopRoles := context.WithCancel(context.Background())
+	loadContext, cancelLoad := context.WithTimeout(rolesContext, 10*time.Second)
+	errRoles := dao.LoadRoles(loadContext)
+	cancelLoad()
+	if errRoles != nil {
+		logger.Println("Cannot load roles:", errRoles)
+		stopRoles()
+		dao.Close()
+		cache.Close()
+		os.Exit(1)
+	}
+
+	dao.WatchRoles(rolesContext, 5*time.Minute)
 
 	///////////////////////////////
 	// define web serving and links
 
-	secret := os.Getenv("ENGINE_SECRET")
-	if secret == "" {
-		secret = engines.NewLongSecret()
+	// keys to sign tokens are stored, and shared by instances
+	algorithm := os.Getenv("ENGINE_SIGNING_ALGORITHM")
+	if algorithm == "" {
+		algorithm = engines.ALGORITHM_HS256
+	}
+
+	keys, errKeys := engines.NewKeyRing(algorithm, &dao)
+	if errKeys == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		errKeys = keys.Load(ctx, os.Getenv("ENGINE_SECRET"))
+		cancel()
+	}
+
+	if errKeys != nil {
+		logger.Println("Cannot load signing keys:", errKeys)
+		dao.Close()
+		cache.Close()
+		os.Exit(1)
+	}
+
+	// rotate keys on schedule, if any
+	rotationContext, stopRotation := context.WithCancel(context.Background())
+	if value := os.Getenv("ENGINE_KEY_ROTATION"); value != "" {
+		if period, err := time.ParseDuration(value); err != nil || period <= 0 {
+			logger.Println("Invalid key rotation period:", value)
+			dao.Close()
+			cache.Close()
+			os.Exit(1)
+		} else {
+			keys.Schedule(rotationContext, period, logger)
+		}
+	}
+
+	// mails are sent with SMTP if set, or appended to a local file (for local tests)
+	var mailer mails.Mailer
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "scrutateur@localhost"
+	}
+
+	if address := os.Getenv("SMTP_ADDRESS"); address != "" {
+		if value, err := mails.NewSMTPMailer(address, mailFrom, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD")); err != nil {
+			logger.Println("Invalid SMTP address:", address)
+			dao.Close()
+			cache.Close()
+			os.Exit(1)
+		} else {
+			mailer = value
+		}
+	} else {
+		logger.Println("No SMTP server set, mails are written to logs/mails.log")
+		mailer = mails.NewFileMailer("logs/mails.log", mailFrom)
+	}
+
+	// short-lived access tokens, refresh tokens to renew them
+	tokens := engines.NewTokenIssuer(keys, 15*time.Minute, 7*24*time.Hour)
+	// roles in tokens: no roles lookup per request, as long as grants do not change
+	tokens.EmbedPermissions = os.Getenv("ENGINE_PERMISSION_CLAIMS") == "true"
+	engine := services.Init(dao, logger, tokens, mailer)
+
+	// each protected route should have a resource, and each resource a protected route
+	strictResources := os.Getenv("ENGINE_STRICT_RESOURCES") == "true"
+	reconcileContext, cancelReconcile := context.WithTimeout(context.Background(), 10*time.Second)
+	report, errReconcile := engine.Reconcile(reconcileContext)
+	cancelReconcile()
+	if errReconcile != nil {
+		logger.Println("Cannot compare routes and resources:", errReconcile)
+	} else {
+		for _, line := range report.Describe() {
+			logger.Println("Resources:", line)
+		}
+	}
+
+	if strictResources && (errReconcile != nil || !report.Consistent()) {
+		logger.Println("Routes and resources differ, strict mode refuses to start")
+		stopRotation()
+		stopRoles()
+		dao.Close()
+		cache.Close()
+		os.Exit(1)
+	}
+
+	// once server stops, close storage systems in that order
+	engine.OnShutdown("keys", stopRotation)
+	engine.OnShutdown("roles", stopRoles)
+	engine.OnShutdown("dao", dao.Close)
+	if cache != nil {
+		engine.OnShutdown("cache", cache.Close)
 	}
 
-	engine := services.Init(dao, secret, 24*time.Hour)
 	logger.Println("Starting engine")
-	// start engine
-	engine.Launch(":3000")
+	// start engine, blocks until server stops
+	if err := engine.Launch(":3000"); err != nil {
+		logger.Println("Engine failure:", err)
+		os.Exit(1)
+	}
+
+	logger.Println("Engine stopped")
 }
@@ -1,12 +1,8 @@
 package services
 
 import (
-	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
-	"regexp"
 	"slices"
 
 	"github.com/zefrenchwan/scrutateur.git/dto"
@@ -17,10 +13,10 @@ import (
 func endpointCreateGroup(c *engines.HandlerContext) error {
 	name := c.GetQueryParameters()["groupName"]
 	if name == "" {
-		c.Build(http.StatusInternalServerError, "missing group parameter", nil)
+		c.BuildErrorMessage(http.StatusInternalServerError, "missing group parameter", nil)
 		return nil
 	} else if !ValidateGroupNameFormat(name) {
-		c.Build(http.StatusBadRequest, "group parameter does not match valid group name rules", nil)
+		c.BuildErrorMessage(http.StatusBadRequest, "group parameter does not match valid group name rules", nil)
 		return nil
 	}
 
@@ -28,11 +24,11 @@ func endpointCreateGroup(c *engines.HandlerContext) error {
 	groupRoles := append([]dto.GrantRole{dto.RoleReader, dto.RoleEditor}, c.GetRoles()...)
 	groupRoles = slices.Compact(groupRoles)
 
-	if err := c.Dao.CreateUsersGroup(context.Background(), creator, name, groupRoles); err != nil {
+	if err := c.Dao.CreateUsersGroup(c.GetCurrentContext(), creator, name, groupRoles); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 		return nil
 	} else {
-		c.Dao.LogEvent(context.Background(), creator, "groups", fmt.Sprintf("user %s creates group %s", creator, name), nil)
+		c.Dao.LogEvent(c.GetCurrentContext(), creator, "groups", fmt.Sprintf("user %s creates group %s", creator, name), nil)
 		c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
 		return nil
 	}
@@ -42,11 +38,11 @@ func endpointCreateGroup(c *engines.HandlerContext) error {
 func endpointListGroupsForUser(c *engines.HandlerContext) error {
 	login := c.GetLogin()
 	if login == "" {
-		c.Build(http.StatusUnauthorized, "no active user", nil)
+		c.BuildErrorMessage(http.StatusUnauthorized, "no active user", nil)
 		return nil
 	}
 
-	if values, err := c.Dao.ListUserGroupsForSpecificUser(context.Background(), login); err != nil {
+	if values, err := c.Dao.ListUserGroupsForSpecificUser(c.GetCurrentContext(), login); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 		return nil
 	} else if len(values) == 0 {
@@ -61,76 +57,43 @@ func endpointListGroupsForUser(c *engines.HandlerContext) error {
 	}
 }
 
-// endpointUpsertUserInGroup allows to change user (or add user) within a group
-func endpointUpsertUserInGroup(c *engines.HandlerContext) error {
-	parameters := c.GetQueryParameters()
-	groupName := parameters["groupName"]
-	userName := parameters["userName"]
-	login := c.GetLogin()
+// groupMembership is the request to set roles of an user within a group
+type groupMembership struct {
+	GroupName string   `path:"groupName" validate:"required,group"`
+	UserName  string   `path:"userName" validate:"required,username"`
+	Roles     []string `body:"true" validate:"required,role"`
+}
 
-	if !engines.ValidateUsernameFormat(userName) {
-		c.Build(http.StatusBadRequest, "invalid user format", nil)
-		return nil
-	} else if !ValidateGroupNameFormat(groupName) {
-		c.Build(http.StatusBadRequest, "invalid group format", nil)
-		return nil
-	}
+// endpointUpsertUserInGroup allows to change user (or add user) within a group
+var endpointUpsertUserInGroup = engines.JSON(upsertUserInGroup)
 
-	// Read body, expect list of roles
-	var body []byte
-	if groupName == "" {
-		c.Build(http.StatusInternalServerError, "missing group parameter", nil)
-		return nil
-	} else if !ValidateGroupNameFormat(groupName) {
-		c.Build(http.StatusBadRequest, "group parameter does not match valid group name rules", nil)
-		return nil
-	} else if raw, err := c.RequestBodyAsString(); err != nil {
-		c.BuildError(http.StatusBadRequest, err, nil)
-		return nil
-	} else if regexp.MustCompile(`\A\s*\z`).MatchString(raw) {
-		c.Build(http.StatusBadRequest, "empty auth, need at least one", nil)
-		return nil
-	} else {
-		body = []byte(raw)
-	}
+// upsertUserInGroup sets roles of an user within a group, if current user has sufficient access
+func upsertUserInGroup(c *engines.HandlerContext, membership groupMembership) (engines.NoContent, error) {
+	var result engines.NoContent
+	login := c.GetLogin()
 
-	var values []any
+	// null values are accepted and ignored
 	var request []dto.GrantRole
-	if err := json.Unmarshal(body, &values); err != nil {
-		unmarshallError := errors.Join(errors.New("error when unmarshalling: "+string(body)), err)
-		c.BuildError(http.StatusBadRequest, unmarshallError, nil)
-		return nil
-	} else {
-		for _, val := range values {
-			if val == nil {
-				continue
-			} else if r, ok := val.(string); !ok {
-				c.Build(http.StatusBadRequest, "cannot read roles", nil)
-				return nil
-			} else if role, err := dto.ParseGrantRole(r); err != nil {
-				c.Build(http.StatusBadRequest, "cannot read roles", nil)
-				return nil
-			} else {
-				request = append(request, role)
-			}
+	for _, value := range membership.Roles {
+		if value == "" {
+			continue
+		} else if role, err := dto.ParseGrantRole(value); err != nil {
+			return result, engines.NewApiError(http.StatusBadRequest, engines.ErrorCodeBadRequest, "cannot read roles")
+		} else {
+			request = append(request, role)
 		}
 	}
 
 	// Now, ensure that roles match and insert
 	globalRoles := c.GetRoles()
-	localRoles, errLoad := c.Dao.GetGroupAuthForUser(c.GetCurrentContext(), login, groupName)
-	if errLoad != nil {
-		c.BuildError(http.StatusInternalServerError, errLoad, nil)
-		return nil
-	} else if len(request) == 0 {
-		c.Build(http.StatusBadRequest, "empty auth, need at least one", nil)
-		return nil
+	if len(request) == 0 {
+		return result, engines.NewApiError(http.StatusBadRequest, engines.ErrorCodeBadRequest, "empty auth, need at least one")
+	} else if localRoles, err := c.Dao.GetGroupAuthForUser(c.GetCurrentContext(), login, membership.GroupName); err != nil {
+		return result, err
 	} else if !HasMinimumAccessAuth(globalRoles, localRoles, request) {
-		c.Build(http.StatusUnauthorized, "insufficient privilege for user "+userName, nil)
-		return nil
-	} else if err := c.Dao.SetGroupAuthForUser(c.GetCurrentContext(), login, userName, groupName, request); err != nil {
-		c.BuildError(http.StatusInternalServerError, err, nil)
-		return nil
+		return result, engines.NewApiError(http.StatusUnauthorized, engines.ErrorCodeUnauthorized, "insufficient privilege for user "+membership.UserName)
+	} else if err := c.Dao.SetGroupAuthForUser(c.GetCurrentContext(), login, membership.UserName, membership.GroupName, request); err != nil {
+		return result, err
 	}
 
 	var paramRoles []string
@@ -138,9 +101,8 @@ func endpointUpsertUserInGroup(c *engines.HandlerContext) error {
 		paramRoles = append(paramRoles, string(role))
 	}
 
-	c.Dao.LogEvent(c.GetCurrentContext(), login, "groups", fmt.Sprintf("user %s upserts user %s within group %s", login, userName, groupName), paramRoles)
-	c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
-	return nil
+	c.Dao.LogEvent(c.GetCurrentContext(), login, "groups", fmt.Sprintf("user %s upserts user %s within group %s", login, membership.UserName, membership.GroupName), paramRoles)
+	return result, nil
 }
 
 // endpointRevokeUserInGroup revokes a given user within a group
@@ -151,10 +113,10 @@ func endpointRevokeUserInGroup(c *engines.HandlerContext) error {
 	login := c.GetLogin()
 
 	if !engines.ValidateUsernameFormat(userName) {
-		c.Build(http.StatusBadRequest, "invalid user format", nil)
+		c.BuildErrorMessage(http.StatusBadRequest, "invalid user format", nil)
 		return nil
 	} else if !ValidateGroupNameFormat(groupName) {
-		c.Build(http.StatusBadRequest, "invalid group format", nil)
+		c.BuildErrorMessage(http.StatusBadRequest, "invalid group format", nil)
 		return nil
 	}
 
@@ -165,10 +127,10 @@ func endpointRevokeUserInGroup(c *engines.HandlerContext) error {
 		c.BuildError(http.StatusInternalServerError, errLoad, nil)
 		return nil
 	} else if !HasMinimumAccessAuth(globalRoles, localRoles, expectedRoles) {
-		c.Build(http.StatusUnauthorized, "insufficient privileges to revoke user", nil)
+		c.BuildErrorMessage(http.StatusUnauthorized, "insufficient privileges to revoke user", nil)
 		return nil
 	} else if err := c.Dao.RevokeUserInGroup(c.GetCurrentContext(), userName, groupName); err != nil {
-		c.BuildError(http.StatusInternalServerError, errLoad, nil)
+		c.BuildError(http.StatusInternalServerError, err, nil)
 		return nil
 	}
 
@@ -182,10 +144,10 @@ func endpointRevokeUserInGroup(c *engines.HandlerContext) error {
 func endpointDeleteGroup(c *engines.HandlerContext) error {
 	name := c.GetQueryParameters()["groupName"]
 	if name == "" {
-		c.Build(http.StatusInternalServerError, "missing group parameter", nil)
+		c.BuildErrorMessage(http.StatusInternalServerError, "missing group parameter", nil)
 		return nil
 	} else if !ValidateGroupNameFormat(name) {
-		c.Build(http.StatusBadRequest, "group parameter does not match valid group name rules", nil)
+		c.BuildErrorMessage(http.StatusBadRequest, "group parameter does not match valid group name rules", nil)
 		return nil
 	}
 
@@ -196,16 +158,16 @@ func endpointDeleteGroup(c *engines.HandlerContext) error {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 		return nil
 	} else if !HasMinimumAccessAuth(c.GetRoles(), localRoles, mandatoryRoles) {
-		c.Build(http.StatusUnauthorized, "insufficient role or group auth", nil)
+		c.BuildErrorMessage(http.StatusUnauthorized, "insufficient role or group auth", nil)
 		return nil
 	}
 
-	if err := c.Dao.DeleteUsersGroup(context.Background(), name); err != nil {
+	if err := c.Dao.DeleteUsersGroup(c.GetCurrentContext(), name); err != nil {
 		c.BuildError(http.StatusInternalServerError, err, nil)
 		return nil
 	} else {
 		login := c.GetLogin()
-		c.Dao.LogEvent(context.Background(), login, "groups", fmt.Sprintf("user %s deletes group %s", login, name), nil)
+		c.Dao.LogEvent(c.GetCurrentContext(), login, "groups", fmt.Sprintf("user %s deletes group %s", login, name), nil)
 		c.Build(http.StatusOK, "", c.RequestHeaderByNames("Authorization"))
 		return nil
 	}
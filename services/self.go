@@ -9,7 +9,7 @@ import (
 // endpointUserInformation returns user name for that user
 func endpointUserInformation(c *engines.HandlerContext) error {
 	if value := c.GetLogin(); value == "" {
-		c.Build(http.StatusInternalServerError, "no user found", nil)
+		c.BuildErrorMessage(http.StatusInternalServerError, "no user found", nil)
 	} else {
 		c.Build(http.StatusOK, value, c.RequestHeaderByNames("Authorization"))
 	}
@@ -1,10 +1,13 @@
 package services
 
 import (
+	"log"
 	"net/http"
 	"time"
 
+	"github.com/zefrenchwan/scrutateur.git/dto"
 	"github.com/zefrenchwan/scrutateur.git/engines"
+	"github.com/zefrenchwan/scrutateur.git/mails"
 	"github.com/zefrenchwan/scrutateur.git/storage"
 )
 
@@ -14,16 +17,64 @@ const LOCAL_RESOURCES_PATH = "/app/static/"
 // EXTERNAL_API_PREFIX is the URL prefix to get a given resource
 const EXTERNAL_API_PREFIX = "/app/static"
 
+// DEFAULT_ROUTE_TIMEOUT is the maximum processing time for a request to login or to a protected page
+const DEFAULT_ROUTE_TIMEOUT = 10 * time.Second
+
+// AUDIT_ROUTE_TIMEOUT is the maximum processing time to load audit logs (may be huge)
+const AUDIT_ROUTE_TIMEOUT = 30 * time.Second
+
+// API_TITLE is the title of the generated OpenAPI document
+const API_TITLE = "scrutateur"
+
+// API_VERSION is the version of the api, as in the changelog
+const API_VERSION = "0.1.0"
+
 // Init is the place to add all links endpoint -> handlers
-func Init(dao storage.Dao, secret string, tokenDuration time.Duration) engines.ProcessingEngine {
-	server := engines.NewProcessingEngine(dao)
+func Init(dao storage.Dao, logger *log.Logger, tokens *engines.TokenIssuer, mailer mails.Mailer) *engines.ProcessingEngine {
+	server := engines.NewProcessingEngine(dao, logger)
 
 	// technical endpoint to prove app is up
-	server.AddProcessors("GET", "/status", func(context *engines.HandlerContext) error { context.Build(http.StatusOK, "", nil); return nil })
+	server.AddProcessors("GET", "/status", func(context *engines.HandlerContext) error { context.Build(http.StatusOK, "", nil); return nil }).
+		Describe("Empty answer if server is up")
+
+	// generated documentation of all the routes
+	server.AddProcessors("GET", "/openapi.json", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), server.OpenAPIHandler(API_TITLE, API_VERSION)).
+		Describe("OpenAPI document of the server")
+
+	// public keys to verify tokens, for other services
+	server.AddProcessors("GET", "/.well-known/jwks.json", engines.BuildJWKSHandler(tokens.Keys())).
+		Describe("Public keys to verify access tokens (JWKS)").
+		Returns(engines.JSONWebKeySet{})
 
 	// login is the connection handler
-	loginHandler := engines.BuildLoginHandler(secret, tokenDuration)
-	server.AddProcessors("POST", "/login", loginHandler)
+	loginHandler := engines.BuildLoginHandler(tokens, engines.DefaultLoginThrottle())
+	server.AddProcessors("POST", "/login", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), loginHandler).
+		Describe("Validates name and password, and returns an access token (also in the Authorization header) and a refresh token, or a MFA challenge").
+		Accepts(engines.UserInformation{}).
+		Returns(engines.TokenPair{})
+	// second step of login for users with a second factor
+	server.AddProcessors("POST", "/login/mfa", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), engines.BuildMFALoginHandler(tokens, engines.DefaultLoginThrottle())).
+		Describe("Exchanges the challenge token of a login and a TOTP (or recovery) code for an access token and a refresh token").
+		Accepts(engines.MFAVerification{}).
+		Returns(engines.TokenPair{})
+	// refresh token is the credential, no access token needed
+	server.AddProcessors("POST", "/token/refresh", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), engines.BuildRefreshHandler(tokens)).
+		Describe("Exchanges a refresh token (used once) for a new access token and refresh token").
+		Accepts(engines.RefreshRequest{}).
+		Returns(engines.TokenPair{})
+
+	// service accounts get access tokens with client credentials (OAuth2), no password
+	server.AddProcessors("POST", "/oauth/token", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), engines.BuildClientCredentialsHandler(tokens, engines.DefaultLoginThrottle(), API_TITLE)).
+		Describe("OAuth2 client_credentials grant for service accounts (form body), with a client secret or a signed JWT assertion").
+		Returns(engines.ServiceToken{})
+
+	// forgotten passwords: reset token is sent by mail, response does not tell if user exists
+	server.AddProcessors("POST", "/password/forgot", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), engines.BuildForgotPasswordHandler(mailer, engines.DEFAULT_RESET_DURATION, engines.DefaultLoginThrottle())).
+		Describe("Sends a password reset token to the email of the user, if any (same response for unknown users)").
+		Accepts(engines.ForgotPasswordRequest{})
+	server.AddProcessors("POST", "/password/reset", engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT), engines.BuildResetPasswordHandler(tokens)).
+		Describe("Changes the password of the user of a reset token (used once), and revokes all the sessions of that user").
+		Accepts(engines.ResetPasswordRequest{})
 
 	//////////////////////////////////
 	// STATIC UNPROTECTED RESOURCES //
@@ -34,44 +85,166 @@ func Init(dao storage.Dao, secret string, tokenDuration time.Duration) engines.P
 	}
 
 	for url, path := range mapping {
-		server.AddProcessors("GET", url, engines.BuildStaticHandlerForLocalResource(url, path))
+		server.AddProcessors("GET", url, engines.BuildStaticHandlerForLocalResource(url, path)).
+			Describe("Static resource")
 	}
 
 	/////////////////////
 	// PROTECTED PAGES //
 	/////////////////////
-	connectionMiddleware := engines.AuthenticationMiddleware(secret, tokenDuration)
+	connectionMiddleware := engines.AuthenticationMiddleware(tokens)
+	// cancel storage calls that last too long
+	timeoutMiddleware := engines.TimeoutMiddleware(DEFAULT_ROUTE_TIMEOUT)
+
+	// any authenticated user may logout, no role needed
+	authenticated := server.Group("", timeoutMiddleware, connectionMiddleware)
+	authenticated.AddProcessors("POST", "/logout", engines.BuildLogoutHandler()).
+		Describe("Revokes current access token, and the refresh token in the body if any").
+		Accepts(engines.LogoutRequest{})
+	authenticated.AddProcessors("POST", "/logout/all", engines.BuildLogoutAllHandler(tokens)).
+		Describe("Revokes all the tokens of current user, on any device")
 
 	// PAGES FOR AT LEAST A ROLE
 	roleValidationMiddleware := engines.RolesBasedMiddleware()
 
+	// any protected page needs a valid user with roles for that page
+	protected := server.Group("", timeoutMiddleware, connectionMiddleware, roleValidationMiddleware).Protected()
+
 	//////////////////////////////////////////////////////////////////////////////
 	// GROUP SELF: USERS GET THEIR OWN INFORMATION OR CHANGE THEIR OWN PASSWORD //
 	//////////////////////////////////////////////////////////////////////////////
-	server.AddProcessors("GET", "/self/user/whoami", connectionMiddleware, roleValidationMiddleware, endpointUserInformation)
-	server.AddProcessors("POST", "/self/user/password", connectionMiddleware, roleValidationMiddleware, engines.EndpointChangePassword)
-	server.AddProcessors("GET", "/self/groups/list", connectionMiddleware, roleValidationMiddleware, endpointListGroupsForUser)
+	self := protected.Group("/self")
+	self.AddProcessors("GET", "/user/whoami", endpointUserInformation).
+		Describe("Name of current user").
+		Returns("")
+	self.AddProcessors("POST", "/user/password", engines.EndpointChangePassword).
+		Describe("Changes password of current user (body is the new password)").
+		Accepts("")
+	self.AddProcessors("PUT", "/user/email", engines.EndpointSetUserEmail).
+		Describe("Sets the email of current user, to receive password reset tokens").
+		Accepts(engines.UserEmail{})
+	self.AddProcessors("GET", "/groups/list", endpointListGroupsForUser).
+		Describe("Groups of current user, and user's roles per group").
+		Returns(map[string][]dto.GrantRole{})
+	self.AddProcessors("POST", "/mfa/enroll", engines.BuildMFAEnrollHandler(API_TITLE)).
+		Describe("Creates a new TOTP secret for current user, enabled once activated").
+		Returns(engines.MFAEnrollment{})
+	self.AddProcessors("POST", "/mfa/activate", engines.EndpointMFAActivate).
+		Describe("Enables the TOTP secret given a valid code, and returns recovery codes (displayed once)").
+		Accepts(engines.MFACode{}).
+		Returns(engines.RecoveryCodes{})
+	self.AddProcessors("POST", "/mfa/disable", engines.EndpointMFADisable).
+		Describe("Removes the second factor of current user given a valid TOTP or recovery code").
+		Accepts(engines.MFACode{})
+	self.AddProcessors("POST", "/tokens/create", engines.EndpointCreateAccessToken).
+		Describe("Creates a personal access token with a subset of current user's roles (token is displayed once)").
+		Accepts(engines.AccessTokenCreation{}).
+		Returns(engines.AccessTokenCreated{})
+	self.AddProcessors("GET", "/tokens/list", engines.EndpointListAccessTokens).
+		Describe("Personal access tokens of current user, with their roles and last use").
+		Returns([]dto.AccessToken{})
+	self.AddProcessors("DELETE", "/tokens/{tokenId}/revoke", engines.EndpointRevokeAccessToken).
+		Describe("Revokes a personal access token of current user")
 
 	/////////////////////////////////////////////////////////////
 	// GROUP AUDIT: PRINT ACTIONS FOR SPECIAL USERS TO ANALYZE //
 	/////////////////////////////////////////////////////////////
-	server.AddProcessors("GET", "/audits/display", connectionMiddleware, roleValidationMiddleware, engines.EndpointRootAuditLogs)
+	audits := protected.Group("/audits")
+	audits.AddProcessors("GET", "/display", engines.TimeoutMiddleware(AUDIT_ROUTE_TIMEOUT), engines.EndpointRootAuditLogs).
+		Describe("Audit logs between two dates (YYYYMMDD)").
+		Accepts(engines.AuditPeriod{}).
+		Returns([]dto.AuditEntryLog{})
 
 	/////////////////////////////////////////////
 	// GROUP MANAGEMENT: DEAL WITH USER ACCESS //
 	/////////////////////////////////////////////
-	server.AddProcessors("POST", "/manage/user/create", connectionMiddleware, roleValidationMiddleware, engines.EndpointAdminCreateUser)
-	server.AddProcessors("DELETE", "/manage/user/{username}/delete", connectionMiddleware, roleValidationMiddleware, engines.EndpointRootDeleteUser)
-	server.AddProcessors("GET", "/manage/user/{username}/access/list", connectionMiddleware, roleValidationMiddleware, engines.EndpointAdminListUserRoles)
-	server.AddProcessors("PUT", "/manage/user/{username}/access/edit", connectionMiddleware, roleValidationMiddleware, engines.EndpointAdminEditUserRoles)
+	management := protected.Group("/manage")
+	management.AddProcessors("POST", "/user/create", engines.EndpointAdminCreateUser).
+		Describe("Creates an user with no role").
+		Accepts(engines.UserInformation{})
+	management.AddProcessors("DELETE", "/user/{username}/delete", engines.EndpointRootDeleteUser).
+		Describe("Deletes an user (not current user)")
+	management.AddProcessors("GET", "/user/{username}/access/list", engines.EndpointAdminListUserRoles).
+		Describe("Roles of an user, per feature").
+		Returns(map[string][]dto.GrantRole{})
+	management.AddProcessors("PUT", "/user/{username}/access/edit", engines.EndpointAdminEditUserRoles).
+		Describe("Sets roles of an user, per feature (empty roles remove access)").
+		Accepts(engines.UserRolesEdition{})
+	management.AddProcessors("POST", "/user/{username}/unlock", engines.EndpointAdminUnlockUser).
+		Describe("Clears failed logins of an user, locked or not")
+	management.AddProcessors("POST", "/service-accounts/create", engines.EndpointCreateServiceAccount).
+		Describe("Creates a service account with no credential and no role").
+		Accepts(engines.ServiceAccountCreation{})
+	management.AddProcessors("GET", "/service-accounts/list", engines.EndpointListServiceAccounts).
+		Describe("Service accounts and their credentials (no secret)").
+		Returns([]dto.ServiceAccount{})
+	management.AddProcessors("DELETE", "/service-accounts/{name}/delete", engines.EndpointDeleteServiceAccount).
+		Describe("Deletes a service account")
+	management.AddProcessors("PUT", "/service-accounts/{name}/access/edit", engines.EndpointEditServiceAccountRoles).
+		Describe("Sets roles of a service account, per feature (empty roles remove access)").
+		Accepts(engines.ServiceAccountRolesEdition{})
+	management.AddProcessors("POST", "/service-accounts/{name}/secrets/create", engines.EndpointCreateServiceSecret).
+		Describe("Creates a client secret for a service account (secret is displayed once)").
+		Accepts(engines.ServiceSecretCreation{}).
+		Returns(engines.ServiceSecretCreated{})
+	management.AddProcessors("POST", "/service-accounts/{name}/keys/add", engines.EndpointAddServiceKey).
+		Describe("Adds a public key (PEM) to verify assertions signed by a service account").
+		Accepts(engines.ServiceKeyAddition{}).
+		Returns(engines.ServiceKeyAdded{})
+	management.AddProcessors("DELETE", "/service-accounts/{name}/credentials/{credentialId}/revoke", engines.EndpointRevokeServiceCredential).
+		Describe("Revokes a secret or a key of a service account")
+	management.AddProcessors("GET", "/roles/list", engines.EndpointListRoles).
+		Describe("Roles, and the roles each one implies").
+		Returns([]dto.Role{})
+	management.AddProcessors("PUT", "/roles/{name}/upsert", engines.EndpointUpsertRole).
+		Describe("Creates or changes a role (not a built-in one)").
+		Accepts(engines.RoleEdition{})
+	management.AddProcessors("DELETE", "/roles/{name}/delete", engines.EndpointDeleteRole).
+		Describe("Deletes a role (not a built-in one) no resource and no user uses")
+	management.AddProcessors("GET", "/resources/list", engines.EndpointListResources).
+		Describe("Protected resources, with their feature and the roles they apply to").
+		Returns([]dto.Resource{})
+	management.AddProcessors("POST", "/resources/create", server.CreateResourceHandler()).
+		Describe("Creates a resource in a feature, template should match a protected route").
+		Accepts(engines.ResourceEdition{}).
+		Returns(engines.ResourceCreated{})
+	management.AddProcessors("PUT", "/resources/{resourceId}/update", server.UpdateResourceHandler()).
+		Describe("Changes a resource, template should match a protected route").
+		Accepts(engines.ResourceEdition{})
+	management.AddProcessors("DELETE", "/resources/{resourceId}/delete", engines.EndpointDeleteResource).
+		Describe("Deletes a resource")
+	management.AddProcessors("GET", "/resources/reconcile", server.ReconciliationHandler()).
+		Describe("Compares protected routes with resources: unprotected routes, orphan resources and overlaps").
+		Returns(engines.ReconciliationReport{})
+	management.AddProcessors("GET", "/features/list", engines.EndpointListFeatures).
+		Describe("Features, and their number of resources").
+		Returns([]dto.Feature{})
+	management.AddProcessors("PUT", "/features/{feature}/upsert", engines.EndpointUpsertFeature).
+		Describe("Creates or changes a feature, MFA policy applies to its resources").
+		Accepts(engines.FeatureEdition{})
+	management.AddProcessors("DELETE", "/features/{feature}/delete", engines.EndpointDeleteFeature).
+		Describe("Deletes a feature with no resource, and the grants on it")
+	management.AddProcessors("GET", "/authz/explain", engines.EndpointExplainAccess).
+		Describe("Explains the access decision for an user, an http method and a path: each resource, and the final decision").
+		Accepts(engines.AccessQuestion{}).
+		Returns(engines.AccessExplanation{})
+	management.AddProcessors("POST", "/keys/rotate", engines.BuildRotateKeysHandler(tokens.Keys())).
+		Describe("Creates a new key to sign tokens, previous keys still verify tokens").
+		Returns(engines.KeyRotation{})
 
 	/////////////////////////////////////////////////////////////////////////////
 	// GROUP "GROUPS": DEAL WITH GROUP OF USERS AS IN USERS WANTING TO REGROUP //
 	/////////////////////////////////////////////////////////////////////////////
-	server.AddProcessors("POST", "/groups/create/{groupName}", connectionMiddleware, roleValidationMiddleware, endpointCreateGroup)
-	server.AddProcessors("PUT", "/groups/{groupName}/upsert/user/{userName}", connectionMiddleware, roleValidationMiddleware, endpointUpsertUserInGroup)
-	server.AddProcessors("DELETE", "/groups/{groupName}/revoke/user/{userName}", connectionMiddleware, roleValidationMiddleware, endpointRevokeUserInGroup)
-	server.AddProcessors("DELETE", "/groups/delete/{groupName}", connectionMiddleware, roleValidationMiddleware, endpointDeleteGroup)
+	groups := protected.Group("/groups")
+	groups.AddProcessors("POST", "/create/{groupName}", endpointCreateGroup).
+		Describe("Creates a group, current user being in it")
+	groups.AddProcessors("PUT", "/{groupName}/upsert/user/{userName}", endpointUpsertUserInGroup).
+		Describe("Adds an user in a group, or changes user's roles in that group").
+		Accepts(groupMembership{})
+	groups.AddProcessors("DELETE", "/{groupName}/revoke/user/{userName}", endpointRevokeUserInGroup).
+		Describe("Removes an user from a group")
+	groups.AddProcessors("DELETE", "/delete/{groupName}", endpointDeleteGroup).
+		Describe("Deletes a group")
 
 	////////////////////////////////
 	// END OF HANDLER DEFINITIONS //
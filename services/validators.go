@@ -1,6 +1,15 @@
 package services
 
-import "regexp"
+import (
+	"regexp"
+
+	"github.com/zefrenchwan/scrutateur.git/engines"
+)
+
+// register validators for request bindings (see engines.JSON)
+func init() {
+	engines.RegisterValidator("group", ValidateGroupNameFormat)
+}
 
 // ValidateGroupNameFormat tests if group format is valid or not
 func ValidateGroupNameFormat(groupName string) bool {
@@ -101,7 +101,7 @@ where GRO.user_roles && RAU.expected_roles;
 -- ROLES DEFINITION: needs code refactoring if changed --
 ---------------------------------------------------------
 
--- add roles (constants, needs code refactoring for a change)
+-- add built-in roles (used in code, other roles and the hierarchy are defined in 19_roles.sql)
 insert into auth.roles(role_name, role_description) values ('root','allows any action with grant actions too');
 insert into auth.roles(role_name, role_description) values ('admin','allows any action but cannot grant');
 insert into auth.roles(role_name, role_description) values ('editor','crud operations are allowed');
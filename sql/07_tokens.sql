@@ -0,0 +1,52 @@
+-- auth.refresh_tokens are the refresh tokens of users. 
+-- Tokens are opaque random values, only their hash is stored
+create table auth.refresh_tokens (
+    token_hash bytea primary key,
+    user_id int not null references auth.users(user_id) on delete cascade,
+    created_at timestamp with time zone default now(),
+    expires_at timestamp with time zone not null
+);
+
+-- auth.add_refresh_token stores the hash of a refresh token for that user, valid until expiration
+create or replace procedure auth.add_refresh_token(p_login text, p_hash bytea, p_expiration timestamp with time zone) language plpgsql as $$
+declare 
+    l_user_id int;
+begin 
+    select user_id into l_user_id from auth.users where user_login = p_login;
+    if l_user_id is null then 
+        raise exception 'no user matching %', p_login;
+    end if;
+
+    -- clean expired tokens of that user
+    delete from auth.refresh_tokens where user_id = l_user_id and expires_at < now();
+    insert into auth.refresh_tokens(token_hash, user_id, expires_at) values (p_hash, l_user_id, p_expiration);
+end;$$;
+
+-- auth.consume_refresh_token deletes a refresh token and returns the login of its user, null if token is unknown or expired.
+-- A refresh token is then used only once
+create or replace function auth.consume_refresh_token(p_hash bytea) returns text language plpgsql as $$
+declare 
+    l_user_id int;
+    l_expiration timestamp with time zone;
+    l_login text;
+begin 
+    delete from auth.refresh_tokens where token_hash = p_hash returning user_id, expires_at into l_user_id, l_expiration;
+    if l_user_id is null or l_expiration < now() then 
+        return null;
+    end if;
+
+    select user_login into l_login from auth.users where user_id = l_user_id;
+    return l_login;
+end;$$;
+
+-- auth.delete_refresh_token deletes a refresh token, if any
+create or replace procedure auth.delete_refresh_token(p_hash bytea) language plpgsql as $$
+begin 
+    delete from auth.refresh_tokens where token_hash = p_hash;
+end;$$;
+
+-- auth.delete_user_refresh_tokens deletes all the refresh tokens of an user
+create or replace procedure auth.delete_user_refresh_tokens(p_login text) language plpgsql as $$
+begin 
+    delete from auth.refresh_tokens where user_id in (select user_id from auth.users where user_login = p_login);
+end;$$;
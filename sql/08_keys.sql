@@ -0,0 +1,22 @@
+-- auth.signing_keys are the keys to sign tokens. Most recent key signs, others only verify.
+-- Material is secret (raw secret or private key), protect database access accordingly
+create table auth.signing_keys (
+    key_id text primary key,
+    algorithm text not null check(algorithm = ANY('{HS256,RS256,EdDSA}'::text[])),
+    key_material bytea not null,
+    created_at timestamp with time zone default now()
+);
+
+-- auth.add_signing_key adds a key that becomes the current one, and keeps only the p_keep most recent keys
+create or replace procedure auth.add_signing_key(p_key_id text, p_algorithm text, p_material bytea, p_keep int) language plpgsql as $$
+begin 
+    insert into auth.signing_keys(key_id, algorithm, key_material) values (p_key_id, p_algorithm, p_material);
+
+    delete from auth.signing_keys 
+    where key_id not in (
+        select key_id from auth.signing_keys order by created_at desc limit greatest(p_keep, 1)
+    );
+end;$$;
+
+-- key rotation is a management operation for root only
+call auth.add_resource(ARRAY['root']::text[],'EQUALS','/manage/keys/rotate','management');
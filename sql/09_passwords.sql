@@ -0,0 +1,25 @@
+-- Passwords are hashed by the application (argon2id or bcrypt, PHC string format) and stored as is.
+-- Legacy hashes (unsalted sha256, see auth.upsert_user_auth) are replaced on next successful login
+
+-- auth.get_user_password_hash returns the stored hash of an user password, null if no such user
+create or replace function auth.get_user_password_hash(p_login text) returns bytea language plpgsql as $$
+declare 
+    l_hash bytea;
+begin 
+    select user_hash_password into l_hash from auth.users where user_login = p_login;
+    return l_hash;
+end;$$;
+
+-- auth.upsert_user_hash upserts an user with that password hash
+create or replace procedure auth.upsert_user_hash(p_login text, p_hash text) language plpgsql as $$
+begin 
+    insert into auth.users(user_login, user_hash_password) values (p_login, convert_to(p_hash, 'UTF8')) 
+    on conflict (user_login) do update set user_hash_password = convert_to(p_hash, 'UTF8');
+end;$$;
+
+-- auth.replace_user_hash replaces an user password hash, if it did not change since it was read
+create or replace procedure auth.replace_user_hash(p_login text, p_previous bytea, p_hash text) language plpgsql as $$
+begin 
+    update auth.users set user_hash_password = convert_to(p_hash, 'UTF8') 
+    where user_login = p_login and user_hash_password = p_previous;
+end;$$;
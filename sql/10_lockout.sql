@@ -0,0 +1,2 @@
+-- unlock an user after too many failed logins (failures are counted in the cache, not in database)
+call auth.add_resource(ARRAY['admin','root']::text[],'MATCHES','/manage/user/*/unlock','management');
@@ -0,0 +1,159 @@
+-- auth.mfa contains the TOTP secrets of users (RFC 6238). 
+-- A secret is pending until user proves it works with a first code, then it is enabled
+create table auth.mfa (
+    user_id int primary key references auth.users(user_id) on delete cascade,
+    totp_secret text not null,
+    enabled boolean not null default false,
+    created_at timestamp with time zone default now()
+);
+
+-- auth.recovery_codes are single use codes to use instead of a TOTP code (only hashes are stored)
+create table auth.recovery_codes (
+    user_id int not null references auth.users(user_id) on delete cascade,
+    code_hash bytea not null,
+    primary key (user_id, code_hash)
+);
+
+-- refresh tokens remember if session was opened with a second factor
+alter table auth.refresh_tokens add column mfa boolean not null default false;
+
+-- resources may require a second factor (policy is set per feature, see auth.set_feature_mfa)
+alter table auth.resources add column requires_mfa boolean not null default false;
+
+-- auth.set_feature_mfa sets the MFA policy of all the resources of a feature
+create or replace procedure auth.set_feature_mfa(p_feature text, p_required boolean) language plpgsql as $$
+begin 
+    update auth.resources set requires_mfa = p_required where feature_name = p_feature;
+end;$$;
+
+-- auth.v_granted_resources gets login of user, resource operator, template, roles the user has on this resource and MFA policy 
+create or replace view auth.v_granted_resources as
+with granted_roles as (
+    select USR.user_id, GRA.feature_name, array_agg(distinct ROL.role_name::text) as user_roles
+    from auth.users USR 
+    join auth.grants GRA on GRA.user_id = USR.user_id 
+    join auth.roles ROL on ROL.role_id = GRA.role_id  
+    group by USR.user_id, GRA.feature_name
+), resources_auths as (
+    select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+    from auth.authorizations AUT 
+    join auth.resources RES on RES.resource_id = AUT.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id 
+    group by AUT.resource_id, RES.feature_name
+)
+select distinct USR.user_login, RES.operator, RES.template_url, auth.array_intersection(GRO.user_roles, RAU.expected_roles) as roles, RES.requires_mfa
+from auth.users USR 
+join granted_roles GRO on GRO.user_id = USR.user_id 
+join resources_auths RAU on RAU.feature_name = GRO.feature_name 
+join auth.resources RES on RES.resource_id = RAU.resource_id
+where GRO.user_roles && RAU.expected_roles;
+
+-- auth.get_grants_for_user returns the grants of an user, and if resource requires MFA
+drop function auth.get_grants_for_user(text);
+create function auth.get_grants_for_user(p_user text) returns table(operator text, template_url text, roles text[], requires_mfa boolean) language plpgsql as $$
+declare 
+begin 
+    return query
+        select distinct VGR.operator, VGR.template_url, VGR.roles, VGR.requires_mfa
+        from auth.v_granted_resources VGR
+        where VGR.user_login = p_user ;
+end;$$;
+
+-- auth.add_refresh_token stores the hash of a refresh token for that user, valid until expiration, opened with MFA or not
+create or replace procedure auth.add_refresh_token(p_login text, p_hash bytea, p_expiration timestamp with time zone, p_mfa boolean) language plpgsql as $$
+declare 
+    l_user_id int;
+begin 
+    select user_id into l_user_id from auth.users where user_login = p_login;
+    if l_user_id is null then 
+        raise exception 'no user matching %', p_login;
+    end if;
+
+    delete from auth.refresh_tokens where user_id = l_user_id and expires_at < now();
+    insert into auth.refresh_tokens(token_hash, user_id, expires_at, mfa) values (p_hash, l_user_id, p_expiration, p_mfa);
+end;$$;
+
+-- auth.consume_refresh_token deletes a refresh token and returns the login of its user (null if token is unknown or expired) and MFA flag
+drop function auth.consume_refresh_token(bytea);
+create function auth.consume_refresh_token(p_hash bytea) returns table(user_login text, mfa boolean) language plpgsql as $$
+declare 
+    l_user_id int;
+    l_expiration timestamp with time zone;
+    l_mfa boolean;
+begin 
+    delete from auth.refresh_tokens RTO where RTO.token_hash = p_hash returning RTO.user_id, RTO.expires_at, RTO.mfa into l_user_id, l_expiration, l_mfa;
+    if l_user_id is null or l_expiration < now() then 
+        return;
+    end if;
+
+    return query select USR.user_login, l_mfa from auth.users USR where USR.user_id = l_user_id;
+end;$$;
+
+-- auth.set_pending_mfa sets a new TOTP secret for an user, not enabled yet. Previous secret and recovery codes are deleted
+create or replace procedure auth.set_pending_mfa(p_login text, p_secret text) language plpgsql as $$
+declare 
+    l_user_id int;
+begin 
+    select user_id into l_user_id from auth.users where user_login = p_login;
+    if l_user_id is null then 
+        raise exception 'no user matching %', p_login;
+    end if;
+
+    delete from auth.recovery_codes where user_id = l_user_id;
+    delete from auth.mfa where user_id = l_user_id;
+    insert into auth.mfa(user_id, totp_secret) values (l_user_id, p_secret);
+end;$$;
+
+-- auth.get_mfa returns the TOTP secret of an user and if it is enabled (no row if none)
+create or replace function auth.get_mfa(p_login text) returns table(totp_secret text, enabled boolean) language plpgsql as $$
+begin 
+    return query 
+        select MFA.totp_secret, MFA.enabled 
+        from auth.mfa MFA 
+        join auth.users USR on USR.user_id = MFA.user_id
+        where USR.user_login = p_login;
+end;$$;
+
+-- auth.enable_mfa enables the pending secret of an user, with those recovery codes hashes
+create or replace procedure auth.enable_mfa(p_login text, p_codes bytea[]) language plpgsql as $$
+declare 
+    l_user_id int;
+    l_code bytea;
+begin 
+    select USR.user_id into l_user_id from auth.users USR join auth.mfa MFA on MFA.user_id = USR.user_id where USR.user_login = p_login;
+    if l_user_id is null then 
+        raise exception 'no user found with pending mfa for %', p_login;
+    end if;
+
+    update auth.mfa set enabled = true where user_id = l_user_id;
+    delete from auth.recovery_codes where user_id = l_user_id;
+    foreach l_code in array p_codes loop 
+        insert into auth.recovery_codes(user_id, code_hash) values (l_user_id, l_code);
+    end loop;
+end;$$;
+
+-- auth.disable_mfa deletes the TOTP secret and recovery codes of an user
+create or replace procedure auth.disable_mfa(p_login text) language plpgsql as $$
+begin 
+    delete from auth.recovery_codes where user_id in (select user_id from auth.users where user_login = p_login);
+    delete from auth.mfa where user_id in (select user_id from auth.users where user_login = p_login);
+end;$$;
+
+-- auth.consume_recovery_code deletes a recovery code of an user, and returns true if there was such code
+create or replace function auth.consume_recovery_code(p_login text, p_hash bytea) returns boolean language plpgsql as $$
+declare 
+    l_counter int;
+begin 
+    delete from auth.recovery_codes 
+    where code_hash = p_hash 
+    and user_id in (select user_id from auth.users where user_login = p_login);
+    get diagnostics l_counter = row_count;
+    return l_counter = 1;
+end;$$;
+
+-- users manage their own second factor
+call auth.add_resource(ARRAY['reader','editor','admin','root']::text[],'STARTS_WITH','/self/mfa/','self');
+
+-- MFA policy: uncomment to require a second factor for those features
+-- call auth.set_feature_mfa('management', true);
+-- call auth.set_feature_mfa('audit', true);
@@ -0,0 +1,59 @@
+-- users may set an email, to receive password reset tokens
+alter table auth.users add column user_email text;
+
+-- auth.password_resets are the pending password reset tokens of users.
+-- Tokens are opaque random values, only their hash is stored
+create table auth.password_resets (
+    token_hash bytea primary key,
+    user_id int not null references auth.users(user_id) on delete cascade,
+    created_at timestamp with time zone default now(),
+    expires_at timestamp with time zone not null
+);
+
+-- auth.set_user_email sets the email of an user (null to remove it)
+create or replace procedure auth.set_user_email(p_login text, p_email text) language plpgsql as $$
+begin
+    update auth.users set user_email = p_email where user_login = p_login;
+end;$$;
+
+-- auth.get_user_email returns the email of an user, no row if user does not exist or has no email
+create or replace function auth.get_user_email(p_login text) returns table(user_email text) language plpgsql as $$
+begin
+    return query
+        select USR.user_email
+        from auth.users USR
+        where USR.user_login = p_login and USR.user_email is not null;
+end;$$;
+
+-- auth.add_password_reset stores the hash of a reset token for that user, valid until expiration.
+-- Previous reset tokens of that user are deleted: only the last one is valid
+create or replace procedure auth.add_password_reset(p_login text, p_hash bytea, p_expiration timestamp with time zone) language plpgsql as $$
+declare
+    l_user_id int;
+begin
+    select user_id into l_user_id from auth.users where user_login = p_login;
+    if l_user_id is null then
+        raise exception 'no user matching %', p_login;
+    end if;
+
+    delete from auth.password_resets where user_id = l_user_id;
+    insert into auth.password_resets(token_hash, user_id, expires_at) values (p_hash, l_user_id, p_expiration);
+end;$$;
+
+-- auth.consume_password_reset deletes a reset token and returns the login of its user, no row if token is unknown or expired.
+-- A reset token is then used only once
+create or replace function auth.consume_password_reset(p_hash bytea) returns table(user_login text) language plpgsql as $$
+declare
+    l_user_id int;
+    l_expiration timestamp with time zone;
+begin
+    delete from auth.password_resets where token_hash = p_hash returning user_id, expires_at into l_user_id, l_expiration;
+    if l_user_id is null or l_expiration < now() then
+        return;
+    end if;
+
+    return query select USR.user_login from auth.users USR where USR.user_id = l_user_id;
+end;$$;
+
+-- self group: users set their own email
+call auth.add_resource(ARRAY['reader','editor','admin','root']::text[],'EQUALS','/self/user/email','self');
@@ -0,0 +1,115 @@
+-- auth.access_tokens are the personal access tokens of users, for automation.
+-- Tokens are opaque random values, only their hash is stored
+create table auth.access_tokens (
+    token_id text primary key,
+    user_id int not null references auth.users(user_id) on delete cascade,
+    token_name text not null,
+    token_hash bytea unique not null,
+    created_at timestamp with time zone default now(),
+    expires_at timestamp with time zone not null,
+    last_used_at timestamp with time zone,
+    unique (user_id, token_name)
+);
+
+-- auth.access_token_grants are the roles of a token per feature, a subset of the roles of its user
+create table auth.access_token_grants (
+    token_id text not null references auth.access_tokens(token_id) on delete cascade,
+    role_id int not null references auth.roles(role_id),
+    feature_name text not null,
+    primary key (token_id, feature_name, role_id)
+);
+
+-- auth.add_access_token stores the hash of a personal access token for that user, valid until expiration
+create or replace procedure auth.add_access_token(p_login text, p_id text, p_name text, p_hash bytea, p_expiration timestamp with time zone) language plpgsql as $$
+declare
+    l_user_id int;
+begin
+    select user_id into l_user_id from auth.users where user_login = p_login;
+    if l_user_id is null then
+        raise exception 'no user matching %', p_login;
+    end if;
+
+    -- clean expired tokens of that user
+    delete from auth.access_tokens where user_id = l_user_id and expires_at < now();
+    insert into auth.access_tokens(token_id, user_id, token_name, token_hash, expires_at) values (p_id, l_user_id, p_name, p_hash, p_expiration);
+end;$$;
+
+-- auth.add_access_token_grant gives roles on a feature to a token
+create or replace procedure auth.add_access_token_grant(p_id text, p_feature text, p_roles text[]) language plpgsql as $$
+begin
+    insert into auth.access_token_grants(token_id, role_id, feature_name)
+    select p_id, ROL.role_id, p_feature
+    from auth.roles ROL
+    where ROL.role_name = any(p_roles);
+end;$$;
+
+-- auth.use_access_token returns the id and user of a valid token, no row if token is unknown or expired.
+-- Last use is set at most once per minute, to limit writes
+create or replace function auth.use_access_token(p_hash bytea) returns table(token_id text, user_login text) language plpgsql as $$
+begin
+    update auth.access_tokens TOK set last_used_at = now()
+    where TOK.token_hash = p_hash and TOK.expires_at > now()
+    and (TOK.last_used_at is null or TOK.last_used_at < now() - interval '1 minute');
+
+    return query
+        select TOK.token_id, USR.user_login
+        from auth.access_tokens TOK
+        join auth.users USR on USR.user_id = TOK.user_id
+        where TOK.token_hash = p_hash and TOK.expires_at > now();
+end;$$;
+
+-- auth.get_grants_for_access_token returns the grants of a token: roles of the token that its user still has
+create or replace function auth.get_grants_for_access_token(p_id text) returns table(operator text, template_url text, roles text[], requires_mfa boolean) language plpgsql as $$
+begin
+    return query
+        with token_roles as (
+            select ATG.feature_name, array_agg(distinct ROL.role_name::text) as token_roles
+            from auth.access_token_grants ATG
+            join auth.access_tokens TOK on TOK.token_id = ATG.token_id
+            join auth.grants GRA on GRA.user_id = TOK.user_id and GRA.feature_name = ATG.feature_name and GRA.role_id = ATG.role_id
+            join auth.roles ROL on ROL.role_id = ATG.role_id
+            where ATG.token_id = p_id
+            group by ATG.feature_name
+        ), resources_auths as (
+            select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+            from auth.authorizations AUT
+            join auth.resources RES on RES.resource_id = AUT.resource_id
+            join auth.roles ROL on ROL.role_id = AUT.role_id
+            group by AUT.resource_id, RES.feature_name
+        )
+        select distinct RES.operator, RES.template_url, auth.array_intersection(TRO.token_roles, RAU.expected_roles), RES.requires_mfa
+        from token_roles TRO
+        join resources_auths RAU on RAU.feature_name = TRO.feature_name
+        join auth.resources RES on RES.resource_id = RAU.resource_id
+        where TRO.token_roles && RAU.expected_roles;
+end;$$;
+
+-- auth.list_access_tokens returns the tokens of an user, one row per token and feature (null feature for a token with no role)
+create or replace function auth.list_access_tokens(p_login text) returns table(token_id text, token_name text, created_at timestamp with time zone, expires_at timestamp with time zone, last_used_at timestamp with time zone, feature_name text, roles text[]) language plpgsql as $$
+begin
+    return query
+        select TOK.token_id, TOK.token_name, TOK.created_at, TOK.expires_at, TOK.last_used_at, ATG.feature_name,
+        array_remove(array_agg(distinct ROL.role_name::text), null)
+        from auth.access_tokens TOK
+        join auth.users USR on USR.user_id = TOK.user_id
+        left join auth.access_token_grants ATG on ATG.token_id = TOK.token_id
+        left join auth.roles ROL on ROL.role_id = ATG.role_id
+        where USR.user_login = p_login
+        group by TOK.token_id, TOK.token_name, TOK.created_at, TOK.expires_at, TOK.last_used_at, ATG.feature_name
+        order by TOK.created_at, TOK.token_id;
+end;$$;
+
+-- auth.delete_access_token deletes a token of an user, and returns false if user has no such token
+create or replace function auth.delete_access_token(p_login text, p_id text) returns boolean language plpgsql as $$
+declare
+    l_count int;
+begin
+    delete from auth.access_tokens TOK
+    using auth.users USR
+    where USR.user_id = TOK.user_id and USR.user_login = p_login and TOK.token_id = p_id;
+    get diagnostics l_count = row_count;
+    return l_count > 0;
+end;$$;
+
+-- self group: users manage their own tokens
+call auth.add_resource(ARRAY['reader','editor','admin','root']::text[],'STARTS_WITH','/self/tokens/','self');
@@ -0,0 +1,118 @@
+-- users are either humans (login with a password) or service accounts (login with client credentials)
+alter table auth.users add column user_kind text not null default 'human' check (user_kind in ('human','service'));
+
+-- auth.service_credentials are the credentials of service accounts:
+-- hash of a client secret, or public key (DER, PKIX) to verify signed assertions
+create table auth.service_credentials (
+    credential_id text primary key,
+    user_id int not null references auth.users(user_id) on delete cascade,
+    credential_type text not null check (credential_type in ('secret','public_key')),
+    credential bytea not null,
+    created_at timestamp with time zone default now(),
+    expires_at timestamp with time zone
+);
+
+-- auth.get_user_password_hash returns the stored hash of an user password, null if no such user.
+-- Service accounts have no password
+create or replace function auth.get_user_password_hash(p_login text) returns bytea language plpgsql as $$
+declare
+    l_hash bytea;
+begin
+    select user_hash_password into l_hash from auth.users where user_login = p_login and user_kind = 'human';
+    return l_hash;
+end;$$;
+
+-- auth.upsert_user_hash upserts an user with that password hash. Service accounts have no password
+create or replace procedure auth.upsert_user_hash(p_login text, p_hash text) language plpgsql as $$
+begin
+    if exists (select 1 from auth.users where user_login = p_login and user_kind = 'service') then
+        raise exception 'invalid operation: % is a service account', p_login;
+    end if;
+
+    insert into auth.users(user_login, user_hash_password) values (p_login, convert_to(p_hash, 'UTF8'))
+    on conflict (user_login) do update set user_hash_password = convert_to(p_hash, 'UTF8');
+end;$$;
+
+-- auth.get_user_email returns the email of an user, no row if user does not exist or has no email. Service accounts have no email
+create or replace function auth.get_user_email(p_login text) returns table(user_email text) language plpgsql as $$
+begin
+    return query
+        select USR.user_email
+        from auth.users USR
+        where USR.user_login = p_login and USR.user_email is not null and USR.user_kind = 'human';
+end;$$;
+
+-- auth.create_service_account creates a service account with no credential and no role
+create or replace procedure auth.create_service_account(p_name text) language plpgsql as $$
+begin
+    -- empty hash matches no password, and password hash is never read for service accounts anyway
+    insert into auth.users(user_login, user_hash_password, user_kind) values (p_name, ''::bytea, 'service');
+end;$$;
+
+-- auth.delete_service_account deletes a service account, and returns false if there is no such service account
+create or replace function auth.delete_service_account(p_name text) returns boolean language plpgsql as $$
+declare
+    l_user_id int;
+begin
+    select user_id into l_user_id from auth.users where user_login = p_name and user_kind = 'service';
+    if l_user_id is null then
+        return false;
+    end if;
+
+    delete from auth.grants where user_id = l_user_id;
+    delete from auth.users where user_id = l_user_id;
+    return true;
+end;$$;
+
+-- auth.list_service_accounts returns the service accounts, one row per account and credential (null credential for an account with none)
+create or replace function auth.list_service_accounts() returns table(user_login text, credential_id text, credential_type text, created_at timestamp with time zone, expires_at timestamp with time zone) language plpgsql as $$
+begin
+    return query
+        select USR.user_login, SCR.credential_id, SCR.credential_type, SCR.created_at, SCR.expires_at
+        from auth.users USR
+        left join auth.service_credentials SCR on SCR.user_id = USR.user_id
+        where USR.user_kind = 'service'
+        order by USR.user_login, SCR.created_at;
+end;$$;
+
+-- auth.add_service_credential adds a credential to a service account, valid until expiration (null for no expiration)
+create or replace procedure auth.add_service_credential(p_name text, p_id text, p_type text, p_credential bytea, p_expiration timestamp with time zone) language plpgsql as $$
+declare
+    l_user_id int;
+begin
+    select user_id into l_user_id from auth.users where user_login = p_name and user_kind = 'service';
+    if l_user_id is null then
+        raise exception 'no service account matching %', p_name;
+    end if;
+
+    -- clean expired credentials of that account
+    delete from auth.service_credentials where user_id = l_user_id and expires_at < now();
+    insert into auth.service_credentials(credential_id, user_id, credential_type, credential, expires_at)
+    values (p_id, l_user_id, p_type, p_credential, p_expiration);
+end;$$;
+
+-- auth.get_service_credentials returns the valid credentials of a service account, no row for unknown accounts or humans
+create or replace function auth.get_service_credentials(p_name text) returns table(credential_id text, credential_type text, credential bytea, created_at timestamp with time zone, expires_at timestamp with time zone) language plpgsql as $$
+begin
+    return query
+        select SCR.credential_id, SCR.credential_type, SCR.credential, SCR.created_at, SCR.expires_at
+        from auth.service_credentials SCR
+        join auth.users USR on USR.user_id = SCR.user_id
+        where USR.user_login = p_name and USR.user_kind = 'service'
+        and (SCR.expires_at is null or SCR.expires_at > now());
+end;$$;
+
+-- auth.delete_service_credential deletes a credential of a service account, and returns false if there is no such credential
+create or replace function auth.delete_service_credential(p_name text, p_id text) returns boolean language plpgsql as $$
+declare
+    l_count int;
+begin
+    delete from auth.service_credentials SCR
+    using auth.users USR
+    where USR.user_id = SCR.user_id and USR.user_login = p_name and USR.user_kind = 'service' and SCR.credential_id = p_id;
+    get diagnostics l_count = row_count;
+    return l_count > 0;
+end;$$;
+
+-- management group: admins deal with service accounts
+call auth.add_resource(ARRAY['admin','root']::text[],'STARTS_WITH','/manage/service-accounts/','management');
@@ -0,0 +1,44 @@
+-- permissions version of an user changes each time grants of that user change.
+-- Tokens embedding roles carry the version they were built with, and are stale once version changes
+alter table auth.users add column permissions_version bigint not null default 0;
+
+-- auth.bump_permissions_version increments the permissions version of the user of a changed grant
+create or replace function auth.bump_permissions_version() returns trigger language plpgsql as $$
+begin
+    if TG_OP = 'DELETE' then
+        update auth.users set permissions_version = permissions_version + 1 where user_id = old.user_id;
+        return old;
+    end if;
+
+    update auth.users set permissions_version = permissions_version + 1 where user_id = new.user_id;
+    if TG_OP = 'UPDATE' and old.user_id <> new.user_id then
+        update auth.users set permissions_version = permissions_version + 1 where user_id = old.user_id;
+    end if;
+
+    return new;
+end;$$;
+
+create trigger grants_permissions_version after insert or update or delete on auth.grants
+for each row execute function auth.bump_permissions_version();
+
+-- auth.get_permissions_version returns the permissions version of an user, null if no such user
+create or replace function auth.get_permissions_version(p_login text) returns bigint language plpgsql as $$
+declare
+    l_version bigint;
+begin
+    select permissions_version into l_version from auth.users where user_login = p_login;
+    return l_version;
+end;$$;
+
+-- auth.v_resources_authorizations displays, for a resource, its operator, template, group, needed roles and MFA policy
+create or replace view auth.v_resources_authorizations as
+with resources_agg_auth as (
+    select RES.resource_id, array_agg(ROL.role_name) as needed_roles
+    from auth.resources RES
+    join auth.authorizations AUT on AUT.resource_id = RES.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id
+    group by RES.resource_id
+)
+select RES.operator, RES.template_url, RES.feature_name, RAA.needed_roles, RES.requires_mfa
+from auth.resources RES
+join resources_agg_auth RAA on RAA.resource_id = RES.resource_id;
@@ -0,0 +1,25 @@
+-- REGEX resources match urls with a pattern (RE2 syntax, matching the whole url)
+alter table auth.resources drop constraint resources_operator_check;
+alter table auth.resources add constraint resources_operator_check check(operator = ANY('{EQUALS,STARTS_WITH,CONTAINS,MATCHES,REGEX}'::text[]));
+
+-- auth.validate_resource_template rejects REGEX templates that are invalid, too long, or use features RE2 does not have (backreferences, lookarounds)
+create or replace function auth.validate_resource_template() returns trigger language plpgsql as $$
+begin
+    if new.operator <> 'REGEX' then
+        return new;
+    elsif length(new.template_url) > 512 then
+        raise exception 'invalid regex template: longer than 512 characters';
+    elsif new.template_url ~ '\\[1-9]' or new.template_url ~ '\(\?<?[=!]' then
+        raise exception 'invalid regex template: % uses backreferences or lookarounds', new.template_url;
+    end if;
+
+    -- fails if pattern does not compile
+    perform '' ~ new.template_url;
+    return new;
+exception
+    when invalid_regular_expression then
+        raise exception 'invalid regex template: %', new.template_url;
+end;$$;
+
+create trigger resources_template_validation before insert or update on auth.resources
+for each row execute function auth.validate_resource_template();
@@ -0,0 +1,99 @@
+-- resources may apply to some http methods only. No methods (null) means any method, as for existing resources
+alter table auth.resources add column methods text[] check (methods <@ ARRAY['GET','HEAD','POST','PUT','PATCH','DELETE','OPTIONS']::text[]);
+
+-- auth.add_resource adds a resource in a feature for those http methods (null for any), and expicits roles to access it
+create or replace procedure auth.add_resource(p_roles text[], p_operator text, p_template text, p_feature text, p_methods text[]) language plpgsql as $$
+declare 
+    l_role text; 
+    l_role_id int;
+    l_resource_id int;
+begin 
+    insert into auth.resources(operator,template_url,feature_name,methods) values (p_operator, p_template, p_feature, p_methods) returning resource_id into l_resource_id;
+
+    foreach l_role in array p_roles loop 
+        select role_id into l_role_id from auth.roles where role_name = l_role;
+        if l_role_id is null then 
+            raise exception 'no matching role for %', l_role;
+        end if;
+
+        insert into auth.authorizations(resource_id, role_id) values (l_resource_id, l_role_id);
+    end loop;
+end;$$;
+
+-- auth.add_resource adds a resource in a feature for any http method, and expicits roles to access it
+create or replace procedure auth.add_resource(p_roles text[], p_operator text, p_template text, p_feature text) language plpgsql as $$
+begin 
+    call auth.add_resource(p_roles, p_operator, p_template, p_feature, null::text[]);
+end;$$;
+
+-- auth.v_granted_resources gets login of user, resource operator, template, roles the user has on this resource, MFA policy and http methods
+create or replace view auth.v_granted_resources as
+with granted_roles as (
+    select USR.user_id, GRA.feature_name, array_agg(distinct ROL.role_name::text) as user_roles
+    from auth.users USR 
+    join auth.grants GRA on GRA.user_id = USR.user_id 
+    join auth.roles ROL on ROL.role_id = GRA.role_id  
+    group by USR.user_id, GRA.feature_name
+), resources_auths as (
+    select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+    from auth.authorizations AUT 
+    join auth.resources RES on RES.resource_id = AUT.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id 
+    group by AUT.resource_id, RES.feature_name
+)
+select distinct USR.user_login, RES.operator, RES.template_url, auth.array_intersection(GRO.user_roles, RAU.expected_roles) as roles, RES.requires_mfa, RES.methods
+from auth.users USR 
+join granted_roles GRO on GRO.user_id = USR.user_id 
+join resources_auths RAU on RAU.feature_name = GRO.feature_name 
+join auth.resources RES on RES.resource_id = RAU.resource_id
+where GRO.user_roles && RAU.expected_roles;
+
+-- auth.get_grants_for_user returns the grants of an user, if resource requires MFA, and its http methods (null for any)
+drop function auth.get_grants_for_user(text);
+create function auth.get_grants_for_user(p_user text) returns table(operator text, template_url text, roles text[], requires_mfa boolean, methods text[]) language plpgsql as $$
+begin 
+    return query
+        select distinct VGR.operator, VGR.template_url, VGR.roles, VGR.requires_mfa, VGR.methods
+        from auth.v_granted_resources VGR
+        where VGR.user_login = p_user ;
+end;$$;
+
+-- auth.get_grants_for_access_token returns the grants of a token: roles of the token that its user still has
+drop function auth.get_grants_for_access_token(text);
+create function auth.get_grants_for_access_token(p_id text) returns table(operator text, template_url text, roles text[], requires_mfa boolean, methods text[]) language plpgsql as $$
+begin
+    return query
+        with token_roles as (
+            select ATG.feature_name, array_agg(distinct ROL.role_name::text) as token_roles
+            from auth.access_token_grants ATG
+            join auth.access_tokens TOK on TOK.token_id = ATG.token_id
+            join auth.grants GRA on GRA.user_id = TOK.user_id and GRA.feature_name = ATG.feature_name and GRA.role_id = ATG.role_id
+            join auth.roles ROL on ROL.role_id = ATG.role_id
+            where ATG.token_id = p_id
+            group by ATG.feature_name
+        ), resources_auths as (
+            select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+            from auth.authorizations AUT
+            join auth.resources RES on RES.resource_id = AUT.resource_id
+            join auth.roles ROL on ROL.role_id = AUT.role_id
+            group by AUT.resource_id, RES.feature_name
+        )
+        select distinct RES.operator, RES.template_url, auth.array_intersection(TRO.token_roles, RAU.expected_roles), RES.requires_mfa, RES.methods
+        from token_roles TRO
+        join resources_auths RAU on RAU.feature_name = TRO.feature_name
+        join auth.resources RES on RES.resource_id = RAU.resource_id
+        where TRO.token_roles && RAU.expected_roles;
+end;$$;
+
+-- auth.v_resources_authorizations displays, for a resource, its operator, template, group, needed roles, MFA policy and http methods
+create or replace view auth.v_resources_authorizations as
+with resources_agg_auth as (
+    select RES.resource_id, array_agg(ROL.role_name) as needed_roles
+    from auth.resources RES
+    join auth.authorizations AUT on AUT.resource_id = RES.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id
+    group by RES.resource_id
+)
+select RES.operator, RES.template_url, RES.feature_name, RAA.needed_roles, RES.requires_mfa, RES.methods
+from auth.resources RES
+join resources_agg_auth RAA on RAA.resource_id = RES.resource_id;
@@ -0,0 +1,147 @@
+-- roles are defined in database. Built-in roles (root, admin, editor, reader) are used by the application and cannot change.
+-- Roles granting may grant themselves and the roles they imply
+alter table auth.roles add column can_grant boolean not null default false;
+alter table auth.roles add column built_in boolean not null default false;
+update auth.roles set built_in = true where role_name in ('root','admin','editor','reader');
+update auth.roles set can_grant = true where role_name in ('root','admin');
+
+-- auth.role_implications define the roles hierarchy: a role implies other roles (and the roles they imply)
+create table auth.role_implications (
+    role_id int not null references auth.roles(role_id) on delete cascade,
+    implied_role_id int not null references auth.roles(role_id) on delete cascade,
+    primary key (role_id, implied_role_id),
+    check (role_id <> implied_role_id)
+);
+
+insert into auth.role_implications(role_id, implied_role_id)
+select ROL.role_id, IMP.role_id
+from auth.roles ROL
+join auth.roles IMP on (ROL.role_name, IMP.role_name) in (('root','admin'),('admin','editor'),('editor','reader'));
+
+-- auth.v_role_closure links a role to itself and to all the roles it implies
+create or replace recursive view auth.v_role_closure(role_id, implied_role_id) as
+select ROL.role_id, ROL.role_id from auth.roles ROL
+union
+select CLO.role_id, IMP.implied_role_id
+from auth.v_role_closure CLO
+join auth.role_implications IMP on IMP.role_id = CLO.implied_role_id;
+
+-- auth.v_granted_resources gets login of user, resource operator, template, roles the user has on this resource (with implied roles), MFA policy, http methods and effect
+create or replace view auth.v_granted_resources as
+with granted_roles as (
+    select USR.user_id, GRA.feature_name, array_agg(distinct ROL.role_name::text) as user_roles
+    from auth.users USR 
+    join auth.grants GRA on GRA.user_id = USR.user_id 
+    join auth.v_role_closure CLO on CLO.role_id = GRA.role_id
+    join auth.roles ROL on ROL.role_id = CLO.implied_role_id
+    group by USR.user_id, GRA.feature_name
+), resources_auths as (
+    select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+    from auth.authorizations AUT 
+    join auth.resources RES on RES.resource_id = AUT.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id 
+    group by AUT.resource_id, RES.feature_name
+)
+select distinct USR.user_login, RES.operator, RES.template_url, auth.array_intersection(GRO.user_roles, RAU.expected_roles) as roles, RES.requires_mfa, RES.methods, RES.effect
+from auth.users USR 
+join granted_roles GRO on GRO.user_id = USR.user_id 
+join resources_auths RAU on RAU.feature_name = GRO.feature_name 
+join auth.resources RES on RES.resource_id = RAU.resource_id
+where GRO.user_roles && RAU.expected_roles;
+
+-- auth.get_grants_for_access_token returns the grants of a token: roles of the token that its user still has (with implied roles)
+create or replace function auth.get_grants_for_access_token(p_id text) returns table(operator text, template_url text, roles text[], requires_mfa boolean, methods text[], effect text) language plpgsql as $$
+begin
+    return query
+        with user_roles as (
+            select GRA.feature_name, CLO.implied_role_id as role_id
+            from auth.access_tokens TOK
+            join auth.grants GRA on GRA.user_id = TOK.user_id
+            join auth.v_role_closure CLO on CLO.role_id = GRA.role_id
+            where TOK.token_id = p_id
+        ), token_roles as (
+            select ATG.feature_name, array_agg(distinct ROL.role_name::text) as token_roles
+            from auth.access_token_grants ATG
+            join user_roles URO on URO.feature_name = ATG.feature_name and URO.role_id = ATG.role_id
+            join auth.v_role_closure CLO on CLO.role_id = ATG.role_id
+            join auth.roles ROL on ROL.role_id = CLO.implied_role_id
+            where ATG.token_id = p_id
+            group by ATG.feature_name
+        ), resources_auths as (
+            select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+            from auth.authorizations AUT
+            join auth.resources RES on RES.resource_id = AUT.resource_id
+            join auth.roles ROL on ROL.role_id = AUT.role_id
+            group by AUT.resource_id, RES.feature_name
+        )
+        select distinct RES.operator, RES.template_url, auth.array_intersection(TRO.token_roles, RAU.expected_roles), RES.requires_mfa, RES.methods, RES.effect
+        from token_roles TRO
+        join resources_auths RAU on RAU.feature_name = TRO.feature_name
+        join auth.resources RES on RES.resource_id = RAU.resource_id
+        where TRO.token_roles && RAU.expected_roles;
+end;$$;
+
+-- auth.list_roles returns the roles, and the roles each one implies directly
+create or replace function auth.list_roles() returns table(role_name text, role_description text, can_grant boolean, built_in boolean, implies text[]) language plpgsql as $$
+begin
+    return query
+        select ROL.role_name, ROL.role_description, ROL.can_grant, ROL.built_in,
+        array_remove(array_agg(IMP.role_name::text order by IMP.role_name), null)
+        from auth.roles ROL
+        left join auth.role_implications RIM on RIM.role_id = ROL.role_id
+        left join auth.roles IMP on IMP.role_id = RIM.implied_role_id
+        group by ROL.role_id, ROL.role_name, ROL.role_description, ROL.can_grant, ROL.built_in
+        order by ROL.role_name;
+end;$$;
+
+-- auth.upsert_role creates or changes a role that is not built-in, and sets the roles it implies
+create or replace procedure auth.upsert_role(p_name text, p_description text, p_can_grant boolean, p_implies text[]) language plpgsql as $$
+declare
+    l_role_id int;
+    l_implied text;
+    l_implied_id int;
+begin
+    if exists (select 1 from auth.roles where role_name = p_name and built_in) then
+        raise exception 'invalid operation: % is a built-in role', p_name;
+    end if;
+
+    insert into auth.roles(role_name, role_description, can_grant) values (p_name, p_description, p_can_grant)
+    on conflict (role_name) do update set role_description = p_description, can_grant = p_can_grant
+    returning role_id into l_role_id;
+
+    delete from auth.role_implications where role_id = l_role_id;
+    foreach l_implied in array coalesce(p_implies, ARRAY[]::text[]) loop
+        select role_id into l_implied_id from auth.roles where role_name = l_implied;
+        if l_implied_id is null then
+            raise exception 'no matching role for %', l_implied;
+        elsif exists (select 1 from auth.v_role_closure where role_id = l_implied_id and implied_role_id = l_role_id) then
+            raise exception 'invalid operation: % implies %', l_implied, p_name;
+        end if;
+
+        insert into auth.role_implications(role_id, implied_role_id) values (l_role_id, l_implied_id) on conflict do nothing;
+    end loop;
+end;$$;
+
+-- auth.delete_role deletes a role that is not built-in and not used, and returns false if there is no such role
+create or replace function auth.delete_role(p_name text) returns boolean language plpgsql as $$
+declare
+    l_role_id int;
+begin
+    select role_id into l_role_id from auth.roles where role_name = p_name;
+    if l_role_id is null then
+        return false;
+    elsif exists (select 1 from auth.roles where role_id = l_role_id and built_in) then
+        raise exception 'invalid operation: % is a built-in role', p_name;
+    elsif exists (select 1 from auth.grants where role_id = l_role_id)
+        or exists (select 1 from auth.authorizations where role_id = l_role_id)
+        or exists (select 1 from auth.access_token_grants where role_id = l_role_id) then
+        raise exception 'invalid operation: % is in use', p_name;
+    end if;
+
+    delete from auth.roles where role_id = l_role_id;
+    return true;
+end;$$;
+
+-- management group: admins read roles, root manages them
+call auth.add_resource(ARRAY['admin']::text[],'STARTS_WITH','/manage/roles/','management',ARRAY['GET']::text[]);
+call auth.add_resource(ARRAY['root']::text[],'STARTS_WITH','/manage/roles/','management');
@@ -0,0 +1,151 @@
+-- auth.features are the groups of resources. Roles are granted per feature
+create table auth.features (
+    feature_name text primary key,
+    feature_description text not null default '',
+    requires_mfa boolean not null default false,
+    created_at timestamp with time zone default now()
+);
+
+insert into auth.features(feature_name, requires_mfa)
+select feature_name, bool_or(requires_mfa) from auth.resources group by feature_name
+on conflict do nothing;
+
+insert into auth.features(feature_name)
+select feature_name from auth.grants
+union
+select feature_name from auth.access_token_grants
+on conflict do nothing;
+
+-- resources belong to a feature, grants are removed with their feature
+alter table auth.resources add constraint resources_feature_fk foreign key (feature_name) references auth.features(feature_name);
+alter table auth.grants add constraint grants_feature_fk foreign key (feature_name) references auth.features(feature_name) on delete cascade;
+alter table auth.access_token_grants add constraint access_token_grants_feature_fk foreign key (feature_name) references auth.features(feature_name) on delete cascade;
+alter table auth.authorizations drop constraint authorizations_resource_id_fkey;
+alter table auth.authorizations add constraint authorizations_resource_id_fkey foreign key (resource_id) references auth.resources(resource_id) on delete cascade;
+
+-- auth.set_feature_mfa sets the MFA policy of a feature and of all its resources
+create or replace procedure auth.set_feature_mfa(p_feature text, p_required boolean) language plpgsql as $$
+begin 
+    update auth.features set requires_mfa = p_required where feature_name = p_feature;
+    update auth.resources set requires_mfa = p_required where feature_name = p_feature;
+end;$$;
+
+-- auth.add_resource adds a resource in a feature (created if needed) for those http methods (null for any) with that effect, and expicits roles it applies to
+create or replace procedure auth.add_resource(p_roles text[], p_operator text, p_template text, p_feature text, p_methods text[], p_effect text) language plpgsql as $$
+begin 
+    insert into auth.features(feature_name) values (p_feature) on conflict do nothing;
+    perform auth.create_resource(p_roles, p_operator, p_template, p_feature, p_methods, p_effect);
+end;$$;
+
+-- auth.v_resources_authorizations displays, for a resource, its operator, template, group, needed roles, MFA policy, http methods, effect and id
+create or replace view auth.v_resources_authorizations as
+with resources_agg_auth as (
+    select RES.resource_id, array_agg(ROL.role_name) as needed_roles
+    from auth.resources RES
+    join auth.authorizations AUT on AUT.resource_id = RES.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id
+    group by RES.resource_id
+)
+select RES.operator, RES.template_url, RES.feature_name, RAA.needed_roles, RES.requires_mfa, RES.methods, RES.effect, RES.resource_id
+from auth.resources RES
+join resources_agg_auth RAA on RAA.resource_id = RES.resource_id;
+
+-- auth.set_resource_roles replaces the roles a resource applies to
+create or replace procedure auth.set_resource_roles(p_id int, p_roles text[]) language plpgsql as $$
+declare 
+    l_role text; 
+    l_role_id int;
+begin 
+    delete from auth.authorizations where resource_id = p_id;
+    foreach l_role in array p_roles loop 
+        select role_id into l_role_id from auth.roles where role_name = l_role;
+        if l_role_id is null then 
+            raise exception 'no matching role for %', l_role;
+        end if;
+
+        insert into auth.authorizations(resource_id, role_id) values (p_id, l_role_id);
+    end loop;
+end;$$;
+
+-- auth.create_resource adds a resource in an existing feature, with the MFA policy of that feature, and returns its id
+create or replace function auth.create_resource(p_roles text[], p_operator text, p_template text, p_feature text, p_methods text[], p_effect text) returns int language plpgsql as $$
+declare 
+    l_resource_id int;
+begin 
+    if not exists (select 1 from auth.features where feature_name = p_feature) then
+        raise exception 'no feature matching %', p_feature;
+    end if;
+
+    insert into auth.resources(operator, template_url, feature_name, methods, effect, requires_mfa)
+    select p_operator, p_template, p_feature, p_methods, p_effect, FEA.requires_mfa
+    from auth.features FEA where FEA.feature_name = p_feature
+    returning resource_id into l_resource_id;
+
+    call auth.set_resource_roles(l_resource_id, p_roles);
+    return l_resource_id;
+end;$$;
+
+-- auth.update_resource changes a resource, and returns false if there is no such resource
+create or replace function auth.update_resource(p_id int, p_roles text[], p_operator text, p_template text, p_feature text, p_methods text[], p_effect text) returns boolean language plpgsql as $$
+begin 
+    if not exists (select 1 from auth.resources where resource_id = p_id) then
+        return false;
+    elsif not exists (select 1 from auth.features where feature_name = p_feature) then
+        raise exception 'no feature matching %', p_feature;
+    end if;
+
+    update auth.resources RES
+    set operator = p_operator, template_url = p_template, feature_name = p_feature, methods = p_methods, effect = p_effect, requires_mfa = FEA.requires_mfa
+    from auth.features FEA
+    where RES.resource_id = p_id and FEA.feature_name = p_feature;
+
+    call auth.set_resource_roles(p_id, p_roles);
+    return true;
+end;$$;
+
+-- auth.delete_resource deletes a resource, and returns false if there is no such resource
+create or replace function auth.delete_resource(p_id int) returns boolean language plpgsql as $$
+declare
+    l_count int;
+begin 
+    delete from auth.resources where resource_id = p_id;
+    get diagnostics l_count = row_count;
+    return l_count > 0;
+end;$$;
+
+-- auth.list_features returns the features, with their number of resources
+create or replace function auth.list_features() returns table(feature_name text, feature_description text, requires_mfa boolean, resources bigint) language plpgsql as $$
+begin
+    return query
+        select FEA.feature_name, FEA.feature_description, FEA.requires_mfa, count(RES.resource_id)
+        from auth.features FEA
+        left join auth.resources RES on RES.feature_name = FEA.feature_name
+        group by FEA.feature_name, FEA.feature_description, FEA.requires_mfa
+        order by FEA.feature_name;
+end;$$;
+
+-- auth.upsert_feature creates or changes a feature, and applies its MFA policy to its resources
+create or replace procedure auth.upsert_feature(p_name text, p_description text, p_requires_mfa boolean) language plpgsql as $$
+begin
+    insert into auth.features(feature_name, feature_description, requires_mfa) values (p_name, p_description, p_requires_mfa)
+    on conflict (feature_name) do update set feature_description = p_description;
+    call auth.set_feature_mfa(p_name, p_requires_mfa);
+end;$$;
+
+-- auth.delete_feature deletes a feature with no resource (and grants on it), and returns false if there is no such feature
+create or replace function auth.delete_feature(p_name text) returns boolean language plpgsql as $$
+declare
+    l_count int;
+begin
+    if exists (select 1 from auth.resources where feature_name = p_name) then
+        raise exception 'invalid operation: feature % has resources', p_name;
+    end if;
+
+    delete from auth.features where feature_name = p_name;
+    get diagnostics l_count = row_count;
+    return l_count > 0;
+end;$$;
+
+-- management group: root manages resources and features
+call auth.add_resource(ARRAY['root']::text[],'STARTS_WITH','/manage/resources/','management');
+call auth.add_resource(ARRAY['root']::text[],'STARTS_WITH','/manage/features/','management');
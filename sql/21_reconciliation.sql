@@ -0,0 +1,2 @@
+-- management group: admin reads the reconciliation report of routes and resources (root manages resources anyway)
+call auth.add_resource(ARRAY['admin']::text[],'EQUALS','/manage/resources/reconcile','management',ARRAY['GET']::text[]);
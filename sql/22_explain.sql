@@ -0,0 +1,34 @@
+-- auth.v_granted_resources gets login of user, resource operator, template, roles the user has on this resource (with implied roles), MFA policy, http methods, effect and resource id
+create or replace view auth.v_granted_resources as
+with granted_roles as (
+    select USR.user_id, GRA.feature_name, array_agg(distinct ROL.role_name::text) as user_roles
+    from auth.users USR 
+    join auth.grants GRA on GRA.user_id = USR.user_id 
+    join auth.v_role_closure CLO on CLO.role_id = GRA.role_id
+    join auth.roles ROL on ROL.role_id = CLO.implied_role_id
+    group by USR.user_id, GRA.feature_name
+), resources_auths as (
+    select AUT.resource_id, RES.feature_name, array_agg(distinct ROL.role_name::text) as expected_roles
+    from auth.authorizations AUT 
+    join auth.resources RES on RES.resource_id = AUT.resource_id
+    join auth.roles ROL on ROL.role_id = AUT.role_id 
+    group by AUT.resource_id, RES.feature_name
+)
+select distinct USR.user_login, RES.operator, RES.template_url, auth.array_intersection(GRO.user_roles, RAU.expected_roles) as roles, RES.requires_mfa, RES.methods, RES.effect, RES.resource_id
+from auth.users USR 
+join granted_roles GRO on GRO.user_id = USR.user_id 
+join resources_auths RAU on RAU.feature_name = GRO.feature_name 
+join auth.resources RES on RES.resource_id = RAU.resource_id
+where GRO.user_roles && RAU.expected_roles;
+
+-- auth.get_granted_resources_for_user returns, per resource, the roles of an user on it (to explain access decisions)
+create or replace function auth.get_granted_resources_for_user(p_login text) returns table(resource_id int, roles text[]) language plpgsql as $$
+begin
+    return query
+        select VGR.resource_id, VGR.roles
+        from auth.v_granted_resources VGR
+        where VGR.user_login = p_login;
+end;$$;
+
+-- management group: root explains access decisions
+call auth.add_resource(ARRAY['root']::text[],'EQUALS','/manage/authz/explain','management',ARRAY['GET']::text[]);
@@ -0,0 +1,10 @@
+-- auth.get_roles_features_for_all_users returns, for each user, the roles granted per feature (to simulate resources changes)
+create or replace function auth.get_roles_features_for_all_users() returns table(user_login text, feature_name text, roles text[]) language plpgsql as $$
+begin 
+    return query 
+        select USR.user_login, GRA.feature_name, array_agg(distinct ROL.role_name::text) as roles
+        from auth.users USR 
+        join auth.grants GRA on GRA.user_id = USR.user_id 
+        join auth.roles ROL on ROL.role_id = GRA.role_id
+        group by USR.user_login, GRA.feature_name;
+end;$$;
@@ -0,0 +1,10 @@
+-- REGEX templates are RE2 patterns, checked by the server when resources are created or changed (PostgreSQL regex syntax differs).
+-- auth.validate_resource_template only rejects REGEX templates that are too long
+create or replace function auth.validate_resource_template() returns trigger language plpgsql as $$
+begin
+    if new.operator = 'REGEX' and length(new.template_url) > 512 then
+        raise exception 'invalid regex template: longer than 512 characters';
+    end if;
+
+    return new;
+end;$$;
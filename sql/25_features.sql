@@ -0,0 +1,10 @@
+-- auth.upsert_feature creates or changes a feature, and applies its MFA policy to its resources.
+-- Null policy keeps the current one (no MFA for a new feature)
+create or replace procedure auth.upsert_feature(p_name text, p_description text, p_requires_mfa boolean) language plpgsql as $$
+begin
+    insert into auth.features(feature_name, feature_description, requires_mfa) values (p_name, p_description, coalesce(p_requires_mfa, false))
+    on conflict (feature_name) do update set feature_description = p_description;
+    if p_requires_mfa is not null then
+        call auth.set_feature_mfa(p_name, p_requires_mfa);
+    end if;
+end;$$;
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// AddAccessToken stores a personal access token of an user (only its hash) and its roles per feature
+func (d *Dao) AddAccessToken(ctx context.Context, login string, token dto.AccessToken, tokenHash []byte) error {
+	if err := d.rdb.AddAccessToken(ctx, login, token, tokenHash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// UseAccessToken returns the id and the user of a personal access token, and sets its last use.
+// Both are empty if token is unknown or expired
+func (d *Dao) UseAccessToken(ctx context.Context, tokenHash []byte) (string, string, error) {
+	if id, login, err := d.rdb.UseAccessToken(ctx, tokenHash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return "", "", mapError(err)
+	} else {
+		return id, login, nil
+	}
+}
+
+// GetAccessTokenGrantedAccess returns, for a personal access token, all the rules conditions to access a resource.
+// Token has the roles it was given, as long as its user still has them
+func (d *Dao) GetAccessTokenGrantedAccess(ctx context.Context, tokenId string) ([]dto.GrantAccessForResource, error) {
+	if resp, err := d.rdb.GetAccessTokenGrantedAccess(ctx, tokenId); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// ListAccessTokens returns the personal access tokens of an user, oldest first
+func (d *Dao) ListAccessTokens(ctx context.Context, login string) ([]dto.AccessToken, error) {
+	if resp, err := d.rdb.ListAccessTokens(ctx, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// DeleteAccessToken revokes a personal access token of an user, and returns false if user has no such token
+func (d *Dao) DeleteAccessToken(ctx context.Context, login, tokenId string) (bool, error) {
+	if deleted, err := d.rdb.DeleteAccessToken(ctx, login, tokenId); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else {
+		return deleted, nil
+	}
+}
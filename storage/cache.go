@@ -2,11 +2,31 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// Cache is a key value cache with expiration
+type Cache interface {
+	// SetValue sets value with the default time to live
+	SetValue(context context.Context, key string, value []byte) error
+	// SetValueFor sets value for that time to live
+	SetValueFor(context context.Context, key string, value []byte, ttl time.Duration) error
+	// Increment adds one to the counter at key, and returns the new value. Time to live is set when the counter is created
+	Increment(context context.Context, key string, ttl time.Duration) (int64, error)
+	// Has returns true if the key is stored in the cache
+	Has(ctx context.Context, key string) (bool, error)
+	// GetValue gets value by key, ErrCacheMiss if there is no value
+	GetValue(context context.Context, key string) ([]byte, error)
+	// Delete a value by key
+	Delete(context context.Context, key string) error
+}
+
+// ErrCacheMiss is the error when getting a key that is not in the cache
+var ErrCacheMiss = errors.New("no value for key in cache")
+
 // CacheStorage is a key value cache
 type CacheStorage struct {
 	client *redis.Client
@@ -34,6 +54,28 @@ func (c *CacheStorage) SetValue(context context.Context, key string, value []byt
 	return nil
 }
 
+// SetValueFor sets value in a cache for that time to live
+func (c *CacheStorage) SetValueFor(context context.Context, key string, value []byte, ttl time.Duration) error {
+	if status := c.client.Set(context, key, value, ttl); status.Err() != nil {
+		return status.Err()
+	}
+
+	return nil
+}
+
+// Increment adds one to the counter at key, and returns the new value.
+// Time to live is set when the counter is created (or has none), so that the counter expires ttl after its first increment
+func (c *CacheStorage) Increment(context context.Context, key string, ttl time.Duration) (int64, error) {
+	pipe := c.client.TxPipeline()
+	counter := pipe.Incr(context, key)
+	pipe.ExpireNX(context, key, ttl)
+	if _, err := pipe.Exec(context); err != nil {
+		return 0, err
+	}
+
+	return counter.Val(), nil
+}
+
 // Has returns true if the key is stored in the cache
 func (c *CacheStorage) Has(ctx context.Context, key string) (bool, error) {
 	cmd, err := c.client.Exists(ctx, key).Result()
@@ -46,7 +88,9 @@ func (c *CacheStorage) Has(ctx context.Context, key string) (bool, error) {
 
 // GetValue gets value by key from a cache
 func (c *CacheStorage) GetValue(context context.Context, key string) ([]byte, error) {
-	if result := c.client.Get(context, key); result.Err() != nil {
+	if result := c.client.Get(context, key); errors.Is(result.Err(), redis.Nil) {
+		return nil, ErrCacheMiss
+	} else if result.Err() != nil {
 		return nil, result.Err()
 	} else {
 		return result.Bytes()
@@ -68,3 +112,30 @@ func (c *CacheStorage) Close() {
 		c.client.Close()
 	}
 }
+
+// Publish sends a message to the subscribers of that channel
+func (c *CacheStorage) Publish(ctx context.Context, channel, message string) error {
+	return c.client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe calls handler for each message on that channel, until context is done.
+// Messages are handled in the background. Connection is restored after failures, messages sent meanwhile are lost
+func (c *CacheStorage) Subscribe(ctx context.Context, channel string, handler func(string)) {
+	pubsub := c.client.Subscribe(ctx, channel)
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				handler(message.Payload)
+			}
+		}
+	}()
+}
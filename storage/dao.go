@@ -12,12 +12,20 @@ import (
 // DaoOptions hides decorated systems
 type DaoOptions struct {
 	PostgresqlURL string
+	// Cache is the shared cache, nil to use an in-process cache only
+	Cache *CacheStorage
+	// PasswordHashing is the algorithm to hash passwords (argon2id if empty, or bcrypt)
+	PasswordHashing string
 }
 
 // Dao deals with operations such as roles, users, groups, etc
 type Dao struct {
-	rdb    DbStorage
-	logger *log.Logger
+	rdb       DbStorage
+	cache     *ResilientCache
+	passwords *PasswordHasher
+	resources *resourcesCache
+	grants    *grantsCache
+	logger    *log.Logger
 }
 
 // NewDao returns a new dao for those connection parameters
@@ -25,16 +33,20 @@ func NewDao(options DaoOptions, logger *log.Logger) (Dao, error) {
 	var dao Dao
 	if len(options.PostgresqlURL) == 0 {
 		return dao, fmt.Errorf("missing postgres configuration")
+	} else if passwords, err := NewPasswordHasher(options.PasswordHashing); err != nil {
+		return dao, err
 	} else if db, err := NewDbStorage(options.PostgresqlURL); err != nil {
 		return dao, err
 	} else {
-		return Dao{rdb: db, logger: logger}, nil
+		resources := &resourcesCache{}
+		return Dao{rdb: db, cache: NewResilientCache(options.Cache, logger), passwords: passwords, resources: resources, grants: newGrantsCache(options.Cache, resources), logger: logger}, nil
 	}
 }
 
 // Close all the storage systems
 func (d *Dao) Close() {
 	if d != nil {
+		d.grants.stop()
 		d.rdb.Close()
 	}
 }
@@ -43,7 +55,7 @@ func (d *Dao) Close() {
 func (d *Dao) LogEvent(ctx context.Context, login, actionType, actionDescription string, parameters []string) error {
 	if err := d.rdb.LogEvent(ctx, login, actionType, actionDescription, parameters); err != nil {
 		d.logger.Printf("FAILED TO LOG AUDIT EVENT: %s \n", err.Error())
-		return err
+		return mapError(err)
 	}
 
 	return nil
@@ -51,75 +63,102 @@ func (d *Dao) LogEvent(ctx context.Context, login, actionType, actionDescription
 
 // LoadAuditEvents gets the events between two dates
 func (d *Dao) LoadAuditEvents(ctx context.Context, from, to time.Time) ([]dto.AuditEntryLog, error) {
-	return d.rdb.LoadAuditEvents(ctx, from, to)
+	values, err := d.rdb.LoadAuditEvents(ctx, from, to)
+	return values, mapError(err)
 }
 
 // CreateUsersGroup creates a group of users.
 // Login is the user that created the group, and that user has access rights to set
 func (d *Dao) CreateUsersGroup(ctx context.Context, login, groupName string, roles []dto.GrantRole) error {
-	return d.rdb.CreateUsersGroup(ctx, login, groupName, roles)
+	return mapError(d.rdb.CreateUsersGroup(ctx, login, groupName, roles))
 }
 
 // ListUserGroupsForSpecificUser returns the groups an user is in
 func (d *Dao) ListUserGroupsForSpecificUser(ctx context.Context, login string) (map[string][]dto.GrantRole, error) {
-	return d.rdb.ListUserGroupsForSpecificUser(ctx, login)
+	values, err := d.rdb.ListUserGroupsForSpecificUser(ctx, login)
+	return values, mapError(err)
 }
 
 // GetGroupAuthForUser returns, for a specific group and user, user's auth (if any)
 func (d *Dao) GetGroupAuthForUser(ctx context.Context, login, group string) ([]dto.GrantRole, error) {
-	return d.rdb.GetGroupAuthForUser(ctx, login, group)
+	values, err := d.rdb.GetGroupAuthForUser(ctx, login, group)
+	return values, mapError(err)
 }
 
 // SetGroupAuthForUser sets auth within a group for a given user, granted by a creator
 func (d *Dao) SetGroupAuthForUser(ctx context.Context, creator, user, group string, roles []dto.GrantRole) error {
-	return d.rdb.SetGroupAuthForUser(ctx, creator, user, group, roles)
+	if err := d.rdb.SetGroupAuthForUser(ctx, creator, user, group, roles); err != nil {
+		return mapError(err)
+	}
+
+	d.invalidateAccess(ctx, user)
+	return nil
 }
 
 // RevokeUserInGroup removes an user in a group
 func (d *Dao) RevokeUserInGroup(ctx context.Context, user, group string) error {
-	return d.rdb.RevokeUserInGroup(ctx, user, group)
+	if err := d.rdb.RevokeUserInGroup(ctx, user, group); err != nil {
+		return mapError(err)
+	}
+
+	d.invalidateAccess(ctx, user)
+	return nil
 }
 
 // DeleteUsersGroup just deletes a group of users
 func (d *Dao) DeleteUsersGroup(ctx context.Context, name string) error {
-	return d.rdb.DeleteUsersGroup(ctx, name)
+	if err := d.rdb.DeleteUsersGroup(ctx, name); err != nil {
+		return mapError(err)
+	}
+
+	// members are not known anymore
+	d.invalidateAllAccess(ctx)
+	return nil
 }
 
 // ValidateUser returns true if login and password are a valid user auth info.
+// Legacy or outdated hashes are replaced once password is validated
 func (d *Dao) ValidateUser(ctx context.Context, login string, password string) (bool, error) {
-	if resp, err := d.rdb.ValidateUser(ctx, login, password); err != nil {
+	stored, err := d.rdb.GetUserPasswordHash(ctx, login)
+	if err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return false, err
-	} else {
-		return resp, err
+		return false, mapError(err)
+	} else if stored == nil {
+		// no such user, but take as much time as for an user
+		d.passwords.VerifyDecoy(password)
+		return false, nil
 	}
-}
 
-// GetFeaturesSet returns all the resources group names (ordered by name)
-func (d *Dao) GetFeaturesSet(ctx context.Context) ([]string, error) {
-	if resp, err := d.rdb.GetFeaturesSet(ctx); err != nil {
+	valid, rehash, err := d.passwords.Verify(stored, password)
+	if err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return nil, err
-	} else {
-		return resp, err
+		return false, mapError(err)
+	} else if rehash {
+		if hash, err := d.passwords.Hash(password); err != nil {
+			d.logger.Println("DAO: failed to hash password again", err)
+		} else if err := d.rdb.ReplaceUserHash(ctx, login, stored, hash); err != nil {
+			d.logger.Println("DAO: failed to replace password hash", err)
+		}
 	}
+
+	return valid, nil
 }
 
-// GetUserGrantedAccess returns, for a user, all the rules conditions to access a resource
-func (d *Dao) GetUserGrantedAccess(context context.Context, user string) ([]dto.GrantAccessForResource, error) {
-	if resp, err := d.rdb.GetUserGrantedAccess(context, user); err != nil {
+// GetFeaturesSet returns all the resources group names (ordered by name)
+func (d *Dao) GetFeaturesSet(ctx context.Context) ([]string, error) {
+	if resp, err := d.rdb.GetFeaturesSet(ctx); err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return nil, err
+		return nil, mapError(err)
 	} else {
 		return resp, err
 	}
 }
 
-// GetUserRolesPerFeature returns, for each resources group, all roles for that group that the user was granted
-func (d *Dao) GetUserRolesPerFeature(ctx context.Context, username string) (map[string][]dto.GrantRole, error) {
-	if resp, err := d.rdb.GetUserRolesPerFeature(ctx, username); err != nil {
+// GetResources returns all the protected resources, with the roles to access them
+func (d *Dao) GetResources(ctx context.Context) ([]dto.Resource, error) {
+	if resp, err := d.rdb.GetResources(ctx); err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return nil, err
+		return nil, mapError(err)
 	} else {
 		return resp, err
 	}
@@ -127,11 +166,14 @@ func (d *Dao) GetUserRolesPerFeature(ctx context.Context, username string) (map[
 
 // UpsertUser creates an user in database with that password if it does not exist, or changes current password
 func (d *Dao) UpsertUser(ctx context.Context, username, password string) error {
-	if err := d.rdb.UpsertUser(ctx, username, password); err != nil {
+	if hash, err := d.passwords.Hash(password); err != nil {
 		d.logger.Println("DAO: ERROR", err)
 		return err
+	} else if err := d.rdb.UpsertUserHash(ctx, username, hash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
 	} else {
-		return err
+		return nil
 	}
 }
 
@@ -139,30 +181,55 @@ func (d *Dao) UpsertUser(ctx context.Context, username, password string) error {
 func (d *Dao) DeleteUser(ctx context.Context, username string) error {
 	if err := d.rdb.DeleteUser(ctx, username); err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return err
+		return mapError(err)
 	} else {
-		return err
+		d.invalidateAccess(ctx, username)
+		return nil
 	}
 }
 
 // GrantAccessToFeatures sets access on groups for a given user.
 // The access parameter is a map of groups (should exist) and values are the roles to set.
-// Note that roles are the only roles set (no append)
-func (d *Dao) GrantAccessToFeatures(ctx context.Context, username string, access map[string][]dto.GrantRole) error {
-	if err := d.rdb.GrantAccessToFeatures(ctx, username, access); err != nil {
+// Note that roles are the only roles set (no append).
+// In dry run, changes are checked by the database but not committed
+func (d *Dao) GrantAccessToFeatures(ctx context.Context, username string, access map[string][]dto.GrantRole, dryRun bool) error {
+	if err := d.rdb.GrantAccessToFeatures(ctx, username, access, dryRun); err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return err
-	} else {
-		return err
+		return mapError(err)
+	} else if !dryRun {
+		d.invalidateAccess(ctx, username)
 	}
+
+	return nil
 }
 
 // RemoveAccessToFeature removes access rights for that user to a given group of resources
 func (d *Dao) RemoveAccessToFeature(ctx context.Context, username string, group string) error {
 	if err := d.rdb.RemoveAccessToFeature(ctx, username, group); err != nil {
 		d.logger.Println("DAO: ERROR", err)
-		return err
+		return mapError(err)
 	} else {
-		return err
+		d.invalidateAccess(ctx, username)
+		return nil
 	}
 }
+
+// GetSigningKeys returns the keys to sign and verify tokens, most recent (current) first
+func (d *Dao) GetSigningKeys(ctx context.Context) ([]dto.SigningKey, error) {
+	if resp, err := d.rdb.GetSigningKeys(ctx); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// AddSigningKey adds a key that becomes the current one. Only the keep most recent keys remain
+func (d *Dao) AddSigningKey(ctx context.Context, key dto.SigningKey, keep int) error {
+	if err := d.rdb.AddSigningKey(ctx, key, keep); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/zefrenchwan/scrutateur.git/dto"
 )
@@ -186,17 +188,6 @@ func (d *DbStorage) DeleteUsersGroup(ctx context.Context, name string) error {
 	return err
 }
 
-// ValidateUser returns true if login and password are a valid user auth info.
-func (d *DbStorage) ValidateUser(ctx context.Context, login string, password string) (bool, error) {
-	var result bool
-	row := d.db.QueryRow(ctx, "select * from auth.validate_auth($1,$2)", login, password)
-	if err := row.Scan(&result); err != nil {
-		return result, err
-	} else {
-		return result, nil
-	}
-}
-
 // GetGroupsOfResources returns all the resources group names
 func (d *DbStorage) GetFeaturesSet(ctx context.Context) ([]string, error) {
 	var result []string
@@ -227,7 +218,7 @@ func (d *DbStorage) GetFeaturesSet(ctx context.Context) ([]string, error) {
 // GetUserGrantedAccess gets all the grants access for a user
 func (d DbStorage) GetUserGrantedAccess(ctx context.Context, user string) ([]dto.GrantAccessForResource, error) {
 	var result []dto.GrantAccessForResource
-	if rows, err := d.db.Query(ctx, "select operator, template_url, roles from auth.get_grants_for_user($1) ", user); err != nil {
+	if rows, err := d.db.Query(ctx, "select operator, template_url, roles, requires_mfa, methods, effect from auth.get_grants_for_user($1) ", user); err != nil {
 		return result, err
 	} else if rows == nil {
 		return result, nil
@@ -239,17 +230,20 @@ func (d DbStorage) GetUserGrantedAccess(ctx context.Context, user string) ([]dto
 				return result, err
 			}
 
-			var operator string
-			var template_url string
+			var operator, template_url, effect string
+			var requiresMFA bool
+			var methods []string
 			roles := []string{}
-			if err := rows.Scan(&operator, &template_url, &roles); err != nil {
+			if err := rows.Scan(&operator, &template_url, &roles, &requiresMFA, &methods, &effect); err != nil {
 				return result, err
 			} else if parsedRoles, err := dto.ParseGrantRoles(roles); err != nil {
 				return result, err
 			} else if op, err := dto.ParseGrantOperator(operator); err != nil {
 				return result, err
+			} else if parsedEffect, err := dto.ParseGrantEffect(effect); err != nil {
+				return result, err
 			} else {
-				result = append(result, dto.GrantAccessForResource{Operator: op, Template: template_url, UserRoles: parsedRoles})
+				result = append(result, dto.GrantAccessForResource{Operator: op, Template: template_url, UserRoles: parsedRoles, RequiresMFA: requiresMFA, Methods: methods, Effect: parsedEffect})
 			}
 		}
 	}
@@ -257,15 +251,6 @@ func (d DbStorage) GetUserGrantedAccess(ctx context.Context, user string) ([]dto
 	return result, nil
 }
 
-// UpsertUser creates an user in database with that password if it does not exist, or changes current password
-func (d DbStorage) UpsertUser(ctx context.Context, username, password string) error {
-	if _, err := d.db.Exec(ctx, "call auth.upsert_user_auth($1, $2)", username, password); err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // DeleteUser deletes user regardless user's access rights
 func (d DbStorage) DeleteUser(ctx context.Context, username string) error {
 	_, err := d.db.Exec(ctx, "call auth.delete_user($1)", username)
@@ -302,8 +287,9 @@ func (d DbStorage) GetUserRolesPerFeature(ctx context.Context, username string)
 	return result, nil
 }
 
-// GrantAccessToFeatures upserts access auth for features as a map of name and roles
-func (d DbStorage) GrantAccessToFeatures(ctx context.Context, username string, access map[string][]dto.GrantRole) error {
+// GrantAccessToFeatures upserts access auth for features as a map of name and roles.
+// In dry run, changes are made in a transaction that is rolled back: database checks apply, nothing changes
+func (d DbStorage) GrantAccessToFeatures(ctx context.Context, username string, access map[string][]dto.GrantRole, dryRun bool) error {
 	if transaction, err := d.db.Begin(ctx); err != nil {
 		return err
 	} else {
@@ -315,7 +301,7 @@ func (d DbStorage) GrantAccessToFeatures(ctx context.Context, username string, a
 					mapping[index] = string(value)
 				}
 
-				if _, err := d.db.Exec(ctx, "call  auth.grant_feature_access($1,$2,$3)", username, mapping, group); err != nil {
+				if _, err := transaction.Exec(ctx, "call  auth.grant_feature_access($1,$2,$3)", username, mapping, group); err != nil {
 					transaction.Rollback(ctx)
 					return err
 				}
@@ -326,7 +312,9 @@ func (d DbStorage) GrantAccessToFeatures(ctx context.Context, username string, a
 			}
 		}
 
-		if err := transaction.Commit(ctx); err != nil {
+		if dryRun {
+			return transaction.Rollback(ctx)
+		} else if err := transaction.Commit(ctx); err != nil {
 			return err
 		}
 	}
@@ -339,3 +327,664 @@ func (d DbStorage) RemoveAccessToFeature(ctx context.Context, username string, g
 	_, err := d.db.Exec(ctx, "call auth.remove_feature_access_to_user($1,$2)", username, group)
 	return err
 }
+
+// GetResources returns all the protected resources, with the roles to access them
+func (d DbStorage) GetResources(ctx context.Context) ([]dto.Resource, error) {
+	var result []dto.Resource
+	if rows, err := d.db.Query(ctx, "select operator, template_url, feature_name, needed_roles, requires_mfa, methods, effect, resource_id from auth.v_resources_authorizations order by feature_name, template_url"); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var operator, template, feature, effect string
+			var requiresMFA bool
+			var methods []string
+			var id int
+			roles := []string{}
+			if err := rows.Scan(&operator, &template, &feature, &roles, &requiresMFA, &methods, &effect, &id); err != nil {
+				return result, err
+			} else if parsedRoles, err := dto.ParseGrantRoles(roles); err != nil {
+				return result, err
+			} else if op, err := dto.ParseGrantOperator(operator); err != nil {
+				return result, err
+			} else if parsedEffect, err := dto.ParseGrantEffect(effect); err != nil {
+				return result, err
+			} else {
+				result = append(result, dto.Resource{ID: id, Operator: op, Template: template, Feature: feature, Roles: parsedRoles, RequiresMFA: requiresMFA, Methods: methods, Effect: parsedEffect})
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// AddRefreshToken stores the hash of a refresh token for an user, valid until expiration, for a session opened with MFA or not
+func (d DbStorage) AddRefreshToken(ctx context.Context, login string, tokenHash []byte, expiration time.Time, mfa bool) error {
+	_, err := d.db.Exec(ctx, "call auth.add_refresh_token($1,$2,$3,$4)", login, tokenHash, expiration, mfa)
+	return err
+}
+
+// ConsumeRefreshToken deletes a refresh token and returns its user (empty for an unknown or expired token) and MFA flag
+func (d DbStorage) ConsumeRefreshToken(ctx context.Context, tokenHash []byte) (string, bool, error) {
+	var login string
+	var mfa bool
+	row := d.db.QueryRow(ctx, "select user_login, mfa from auth.consume_refresh_token($1)", tokenHash)
+	if err := row.Scan(&login, &mfa); errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	} else {
+		return login, mfa, nil
+	}
+}
+
+// DeleteRefreshToken deletes a refresh token, if any
+func (d DbStorage) DeleteRefreshToken(ctx context.Context, tokenHash []byte) error {
+	_, err := d.db.Exec(ctx, "call auth.delete_refresh_token($1)", tokenHash)
+	return err
+}
+
+// DeleteUserRefreshTokens deletes all the refresh tokens of an user
+func (d DbStorage) DeleteUserRefreshTokens(ctx context.Context, login string) error {
+	_, err := d.db.Exec(ctx, "call auth.delete_user_refresh_tokens($1)", login)
+	return err
+}
+
+// GetSigningKeys returns the signing keys, most recent first
+func (d DbStorage) GetSigningKeys(ctx context.Context) ([]dto.SigningKey, error) {
+	var result []dto.SigningKey
+	if rows, err := d.db.Query(ctx, "select key_id, algorithm, key_material, created_at from auth.signing_keys order by created_at desc"); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var key dto.SigningKey
+			if err := rows.Scan(&key.ID, &key.Algorithm, &key.Material, &key.CreatedAt); err != nil {
+				return result, err
+			} else {
+				result = append(result, key)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// AddSigningKey adds a key that becomes the current one, and keeps only the keep most recent keys
+func (d DbStorage) AddSigningKey(ctx context.Context, key dto.SigningKey, keep int) error {
+	_, err := d.db.Exec(ctx, "call auth.add_signing_key($1,$2,$3,$4)", key.ID, key.Algorithm, key.Material, keep)
+	return err
+}
+
+// GetUserPasswordHash returns the stored password hash of an user, nil if there is no such user
+func (d DbStorage) GetUserPasswordHash(ctx context.Context, login string) ([]byte, error) {
+	var result []byte
+	row := d.db.QueryRow(ctx, "select auth.get_user_password_hash($1)", login)
+	if err := row.Scan(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// UpsertUserHash creates an user with that password hash if it does not exist, or changes current hash
+func (d DbStorage) UpsertUserHash(ctx context.Context, login, hash string) error {
+	_, err := d.db.Exec(ctx, "call auth.upsert_user_hash($1,$2)", login, hash)
+	return err
+}
+
+// ReplaceUserHash replaces the password hash of an user, if stored hash is still previous
+func (d DbStorage) ReplaceUserHash(ctx context.Context, login string, previous []byte, hash string) error {
+	_, err := d.db.Exec(ctx, "call auth.replace_user_hash($1,$2,$3)", login, previous, hash)
+	return err
+}
+
+// SetPendingMFA sets a new TOTP secret for an user, not enabled yet
+func (d DbStorage) SetPendingMFA(ctx context.Context, login, secret string) error {
+	_, err := d.db.Exec(ctx, "call auth.set_pending_mfa($1,$2)", login, secret)
+	return err
+}
+
+// GetMFA returns the TOTP secret of an user (empty if none) and if it is enabled
+func (d DbStorage) GetMFA(ctx context.Context, login string) (string, bool, error) {
+	var secret string
+	var enabled bool
+	row := d.db.QueryRow(ctx, "select totp_secret, enabled from auth.get_mfa($1)", login)
+	if err := row.Scan(&secret, &enabled); errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	} else {
+		return secret, enabled, nil
+	}
+}
+
+// EnableMFA enables the pending secret of an user, with those recovery codes hashes
+func (d DbStorage) EnableMFA(ctx context.Context, login string, codeHashes [][]byte) error {
+	_, err := d.db.Exec(ctx, "call auth.enable_mfa($1,$2)", login, codeHashes)
+	return err
+}
+
+// DisableMFA deletes the secret and recovery codes of an user
+func (d DbStorage) DisableMFA(ctx context.Context, login string) error {
+	_, err := d.db.Exec(ctx, "call auth.disable_mfa($1)", login)
+	return err
+}
+
+// ConsumeRecoveryCode deletes a recovery code of an user, and returns true if there was such code
+func (d DbStorage) ConsumeRecoveryCode(ctx context.Context, login string, codeHash []byte) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.consume_recovery_code($1,$2)", login, codeHash)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// SetUserEmail sets the email of an user, empty to remove it
+func (d DbStorage) SetUserEmail(ctx context.Context, login, email string) error {
+	var value *string
+	if email != "" {
+		value = &email
+	}
+
+	_, err := d.db.Exec(ctx, "call auth.set_user_email($1,$2)", login, value)
+	return err
+}
+
+// GetUserEmail returns the email of an user, empty if user does not exist or has no email
+func (d DbStorage) GetUserEmail(ctx context.Context, login string) (string, error) {
+	var email string
+	row := d.db.QueryRow(ctx, "select user_email from auth.get_user_email($1)", login)
+	if err := row.Scan(&email); errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return email, nil
+}
+
+// AddPasswordReset stores the hash of a password reset token for an user, valid until expiration
+func (d DbStorage) AddPasswordReset(ctx context.Context, login string, tokenHash []byte, expiration time.Time) error {
+	_, err := d.db.Exec(ctx, "call auth.add_password_reset($1,$2,$3)", login, tokenHash, expiration)
+	return err
+}
+
+// ConsumePasswordReset deletes a password reset token and returns its user (empty for an unknown or expired token)
+func (d DbStorage) ConsumePasswordReset(ctx context.Context, tokenHash []byte) (string, error) {
+	var login string
+	row := d.db.QueryRow(ctx, "select user_login from auth.consume_password_reset($1)", tokenHash)
+	if err := row.Scan(&login); errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return login, nil
+}
+
+// AddAccessToken stores a personal access token of an user (with its hash) and its roles per feature
+func (d DbStorage) AddAccessToken(ctx context.Context, login string, token dto.AccessToken, tokenHash []byte) error {
+	if transaction, err := d.db.Begin(ctx); err != nil {
+		return err
+	} else if _, err := transaction.Exec(ctx, "call auth.add_access_token($1,$2,$3,$4,$5)", login, token.ID, token.Name, tokenHash, token.ExpiresAt); err != nil {
+		transaction.Rollback(ctx)
+		return err
+	} else {
+		for feature, roles := range token.Roles {
+			mapping := make([]string, len(roles))
+			for index, value := range roles {
+				mapping[index] = string(value)
+			}
+
+			if _, err := transaction.Exec(ctx, "call auth.add_access_token_grant($1,$2,$3)", token.ID, feature, mapping); err != nil {
+				transaction.Rollback(ctx)
+				return err
+			}
+		}
+
+		return transaction.Commit(ctx)
+	}
+}
+
+// UseAccessToken returns the id and user of a valid personal access token (empty if unknown or expired), and sets its last use
+func (d DbStorage) UseAccessToken(ctx context.Context, tokenHash []byte) (string, string, error) {
+	var id, login string
+	row := d.db.QueryRow(ctx, "select token_id, user_login from auth.use_access_token($1)", tokenHash)
+	if err := row.Scan(&id, &login); errors.Is(err, pgx.ErrNoRows) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	return id, login, nil
+}
+
+// GetAccessTokenGrantedAccess gets all the grants access for a personal access token
+func (d DbStorage) GetAccessTokenGrantedAccess(ctx context.Context, tokenId string) ([]dto.GrantAccessForResource, error) {
+	var result []dto.GrantAccessForResource
+	if rows, err := d.db.Query(ctx, "select operator, template_url, roles, requires_mfa, methods, effect from auth.get_grants_for_access_token($1) ", tokenId); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var operator, template_url, effect string
+			var requiresMFA bool
+			var methods []string
+			roles := []string{}
+			if err := rows.Scan(&operator, &template_url, &roles, &requiresMFA, &methods, &effect); err != nil {
+				return result, err
+			} else if parsedRoles, err := dto.ParseGrantRoles(roles); err != nil {
+				return result, err
+			} else if op, err := dto.ParseGrantOperator(operator); err != nil {
+				return result, err
+			} else if parsedEffect, err := dto.ParseGrantEffect(effect); err != nil {
+				return result, err
+			} else {
+				result = append(result, dto.GrantAccessForResource{Operator: op, Template: template_url, UserRoles: parsedRoles, RequiresMFA: requiresMFA, Methods: methods, Effect: parsedEffect})
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ListAccessTokens returns the personal access tokens of an user, oldest first
+func (d DbStorage) ListAccessTokens(ctx context.Context, login string) ([]dto.AccessToken, error) {
+	var result []dto.AccessToken
+	if rows, err := d.db.Query(ctx, "select token_id, token_name, created_at, expires_at, last_used_at, feature_name, roles from auth.list_access_tokens($1)", login); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var token dto.AccessToken
+			var feature *string
+			roles := []string{}
+			if err := rows.Scan(&token.ID, &token.Name, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &feature, &roles); err != nil {
+				return result, err
+			} else if parsedRoles, err := dto.ParseGrantRoles(roles); err != nil {
+				return result, err
+			} else {
+				// one row per token and feature, rows of a token are consecutive
+				if size := len(result); size == 0 || result[size-1].ID != token.ID {
+					token.Roles = make(map[string][]dto.GrantRole)
+					result = append(result, token)
+				}
+
+				if feature != nil {
+					result[len(result)-1].Roles[*feature] = parsedRoles
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// DeleteAccessToken deletes a personal access token of an user, and returns false if user has no such token
+func (d DbStorage) DeleteAccessToken(ctx context.Context, login, tokenId string) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.delete_access_token($1,$2)", login, tokenId)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// CreateServiceAccount creates a service account with no credential and no role
+func (d DbStorage) CreateServiceAccount(ctx context.Context, name string) error {
+	_, err := d.db.Exec(ctx, "call auth.create_service_account($1)", name)
+	return err
+}
+
+// DeleteServiceAccount deletes a service account, and returns false if there is no such service account
+func (d DbStorage) DeleteServiceAccount(ctx context.Context, name string) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.delete_service_account($1)", name)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// ListServiceAccounts returns the service accounts and their credentials (no material)
+func (d DbStorage) ListServiceAccounts(ctx context.Context) ([]dto.ServiceAccount, error) {
+	var result []dto.ServiceAccount
+	if rows, err := d.db.Query(ctx, "select user_login, credential_id, credential_type, created_at, expires_at from auth.list_service_accounts()"); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var name string
+			var id, credentialType *string
+			var createdAt *time.Time
+			var expiresAt *time.Time
+			if err := rows.Scan(&name, &id, &credentialType, &createdAt, &expiresAt); err != nil {
+				return result, err
+			}
+
+			// one row per account and credential, rows of an account are consecutive
+			if size := len(result); size == 0 || result[size-1].Name != name {
+				result = append(result, dto.ServiceAccount{Name: name, Credentials: []dto.ServiceCredential{}})
+			}
+
+			if id != nil {
+				credential := dto.ServiceCredential{ID: *id, Type: *credentialType, ExpiresAt: expiresAt}
+				if createdAt != nil {
+					credential.CreatedAt = *createdAt
+				}
+
+				last := len(result) - 1
+				result[last].Credentials = append(result[last].Credentials, credential)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// AddServiceCredential adds a credential to a service account
+func (d DbStorage) AddServiceCredential(ctx context.Context, name string, credential dto.ServiceCredential) error {
+	_, err := d.db.Exec(ctx, "call auth.add_service_credential($1,$2,$3,$4,$5)", name, credential.ID, credential.Type, credential.Material, credential.ExpiresAt)
+	return err
+}
+
+// GetServiceCredentials returns the valid credentials of a service account, with their material.
+// Result is empty for unknown accounts and for humans
+func (d DbStorage) GetServiceCredentials(ctx context.Context, name string) ([]dto.ServiceCredential, error) {
+	var result []dto.ServiceCredential
+	if rows, err := d.db.Query(ctx, "select credential_id, credential_type, credential, created_at, expires_at from auth.get_service_credentials($1)", name); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var credential dto.ServiceCredential
+			if err := rows.Scan(&credential.ID, &credential.Type, &credential.Material, &credential.CreatedAt, &credential.ExpiresAt); err != nil {
+				return result, err
+			}
+
+			result = append(result, credential)
+		}
+	}
+
+	return result, nil
+}
+
+// DeleteServiceCredential deletes a credential of a service account, and returns false if there is no such credential
+func (d DbStorage) DeleteServiceCredential(ctx context.Context, name, id string) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.delete_service_credential($1,$2)", name, id)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// GetPermissionsVersion returns the permissions version of an user, changed each time grants of that user change.
+// Version is -1 for an unknown user
+func (d DbStorage) GetPermissionsVersion(ctx context.Context, login string) (int64, error) {
+	var version *int64
+	row := d.db.QueryRow(ctx, "select auth.get_permissions_version($1)", login)
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	} else if version == nil {
+		return -1, nil
+	}
+
+	return *version, nil
+}
+
+// ListRoles returns the roles and the roles each one implies directly, ordered by name
+func (d DbStorage) ListRoles(ctx context.Context) ([]dto.Role, error) {
+	var result []dto.Role
+	if rows, err := d.db.Query(ctx, "select role_name, role_description, can_grant, built_in, implies from auth.list_roles()"); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var role dto.Role
+			var name string
+			implies := []string{}
+			if err := rows.Scan(&name, &role.Description, &role.CanGrant, &role.BuiltIn, &implies); err != nil {
+				return result, err
+			}
+
+			// roles are read before they are known, no validation
+			role.Name = dto.GrantRole(name)
+			for _, implied := range implies {
+				role.Implies = append(role.Implies, dto.GrantRole(implied))
+			}
+
+			result = append(result, role)
+		}
+	}
+
+	return result, nil
+}
+
+// UpsertRole creates or changes a role that is not built-in, and sets the roles it implies
+func (d DbStorage) UpsertRole(ctx context.Context, role dto.Role) error {
+	implies := make([]string, 0, len(role.Implies))
+	for _, implied := range role.Implies {
+		implies = append(implies, string(implied))
+	}
+
+	_, err := d.db.Exec(ctx, "call auth.upsert_role($1,$2,$3,$4)", string(role.Name), role.Description, role.CanGrant, implies)
+	return err
+}
+
+// DeleteRole deletes a role that is not built-in and not used, and returns false if there is no such role
+func (d DbStorage) DeleteRole(ctx context.Context, name string) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.delete_role($1)", name)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// CreateResource adds a resource in an existing feature, and returns its id
+func (d DbStorage) CreateResource(ctx context.Context, resource dto.Resource) (int, error) {
+	var result int
+	roles := make([]string, 0, len(resource.Roles))
+	for _, role := range resource.Roles {
+		roles = append(roles, string(role))
+	}
+
+	row := d.db.QueryRow(ctx, "select auth.create_resource($1,$2,$3,$4,$5,$6)", roles, string(resource.Operator), resource.Template, resource.Feature, resource.Methods, string(resource.Effect))
+	if err := row.Scan(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// UpdateResource changes a resource (found by its id), and returns false if there is no such resource
+func (d DbStorage) UpdateResource(ctx context.Context, resource dto.Resource) (bool, error) {
+	var result bool
+	roles := make([]string, 0, len(resource.Roles))
+	for _, role := range resource.Roles {
+		roles = append(roles, string(role))
+	}
+
+	row := d.db.QueryRow(ctx, "select auth.update_resource($1,$2,$3,$4,$5,$6,$7)", resource.ID, roles, string(resource.Operator), resource.Template, resource.Feature, resource.Methods, string(resource.Effect))
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// DeleteResource deletes a resource, and returns false if there is no such resource
+func (d DbStorage) DeleteResource(ctx context.Context, id int) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.delete_resource($1)", id)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// ListFeatures returns the features with their number of resources, ordered by name
+func (d DbStorage) ListFeatures(ctx context.Context) ([]dto.Feature, error) {
+	var result []dto.Feature
+	if rows, err := d.db.Query(ctx, "select feature_name, feature_description, requires_mfa, resources from auth.list_features()"); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var feature dto.Feature
+			var resources int64
+			if err := rows.Scan(&feature.Name, &feature.Description, &feature.RequiresMFA, &resources); err != nil {
+				return result, err
+			}
+
+			feature.Resources = int(resources)
+			result = append(result, feature)
+		}
+	}
+
+	return result, nil
+}
+
+// UpsertFeature creates or changes a feature, and applies its MFA policy (nil to keep it) to its resources
+func (d DbStorage) UpsertFeature(ctx context.Context, name, description string, requiresMFA *bool) error {
+	_, err := d.db.Exec(ctx, "call auth.upsert_feature($1,$2,$3)", name, description, requiresMFA)
+	return err
+}
+
+// DeleteFeature deletes a feature with no resource, and returns false if there is no such feature
+func (d DbStorage) DeleteFeature(ctx context.Context, name string) (bool, error) {
+	var result bool
+	row := d.db.QueryRow(ctx, "select auth.delete_feature($1)", name)
+	if err := row.Scan(&result); err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// GetUserGrantedResources returns, per resource id, the roles of an user on that resource (with implied roles)
+func (d DbStorage) GetUserGrantedResources(ctx context.Context, login string) (map[int][]dto.GrantRole, error) {
+	result := make(map[int][]dto.GrantRole)
+	if rows, err := d.db.Query(ctx, "select resource_id, roles from auth.get_granted_resources_for_user($1)", login); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var id int
+			roles := []string{}
+			if err := rows.Scan(&id, &roles); err != nil {
+				return result, err
+			} else if parsedRoles, err := dto.ParseGrantRoles(roles); err != nil {
+				return result, err
+			} else {
+				result[id] = parsedRoles
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// GetAllRolesPerFeature returns, for each user login, the roles granted per feature
+func (d DbStorage) GetAllRolesPerFeature(ctx context.Context) (map[string]map[string][]dto.GrantRole, error) {
+	result := make(map[string]map[string][]dto.GrantRole)
+	if rows, err := d.db.Query(ctx, "select user_login, feature_name, roles from auth.get_roles_features_for_all_users()"); err != nil {
+		return result, err
+	} else if rows == nil {
+		return result, nil
+	} else {
+		defer rows.Close()
+
+		for rows.Next() {
+			if rows.Err() != nil {
+				return result, err
+			}
+
+			var login, feature string
+			roles := []string{}
+			if err := rows.Scan(&login, &feature, &roles); err != nil {
+				return result, err
+			} else if parsedRoles, err := dto.ParseGrantRoles(roles); err != nil {
+				return result, err
+			} else if access, found := result[login]; found {
+				access[feature] = parsedRoles
+			} else {
+				result[login] = map[string][]dto.GrantRole{feature: parsedRoles}
+			}
+		}
+	}
+
+	return result, nil
+}
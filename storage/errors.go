@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrorKind classifies storage failures that callers may deal with
+type ErrorKind string
+
+// Possible values are listed here
+const (
+	// KindNotFound means that an expected element (user, group, etc) does not exist
+	KindNotFound ErrorKind = "not_found"
+	// KindConflict means that operation conflicts with existing data (for instance, a duplicate)
+	KindConflict ErrorKind = "conflict"
+	// KindInvalid means that parameters were rejected by the storage system
+	KindInvalid ErrorKind = "invalid"
+	// KindUnavailable means that storage system could not be reached in time
+	KindUnavailable ErrorKind = "unavailable"
+	// KindUnknown is any other failure
+	KindUnknown ErrorKind = "unknown"
+)
+
+// StorageError decorates a storage failure with its kind.
+// Error message is the raw message, and should not be sent to clients
+type StorageError struct {
+	// Kind of failure
+	Kind ErrorKind
+	// cause is the original error
+	cause error
+}
+
+// Error returns the raw message of the underlying error
+func (s StorageError) Error() string {
+	return s.cause.Error()
+}
+
+// Unwrap returns the original error
+func (s StorageError) Unwrap() error {
+	return s.cause
+}
+
+// KindOf returns the kind of a storage failure, KindUnknown for any other error
+func KindOf(err error) ErrorKind {
+	var storageError StorageError
+	if errors.As(err, &storageError) {
+		return storageError.Kind
+	}
+
+	return KindUnknown
+}
+
+// Postgres error codes to map.
+// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgUniqueViolation           = "23505"
+	pgForeignKeyViolation       = "23503"
+	pgCheckViolation            = "23514"
+	pgNotNullViolation          = "23502"
+	pgInvalidTextRepresentation = "22P02"
+	pgRaiseException            = "P0001"
+)
+
+// mapError classifies a postgres (or pgx) error. Nil remains nil
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var storageError StorageError
+	if errors.As(err, &storageError) {
+		return err
+	}
+
+	kind := KindUnknown
+	var pgError *pgconn.PgError
+	var connectError *pgconn.ConnectError
+	if errors.As(err, &pgError) {
+		switch pgError.Code {
+		case pgUniqueViolation:
+			kind = KindConflict
+		case pgForeignKeyViolation:
+			kind = KindConflict
+		case pgCheckViolation, pgNotNullViolation, pgInvalidTextRepresentation:
+			kind = KindInvalid
+		case pgRaiseException:
+			kind = mapRaisedException(pgError.Message)
+		}
+	} else if errors.Is(err, pgx.ErrNoRows) {
+		kind = KindNotFound
+	} else if errors.As(err, &connectError) {
+		kind = KindUnavailable
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		kind = KindUnavailable
+	}
+
+	return StorageError{Kind: kind, cause: err}
+}
+
+// mapRaisedException classifies exceptions raised by procedures (see sql/ folder)
+func mapRaisedException(message string) ErrorKind {
+	switch {
+	case strings.HasPrefix(message, "no user matching"),
+		strings.HasPrefix(message, "no user found"),
+		strings.HasPrefix(message, "no creator matching"),
+		strings.HasPrefix(message, "no service account matching"),
+		strings.HasPrefix(message, "no feature matching"),
+		strings.HasPrefix(message, "group ") && strings.HasSuffix(message, "does not exist"):
+		return KindNotFound
+	case strings.HasSuffix(message, "already exists"):
+		return KindConflict
+	case strings.HasPrefix(message, "no matching role"),
+		strings.HasPrefix(message, "invalid operation"),
+		strings.HasPrefix(message, "invalid regex template"):
+		return KindInvalid
+	default:
+		return KindUnknown
+	}
+}
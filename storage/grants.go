@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// GRANTS_PREFIX prefixes shared cache keys of grants, per generation, kind and user
+const GRANTS_PREFIX = "grants:"
+
+// GRANTS_GENERATION_KEY is the shared cache key of the grants generation. Changing it invalidates grants of all users
+const GRANTS_GENERATION_KEY = "grants:generation"
+
+// GRANTS_CHANNEL is the pub/sub channel of grants invalidations: an user login, or GRANTS_ALL_USERS
+const GRANTS_CHANNEL = "grants:invalidations"
+
+// GRANTS_ALL_USERS is the invalidation message for all users
+const GRANTS_ALL_USERS = "*"
+
+// GRANTS_CACHE_DELAY is the time grants remain in the shared cache
+const GRANTS_CACHE_DELAY = 5 * time.Minute
+
+// GRANTS_LOCAL_DELAY is the time grants remain in process, in case an invalidation message is lost
+const GRANTS_LOCAL_DELAY = time.Minute
+
+// GRANTS_LOCAL_SIZE is the maximum number of grants kept in process
+const GRANTS_LOCAL_SIZE = 1024
+
+// kinds of cached grants
+const (
+	grantsKindAccess = "access"
+	grantsKindRoles  = "roles"
+)
+
+// grantsCache keeps grants in process, and listens to invalidations from other instances
+type grantsCache struct {
+	// local has decoded grants, per kind and user
+	local *LRUCache
+	// shared publishes invalidations, nil for a single instance
+	shared *CacheStorage
+	// resources are forgotten with grants of all users, since they define grants too
+	resources *resourcesCache
+	// stop ends the invalidations subscription
+	stop context.CancelFunc
+}
+
+// newGrantsCache builds the grants cache, and subscribes to invalidations if there is a shared cache
+func newGrantsCache(shared *CacheStorage, resources *resourcesCache) *grantsCache {
+	result := &grantsCache{local: NewLRUCache(GRANTS_LOCAL_SIZE, GRANTS_LOCAL_DELAY), shared: shared, resources: resources, stop: func() {}}
+	if shared != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		result.stop = cancel
+		shared.Subscribe(ctx, GRANTS_CHANNEL, result.forget)
+	}
+
+	return result
+}
+
+// forget removes grants of an user (or all users, and then resources) from the process
+func (g *grantsCache) forget(login string) {
+	if login == GRANTS_ALL_USERS {
+		g.local.Clear()
+		g.resources.forget()
+		return
+	}
+
+	g.local.Delete(grantsKindAccess + ":" + login)
+	g.local.Delete(grantsKindRoles + ":" + login)
+}
+
+// cachedGrants returns grants of that kind for that user: from process, from shared cache, or loaded (and then cached)
+func cachedGrants[T any](d *Dao, ctx context.Context, kind, login string, load func() (T, error)) (T, error) {
+	localKey := kind + ":" + login
+	if value, found := d.grants.local.Get(localKey); found {
+		return value.(T), nil
+	}
+
+	var result T
+	sharedKey := d.grantsKey(ctx, kind, login)
+	if content, err := d.cache.GetValue(ctx, sharedKey); err == nil {
+		if err := json.Unmarshal(content, &result); err == nil {
+			d.grants.local.Set(localKey, result)
+			return result, nil
+		}
+	} else if !errors.Is(err, ErrCacheMiss) {
+		d.logger.Println("DAO: ERROR", err)
+	}
+
+	result, err := load()
+	if err != nil {
+		return result, err
+	} else if content, err := json.Marshal(result); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	} else if err := d.cache.SetValueFor(ctx, sharedKey, content, GRANTS_CACHE_DELAY); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	}
+
+	d.grants.local.Set(localKey, result)
+	return result, nil
+}
+
+// grantsKey returns the shared cache key of grants of that kind for that user, in current generation
+func (d *Dao) grantsKey(ctx context.Context, kind, login string) string {
+	generation := "0"
+	if value, err := d.cache.GetValue(ctx, GRANTS_GENERATION_KEY); err == nil {
+		generation = string(value)
+	} else if !errors.Is(err, ErrCacheMiss) {
+		d.logger.Println("DAO: ERROR", err)
+	}
+
+	return GRANTS_PREFIX + generation + ":" + kind + ":" + login
+}
+
+// GetUserGrantedAccess returns, for a user, all the rules conditions to access a resource
+func (d *Dao) GetUserGrantedAccess(ctx context.Context, user string) ([]dto.GrantAccessForResource, error) {
+	return cachedGrants(d, ctx, grantsKindAccess, user, func() ([]dto.GrantAccessForResource, error) {
+		if resp, err := d.rdb.GetUserGrantedAccess(ctx, user); err != nil {
+			d.logger.Println("DAO: ERROR", err)
+			return nil, mapError(err)
+		} else {
+			return resp, nil
+		}
+	})
+}
+
+// GetUserRolesPerFeature returns, for each resources group, all roles for that group that the user was granted
+func (d *Dao) GetUserRolesPerFeature(ctx context.Context, username string) (map[string][]dto.GrantRole, error) {
+	return cachedGrants(d, ctx, grantsKindRoles, username, func() (map[string][]dto.GrantRole, error) {
+		if resp, err := d.rdb.GetUserRolesPerFeature(ctx, username); err != nil {
+			d.logger.Println("DAO: ERROR", err)
+			return nil, mapError(err)
+		} else {
+			return resp, nil
+		}
+	})
+}
+
+// invalidateAccess forgets cached grants and permissions version of an user, in all instances.
+// Failures are only logged: values expire from caches anyway
+func (d *Dao) invalidateAccess(ctx context.Context, login string) {
+	d.invalidatePermissions(ctx, login)
+	d.grants.forget(login)
+	for _, kind := range []string{grantsKindAccess, grantsKindRoles} {
+		if err := d.cache.Delete(ctx, d.grantsKey(ctx, kind, login)); err != nil {
+			d.logger.Println("DAO: ERROR", err)
+		}
+	}
+
+	d.publishInvalidation(ctx, login)
+}
+
+// invalidateAllAccess forgets cached grants of all users, in all instances
+func (d *Dao) invalidateAllAccess(ctx context.Context) {
+	d.grants.forget(GRANTS_ALL_USERS)
+	// new generation: previous keys are not read anymore, and expire
+	if _, err := d.cache.Increment(ctx, GRANTS_GENERATION_KEY, 30*24*time.Hour); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	}
+
+	d.publishInvalidation(ctx, GRANTS_ALL_USERS)
+}
+
+// publishInvalidation tells other instances to forget grants of that user (or all users)
+func (d *Dao) publishInvalidation(ctx context.Context, login string) {
+	if d.grants.shared == nil {
+		return
+	} else if err := d.grants.shared.Publish(ctx, GRANTS_CHANNEL, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	}
+}
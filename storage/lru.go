@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruEntry is a value in the LRU cache
+type lruEntry struct {
+	key        string
+	value      any
+	expiration time.Time
+}
+
+// LRUCache is an in-process cache of decoded values, bounded in size: least recently used values are evicted first.
+// Values are shared with callers, and should not be changed
+type LRUCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	// order has most recently used entries first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewLRUCache builds an empty LRU cache with that many values at most, each one valid for ttl
+func NewLRUCache(capacity int, ttl time.Duration) *LRUCache {
+	return &LRUCache{capacity: max(capacity, 1), ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get returns the value at key, and false if there is no valid value
+func (l *LRUCache) Get(key string) (any, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if element, found := l.entries[key]; !found {
+		return nil, false
+	} else if entry := element.Value.(*lruEntry); !entry.expiration.After(time.Now()) {
+		l.order.Remove(element)
+		delete(l.entries, key)
+		return nil, false
+	} else {
+		l.order.MoveToFront(element)
+		return entry.value, true
+	}
+}
+
+// Set sets value at key, and evicts the least recently used value if cache is full
+func (l *LRUCache) Set(key string, value any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	expiration := time.Now().Add(l.ttl)
+	if element, found := l.entries[key]; found {
+		element.Value = &lruEntry{key: key, value: value, expiration: expiration}
+		l.order.MoveToFront(element)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value, expiration: expiration})
+	if l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Delete removes the value at key, if any
+func (l *LRUCache) Delete(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if element, found := l.entries[key]; found {
+		l.order.Remove(element)
+		delete(l.entries, key)
+	}
+}
+
+// Clear removes all the values
+func (l *LRUCache) Clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.order.Init()
+	clear(l.entries)
+}
+
+// Len returns the number of values, including expired ones not evicted yet
+func (l *LRUCache) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.order.Len()
+}
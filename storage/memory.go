@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryEntry is a value in the memory cache
+type memoryEntry struct {
+	value      []byte
+	expiration time.Time
+}
+
+// memoryPurgeDelay is the minimum delay between two purges of expired values
+const memoryPurgeDelay = time.Minute
+
+// MemoryCache is an in-process key value cache, to use when no shared cache is available
+type MemoryCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	entries   map[string]memoryEntry
+	lastPurge time.Time
+}
+
+// NewMemoryCache builds an empty memory cache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{ttl: time.Hour * 24, entries: make(map[string]memoryEntry)}
+}
+
+// SetValue sets value in the cache
+func (m *MemoryCache) SetValue(context context.Context, key string, value []byte) error {
+	return m.SetValueFor(context, key, value, m.ttl)
+}
+
+// SetValueFor sets value in the cache for that time to live
+func (m *MemoryCache) SetValueFor(context context.Context, key string, value []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.purge(now)
+	copied := make([]byte, len(value))
+	copy(copied, value)
+	m.entries[key] = memoryEntry{value: copied, expiration: now.Add(ttl)}
+	return nil
+}
+
+// Increment adds one to the counter at key, and returns the new value.
+// Time to live is set when the counter is created, so that the counter expires ttl after its first increment
+func (m *MemoryCache) Increment(context context.Context, key string, ttl time.Duration) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.purge(now)
+	var counter int64
+	expiration := now.Add(ttl)
+	if entry, found := m.entries[key]; found && entry.expiration.After(now) {
+		counter, _ = strconv.ParseInt(string(entry.value), 10, 64)
+		expiration = entry.expiration
+	}
+
+	counter++
+	m.entries[key] = memoryEntry{value: []byte(strconv.FormatInt(counter, 10)), expiration: expiration}
+	return counter, nil
+}
+
+// purge deletes expired values, at most once per memoryPurgeDelay. Caller should hold the lock
+func (m *MemoryCache) purge(now time.Time) {
+	if now.Sub(m.lastPurge) < memoryPurgeDelay {
+		return
+	}
+
+	m.lastPurge = now
+	for key, entry := range m.entries {
+		if !entry.expiration.After(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// Has returns true if the key is stored in the cache
+func (m *MemoryCache) Has(ctx context.Context, key string) (bool, error) {
+	_, err := m.GetValue(ctx, key)
+	if err == ErrCacheMiss {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// GetValue gets value by key
+func (m *MemoryCache) GetValue(context context.Context, key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if entry, found := m.entries[key]; !found {
+		return nil, ErrCacheMiss
+	} else if !entry.expiration.After(time.Now()) {
+		delete(m.entries, key)
+		return nil, ErrCacheMiss
+	} else {
+		return entry.value, nil
+	}
+}
+
+// Delete a value in the cache by key
+func (m *MemoryCache) Delete(context context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// MFA_USED_CODE_PREFIX prefixes cache keys of TOTP codes already used, per user and time step
+const MFA_USED_CODE_PREFIX = "mfa:used:"
+
+// SetPendingMFA sets a new TOTP secret for an user. Secret is not enabled until EnableMFA
+func (d *Dao) SetPendingMFA(ctx context.Context, login, secret string) error {
+	if err := d.rdb.SetPendingMFA(ctx, login, secret); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// GetMFA returns the TOTP secret of an user (empty for none) and true if secret is enabled
+func (d *Dao) GetMFA(ctx context.Context, login string) (string, bool, error) {
+	if secret, enabled, err := d.rdb.GetMFA(ctx, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return "", false, mapError(err)
+	} else {
+		return secret, enabled, nil
+	}
+}
+
+// EnableMFA enables the pending secret of an user, and replaces recovery codes with those hashes
+func (d *Dao) EnableMFA(ctx context.Context, login string, codeHashes [][]byte) error {
+	if err := d.rdb.EnableMFA(ctx, login, codeHashes); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// DisableMFA removes the second factor of an user
+func (d *Dao) DisableMFA(ctx context.Context, login string) error {
+	if err := d.rdb.DisableMFA(ctx, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// ConsumeRecoveryCode uses a recovery code of an user, and returns true if code was valid (and then deleted)
+func (d *Dao) ConsumeRecoveryCode(ctx context.Context, login string, codeHash []byte) (bool, error) {
+	if valid, err := d.rdb.ConsumeRecoveryCode(ctx, login, codeHash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else {
+		return valid, nil
+	}
+}
+
+// MarkTOTPCodeUsed registers that an user used the code of a time step, and returns false if it was already used.
+// Marks expire once code is no longer valid anyway
+func (d *Dao) MarkTOTPCodeUsed(ctx context.Context, login string, step int64, validity time.Duration) (bool, error) {
+	key := MFA_USED_CODE_PREFIX + login + ":" + strconv.FormatInt(step, 10)
+	if counter, err := d.cache.Increment(ctx, key, validity); err != nil {
+		return false, err
+	} else {
+		return counter == 1, nil
+	}
+}
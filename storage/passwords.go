@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hashing algorithms
+const (
+	HASHING_ARGON2ID = "argon2id"
+	HASHING_BCRYPT   = "bcrypt"
+)
+
+// Argon2Parameters are the cost parameters of argon2id, as in the PHC string
+type Argon2Parameters struct {
+	// Memory in KiB
+	Memory uint32
+	// Iterations is the number of passes over memory
+	Iterations uint32
+	// Parallelism is the number of threads
+	Parallelism uint8
+	// SaltLength is the length of the random salt, in bytes
+	SaltLength uint32
+	// KeyLength is the length of the hash, in bytes
+	KeyLength uint32
+}
+
+// DefaultArgon2Parameters follow the OWASP recommendations (19 MiB, 2 iterations, 1 thread)
+var DefaultArgon2Parameters = Argon2Parameters{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// DEFAULT_BCRYPT_COST is the cost for bcrypt hashes
+const DEFAULT_BCRYPT_COST = 12
+
+// legacyHashLength is the length of a legacy (unsalted sha256) hash
+const legacyHashLength = sha256.Size
+
+// PasswordHasher hashes passwords with a salted adaptive algorithm, and verifies hashes of any supported algorithm.
+// Hashes are strings in the PHC format (for instance $argon2id$v=19$m=19456,t=2,p=1$salt$hash), or bcrypt format
+type PasswordHasher struct {
+	// algorithm for new hashes
+	algorithm string
+	// argon2 are the parameters for new argon2id hashes
+	argon2 Argon2Parameters
+	// bcryptCost is the cost for new bcrypt hashes
+	bcryptCost int
+	// decoy is a hash to verify when user does not exist, so that response time does not leak user existence
+	decoy []byte
+}
+
+// NewPasswordHasher builds a hasher for that algorithm (argon2id if empty) with default parameters
+func NewPasswordHasher(algorithm string) (*PasswordHasher, error) {
+	if algorithm == "" {
+		algorithm = HASHING_ARGON2ID
+	} else if algorithm != HASHING_ARGON2ID && algorithm != HASHING_BCRYPT {
+		return nil, fmt.Errorf("unsupported password hashing %s", algorithm)
+	}
+
+	result := &PasswordHasher{algorithm: algorithm, argon2: DefaultArgon2Parameters, bcryptCost: DEFAULT_BCRYPT_COST}
+	if decoy, err := result.Hash(rand.Text()); err != nil {
+		return nil, err
+	} else {
+		result.decoy = []byte(decoy)
+	}
+
+	return result, nil
+}
+
+// Hash returns the hash of a password, with a random salt, as a PHC string
+func (p *PasswordHasher) Hash(password string) (string, error) {
+	if p.algorithm == HASHING_BCRYPT {
+		value, err := bcrypt.GenerateFromPassword([]byte(password), p.bcryptCost)
+		return string(value), err
+	}
+
+	salt := make([]byte, p.argon2.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	params := p.argon2
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// Verify compares a password with a stored hash, in constant time.
+// Result is true for a match, and rehash is true if hash should be replaced (legacy hash, other algorithm or weaker parameters)
+func (p *PasswordHasher) Verify(stored []byte, password string) (bool, bool, error) {
+	value := string(stored)
+	switch {
+	case strings.HasPrefix(value, "$argon2id$"):
+		if params, salt, key, err := parseArgon2(value); err != nil {
+			return false, false, err
+		} else {
+			computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+			matches := subtle.ConstantTimeCompare(computed, key) == 1
+			rehash := p.algorithm != HASHING_ARGON2ID || params.Memory < p.argon2.Memory ||
+				params.Iterations < p.argon2.Iterations || params.Parallelism < p.argon2.Parallelism
+			return matches, matches && rehash, nil
+		}
+	case strings.HasPrefix(value, "$2a$") || strings.HasPrefix(value, "$2b$") || strings.HasPrefix(value, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword(stored, []byte(password)); errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		} else if cost, err := bcrypt.Cost(stored); err != nil {
+			return false, false, err
+		} else {
+			return true, p.algorithm != HASHING_BCRYPT || cost < p.bcryptCost, nil
+		}
+	case len(stored) == legacyHashLength:
+		// legacy unsalted sha256, always to replace
+		hash := sha256.Sum256([]byte(password))
+		matches := subtle.ConstantTimeCompare(hash[:], stored) == 1
+		return matches, matches, nil
+	default:
+		return false, false, errors.New("unsupported password hash format")
+	}
+}
+
+// VerifyDecoy spends the same time as a verification, for unknown users
+func (p *PasswordHasher) VerifyDecoy(password string) {
+	p.Verify(p.decoy, password)
+}
+
+// parseArgon2 parses an argon2id PHC string into parameters, salt and key
+func parseArgon2(value string) (Argon2Parameters, []byte, []byte, error) {
+	var params Argon2Parameters
+	var version int
+	parts := strings.Split(value, "$")
+	// parts are: empty, argon2id, v=19, m=...,t=...,p=..., salt, key
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	} else if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	} else if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	} else if salt, err := base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id salt")
+	} else if key, err := base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id hash value")
+	} else {
+		params.SaltLength = uint32(len(salt))
+		params.KeyLength = uint32(len(key))
+		return params, salt, key, nil
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// PERMISSIONS_VERSION_PREFIX prefixes cache keys of permissions versions, per user
+const PERMISSIONS_VERSION_PREFIX = "permissions:version:"
+
+// PERMISSIONS_VERSION_DELAY is the time a permissions version remains in cache.
+// Changes made by the dao are seen at once by all instances sharing the cache (only by that instance if shared cache is down).
+// Changes made directly in database are seen within that delay
+const PERMISSIONS_VERSION_DELAY = time.Minute
+
+// RESOURCES_RELOAD_DELAY is the time resources remain in memory before reloading them
+const RESOURCES_RELOAD_DELAY = time.Minute
+
+// resourcesCache keeps the protected resources in memory
+type resourcesCache struct {
+	// lock protects the values
+	lock sync.RWMutex
+	// values are the resources, as loaded
+	values []dto.Resource
+	// loadedAt is the last loading time, zero for never
+	loadedAt time.Time
+}
+
+// GetPermissionsVersion returns the permissions version of an user (-1 for no user), changed each time grants of that user change.
+// Version is read from the cache, and from the database on a cache miss
+func (d *Dao) GetPermissionsVersion(ctx context.Context, login string) (int64, error) {
+	key := PERMISSIONS_VERSION_PREFIX + login
+	if value, err := d.cache.GetValue(ctx, key); err == nil {
+		if version, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			return version, nil
+		}
+	} else if !errors.Is(err, ErrCacheMiss) {
+		d.logger.Println("DAO: ERROR", err)
+	}
+
+	version, err := d.rdb.GetPermissionsVersion(ctx, login)
+	if err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return 0, mapError(err)
+	} else if err := d.cache.SetValueFor(ctx, key, []byte(strconv.FormatInt(version, 10)), PERMISSIONS_VERSION_DELAY); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	}
+
+	return version, nil
+}
+
+// GetCachedResources returns the protected resources, kept in memory for RESOURCES_RELOAD_DELAY
+func (d *Dao) GetCachedResources(ctx context.Context) ([]dto.Resource, error) {
+	d.resources.lock.RLock()
+	values, loadedAt := d.resources.values, d.resources.loadedAt
+	d.resources.lock.RUnlock()
+	if !loadedAt.IsZero() && time.Since(loadedAt) < RESOURCES_RELOAD_DELAY {
+		return values, nil
+	}
+
+	if values, err := d.GetResources(ctx); err != nil {
+		return nil, err
+	} else {
+		d.resources.lock.Lock()
+		d.resources.values = values
+		d.resources.loadedAt = time.Now()
+		d.resources.lock.Unlock()
+		return values, nil
+	}
+}
+
+// forget forces next read of resources to use the database.
+// Other instances forget them too when told to forget grants of all users
+func (r *resourcesCache) forget() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.loadedAt = time.Time{}
+}
+
+// invalidatePermissions forces next permissions version read of an user to use the database.
+// Failure is only logged: version expires from cache anyway
+func (d *Dao) invalidatePermissions(ctx context.Context, login string) {
+	if err := d.cache.Delete(ctx, PERMISSIONS_VERSION_PREFIX+login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	}
+}
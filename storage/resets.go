@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// SetUserEmail sets the email of an user, empty to remove it
+func (d *Dao) SetUserEmail(ctx context.Context, login, email string) error {
+	if err := d.rdb.SetUserEmail(ctx, login, email); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// GetUserEmail returns the email of an user, empty if user does not exist or has no email
+func (d *Dao) GetUserEmail(ctx context.Context, login string) (string, error) {
+	if email, err := d.rdb.GetUserEmail(ctx, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return "", mapError(err)
+	} else {
+		return email, nil
+	}
+}
+
+// AddPasswordReset stores the hash of a password reset token for an user, valid until expiration.
+// Previous reset tokens of that user are no longer valid
+func (d *Dao) AddPasswordReset(ctx context.Context, login string, tokenHash []byte, expiration time.Time) error {
+	if err := d.rdb.AddPasswordReset(ctx, login, tokenHash, expiration); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// ConsumePasswordReset returns the user of a password reset token, and deletes the token so that it is used once.
+// User is empty if token is unknown or expired
+func (d *Dao) ConsumePasswordReset(ctx context.Context, tokenHash []byte) (string, error) {
+	if login, err := d.rdb.ConsumePasswordReset(ctx, tokenHash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return "", mapError(err)
+	} else {
+		return login, nil
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// ResilientCache uses a shared cache (redis) when available, and an in-process cache otherwise.
+// Values are written in process only when shared cache is down, so that a change made by any instance is seen by all when it is up.
+// Reads fall back to the in-process cache, to keep values written when shared cache was down
+type ResilientCache struct {
+	// shared is the shared cache, may be nil
+	shared *CacheStorage
+	// local is the in-process cache
+	local *MemoryCache
+	// logger to report shared cache failures
+	logger *log.Logger
+}
+
+// NewResilientCache builds a cache over a shared one (nil for no shared cache)
+func NewResilientCache(shared *CacheStorage, logger *log.Logger) *ResilientCache {
+	return &ResilientCache{shared: shared, local: NewMemoryCache(), logger: logger}
+}
+
+// sharedFailure logs a failure of the shared cache
+func (r *ResilientCache) sharedFailure(err error) {
+	r.logger.Println("CACHE: shared cache failure, using local cache:", err)
+}
+
+// SetValue sets value in the caches
+func (r *ResilientCache) SetValue(ctx context.Context, key string, value []byte) error {
+	return r.SetValueFor(ctx, key, value, r.local.ttl)
+}
+
+// SetValueFor sets value in shared cache for that time to live, or in local cache if shared one is down
+func (r *ResilientCache) SetValueFor(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if r.shared != nil {
+		if err := r.shared.SetValueFor(ctx, key, value, ttl); err == nil {
+			return nil
+		} else {
+			r.sharedFailure(err)
+		}
+	}
+
+	return r.local.SetValueFor(ctx, key, value, ttl)
+}
+
+// Increment increments counter in shared cache, or in local cache if shared one is down
+func (r *ResilientCache) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	if r.shared != nil {
+		if value, err := r.shared.Increment(ctx, key, ttl); err == nil {
+			return value, nil
+		} else {
+			r.sharedFailure(err)
+		}
+	}
+
+	return r.local.Increment(ctx, key, ttl)
+}
+
+// Has returns true if any cache has the key
+func (r *ResilientCache) Has(ctx context.Context, key string) (bool, error) {
+	if r.shared != nil {
+		if found, err := r.shared.Has(ctx, key); err != nil {
+			r.sharedFailure(err)
+		} else if found {
+			return true, nil
+		}
+	}
+
+	return r.local.Has(ctx, key)
+}
+
+// GetValue gets value from shared cache, or from local cache if shared one has no value (written when it was down) or is down
+func (r *ResilientCache) GetValue(ctx context.Context, key string) ([]byte, error) {
+	if r.shared != nil {
+		if value, err := r.shared.GetValue(ctx, key); err == nil {
+			return value, nil
+		} else if !errors.Is(err, ErrCacheMiss) {
+			r.sharedFailure(err)
+		}
+	}
+
+	return r.local.GetValue(ctx, key)
+}
+
+// Delete deletes the key in all caches
+func (r *ResilientCache) Delete(ctx context.Context, key string) error {
+	r.local.Delete(ctx, key)
+	if r.shared != nil {
+		if err := r.shared.Delete(ctx, key); err != nil {
+			r.sharedFailure(err)
+		}
+	}
+
+	return nil
+}
+
+// StrictDelete deletes the key in all caches, and returns the error of the shared cache if any.
+// Use it when other instances should see the deletion, for instance to lift a lockout
+func (r *ResilientCache) StrictDelete(ctx context.Context, key string) error {
+	r.local.Delete(ctx, key)
+	if r.shared != nil {
+		return r.shared.Delete(ctx, key)
+	}
+
+	return nil
+}
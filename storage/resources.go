@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// CreateResource adds a resource in an existing feature, and returns its id.
+// Resources define grants: cached grants and resources are invalidated
+func (d *Dao) CreateResource(ctx context.Context, resource dto.Resource) (int, error) {
+	id, err := d.rdb.CreateResource(ctx, resource)
+	if err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return 0, mapError(err)
+	}
+
+	d.invalidateAllAccess(ctx)
+	return id, nil
+}
+
+// UpdateResource changes a resource (found by its id), and returns false if there is no such resource
+func (d *Dao) UpdateResource(ctx context.Context, resource dto.Resource) (bool, error) {
+	updated, err := d.rdb.UpdateResource(ctx, resource)
+	if err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else if updated {
+		d.invalidateAllAccess(ctx)
+	}
+
+	return updated, nil
+}
+
+// DeleteResource deletes a resource, and returns false if there is no such resource
+func (d *Dao) DeleteResource(ctx context.Context, id int) (bool, error) {
+	deleted, err := d.rdb.DeleteResource(ctx, id)
+	if err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else if deleted {
+		d.invalidateAllAccess(ctx)
+	}
+
+	return deleted, nil
+}
+
+// ListFeatures returns the features with their number of resources, ordered by name
+func (d *Dao) ListFeatures(ctx context.Context) ([]dto.Feature, error) {
+	if resp, err := d.rdb.ListFeatures(ctx); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// UpsertFeature creates or changes a feature, and applies its MFA policy to its resources.
+// Nil policy keeps the current one (no MFA for a new feature)
+func (d *Dao) UpsertFeature(ctx context.Context, name, description string, requiresMFA *bool) error {
+	if err := d.rdb.UpsertFeature(ctx, name, description, requiresMFA); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	d.invalidateAllAccess(ctx)
+	return nil
+}
+
+// DeleteFeature deletes a feature with no resource (and grants on it), and returns false if there is no such feature
+func (d *Dao) DeleteFeature(ctx context.Context, name string) (bool, error) {
+	deleted, err := d.rdb.DeleteFeature(ctx, name)
+	if err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else if deleted {
+		d.invalidateAllAccess(ctx)
+	}
+
+	return deleted, nil
+}
+
+// GetUserGrantedResources returns, per resource id, the roles of an user on that resource (with implied roles).
+// It reads the database, to explain access decisions
+func (d *Dao) GetUserGrantedResources(ctx context.Context, login string) (map[int][]dto.GrantRole, error) {
+	if resp, err := d.rdb.GetUserGrantedResources(ctx, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// GetAllRolesPerFeature returns, for each user login, the roles granted per feature.
+// It reads the database, to simulate resources changes
+func (d *Dao) GetAllRolesPerFeature(ctx context.Context) (map[string]map[string][]dto.GrantRole, error) {
+	if resp, err := d.rdb.GetAllRolesPerFeature(ctx); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// REVOKED_TOKEN_PREFIX prefixes cache keys of revoked token ids
+const REVOKED_TOKEN_PREFIX = "revoked:token:"
+
+// REVOKED_USER_PREFIX prefixes cache keys of users whose tokens issued before a given time are revoked
+const REVOKED_USER_PREFIX = "revoked:user:"
+
+// AddRefreshToken stores the hash of a refresh token for an user, valid until expiration.
+// Flag mfa is true if session was opened with a second factor
+func (d *Dao) AddRefreshToken(ctx context.Context, login string, tokenHash []byte, expiration time.Time, mfa bool) error {
+	if err := d.rdb.AddRefreshToken(ctx, login, tokenHash, expiration, mfa); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// ConsumeRefreshToken returns the user of a refresh token and if session was opened with MFA, and deletes the token so that it is used once.
+// User is empty if token is unknown or expired
+func (d *Dao) ConsumeRefreshToken(ctx context.Context, tokenHash []byte) (string, bool, error) {
+	if login, mfa, err := d.rdb.ConsumeRefreshToken(ctx, tokenHash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return "", false, mapError(err)
+	} else {
+		return login, mfa, nil
+	}
+}
+
+// DeleteRefreshToken deletes a refresh token, if any
+func (d *Dao) DeleteRefreshToken(ctx context.Context, tokenHash []byte) error {
+	if err := d.rdb.DeleteRefreshToken(ctx, tokenHash); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// RevokeToken adds a token id to the denylist until the token expires
+func (d *Dao) RevokeToken(ctx context.Context, tokenId string, expiration time.Time) error {
+	if remaining := time.Until(expiration); remaining <= 0 {
+		// token is expired anyway
+		return nil
+	} else {
+		return d.cache.SetValueFor(ctx, REVOKED_TOKEN_PREFIX+tokenId, []byte{1}, remaining)
+	}
+}
+
+// RevokeUserTokens revokes all the tokens of an user: refresh tokens are deleted,
+// and access tokens issued so far are denied until they expire (after maxDuration at most)
+func (d *Dao) RevokeUserTokens(ctx context.Context, login string, maxDuration time.Duration) error {
+	if err := d.rdb.DeleteUserRefreshTokens(ctx, login); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return d.cache.SetValueFor(ctx, REVOKED_USER_PREFIX+login, []byte(now), maxDuration)
+}
+
+// IsTokenRevoked returns true if token id is in the denylist, or if user's tokens issued at that time were revoked
+func (d *Dao) IsTokenRevoked(ctx context.Context, tokenId, login string, issuedAt time.Time) (bool, error) {
+	if revoked, err := d.cache.Has(ctx, REVOKED_TOKEN_PREFIX+tokenId); err != nil || revoked {
+		return revoked, err
+	} else if value, err := d.cache.GetValue(ctx, REVOKED_USER_PREFIX+login); err == ErrCacheMiss {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if revokedAt, err := strconv.ParseInt(string(value), 10, 64); err != nil {
+		return false, err
+	} else {
+		// strictly before, so that user may log in again right after revocation
+		return issuedAt.Unix() < revokedAt, nil
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// ROLES_CHANNEL is the pub/sub channel to tell other instances that roles changed
+const ROLES_CHANNEL = "roles:changes"
+
+// LoadRoles reads roles from database, and makes them the known roles (see dto.SetKnownRoles)
+func (d *Dao) LoadRoles(ctx context.Context) error {
+	if roles, err := d.rdb.ListRoles(ctx); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	} else {
+		dto.SetKnownRoles(roles)
+		return nil
+	}
+}
+
+// WatchRoles reloads roles when another instance changes them, and every period anyway, until context is done
+func (d *Dao) WatchRoles(ctx context.Context, period time.Duration) {
+	reload := func() {
+		if err := d.LoadRoles(ctx); err != nil {
+			d.logger.Println("DAO: failed to reload roles:", err)
+		}
+	}
+
+	if d.grants.shared != nil {
+		d.grants.shared.Subscribe(ctx, ROLES_CHANNEL, func(string) { reload() })
+	}
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reload()
+			}
+		}
+	}()
+}
+
+// ListRoles returns the roles and the roles each one implies directly, ordered by name
+func (d *Dao) ListRoles(ctx context.Context) ([]dto.Role, error) {
+	if resp, err := d.rdb.ListRoles(ctx); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// UpsertRole creates or changes a role that is not built-in, and sets the roles it implies
+func (d *Dao) UpsertRole(ctx context.Context, role dto.Role) error {
+	if err := d.rdb.UpsertRole(ctx, role); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	d.rolesChanged(ctx)
+	return nil
+}
+
+// DeleteRole deletes a role that is not built-in and not used, and returns false if there is no such role
+func (d *Dao) DeleteRole(ctx context.Context, name string) (bool, error) {
+	deleted, err := d.rdb.DeleteRole(ctx, name)
+	if err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else if deleted {
+		d.rolesChanged(ctx)
+	}
+
+	return deleted, nil
+}
+
+// rolesChanged reloads roles, and tells other instances to reload them too.
+// Hierarchy changes grants of users: cached grants are invalidated
+func (d *Dao) rolesChanged(ctx context.Context) {
+	if err := d.LoadRoles(ctx); err != nil {
+		d.logger.Println("DAO: failed to reload roles:", err)
+	}
+
+	d.invalidateAllAccess(ctx)
+	if d.grants.shared == nil {
+		return
+	} else if err := d.grants.shared.Publish(ctx, ROLES_CHANNEL, ""); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+	}
+}
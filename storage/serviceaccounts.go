@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/dto"
+)
+
+// ASSERTION_USED_PREFIX prefixes cache keys of client assertions already used, per service account and assertion id
+const ASSERTION_USED_PREFIX = "assertion:used:"
+
+// CreateServiceAccount creates a service account with no credential and no role
+func (d *Dao) CreateServiceAccount(ctx context.Context, name string) error {
+	if err := d.rdb.CreateServiceAccount(ctx, name); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// DeleteServiceAccount deletes a service account, and returns false if there is no such service account
+func (d *Dao) DeleteServiceAccount(ctx context.Context, name string) (bool, error) {
+	if deleted, err := d.rdb.DeleteServiceAccount(ctx, name); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else {
+		d.invalidateAccess(ctx, name)
+		return deleted, nil
+	}
+}
+
+// ListServiceAccounts returns the service accounts and their credentials (with no material)
+func (d *Dao) ListServiceAccounts(ctx context.Context) ([]dto.ServiceAccount, error) {
+	if resp, err := d.rdb.ListServiceAccounts(ctx); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// AddServiceCredential adds a credential to a service account
+func (d *Dao) AddServiceCredential(ctx context.Context, name string, credential dto.ServiceCredential) error {
+	if err := d.rdb.AddServiceCredential(ctx, name, credential); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
+
+// GetServiceCredentials returns the valid credentials of a service account, with their material.
+// Result is empty for unknown accounts and for humans
+func (d *Dao) GetServiceCredentials(ctx context.Context, name string) ([]dto.ServiceCredential, error) {
+	if resp, err := d.rdb.GetServiceCredentials(ctx, name); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return nil, mapError(err)
+	} else {
+		return resp, nil
+	}
+}
+
+// DeleteServiceCredential revokes a credential of a service account, and returns false if there is no such credential
+func (d *Dao) DeleteServiceCredential(ctx context.Context, name, id string) (bool, error) {
+	if deleted, err := d.rdb.DeleteServiceCredential(ctx, name, id); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return false, mapError(err)
+	} else {
+		return deleted, nil
+	}
+}
+
+// MarkAssertionUsed registers that a service account used an assertion, and returns false if it was already used.
+// Marks expire once assertion is expired anyway
+func (d *Dao) MarkAssertionUsed(ctx context.Context, name, assertionId string, validity time.Duration) (bool, error) {
+	if counter, err := d.cache.Increment(ctx, ASSERTION_USED_PREFIX+name+":"+assertionId, validity); err != nil {
+		return false, err
+	} else {
+		return counter == 1, nil
+	}
+}
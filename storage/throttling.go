@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// LOGIN_FAILURES_PREFIX prefixes cache keys of failed login counters, per subject (user or address)
+const LOGIN_FAILURES_PREFIX = "login:failures:"
+
+// LOGIN_BLOCKED_PREFIX prefixes cache keys of subjects that may not log in until a given time
+const LOGIN_BLOCKED_PREFIX = "login:blocked:"
+
+// CountLoginFailure registers a failed login for a subject (user or address), and returns the number of failures within window
+func (d *Dao) CountLoginFailure(ctx context.Context, subject string, window time.Duration) (int64, error) {
+	return d.cache.Increment(ctx, LOGIN_FAILURES_PREFIX+subject, window)
+}
+
+// BlockLogin prevents a subject from logging in until that time
+func (d *Dao) BlockLogin(ctx context.Context, subject string, until time.Time) error {
+	if remaining := time.Until(until); remaining <= 0 {
+		return nil
+	} else {
+		value := strconv.FormatInt(until.UnixMilli(), 10)
+		return d.cache.SetValueFor(ctx, LOGIN_BLOCKED_PREFIX+subject, []byte(value), remaining)
+	}
+}
+
+// GetLoginBlockedUntil returns the time a subject may log in again, zero time if subject is not blocked
+func (d *Dao) GetLoginBlockedUntil(ctx context.Context, subject string) (time.Time, error) {
+	var result time.Time
+	if value, err := d.cache.GetValue(ctx, LOGIN_BLOCKED_PREFIX+subject); err == ErrCacheMiss {
+		return result, nil
+	} else if err != nil {
+		return result, err
+	} else if millis, err := strconv.ParseInt(string(value), 10, 64); err != nil {
+		return result, err
+	} else if until := time.UnixMilli(millis); until.After(time.Now()) {
+		return until, nil
+	}
+
+	return result, nil
+}
+
+// ClearLoginFailures resets failures of a subject and unblocks it.
+// Shared cache failures are only logged, see UnlockLogin to ensure all instances unblock the subject
+func (d *Dao) ClearLoginFailures(ctx context.Context, subject string) error {
+	if err := d.cache.Delete(ctx, LOGIN_FAILURES_PREFIX+subject); err != nil {
+		return err
+	}
+
+	return d.cache.Delete(ctx, LOGIN_BLOCKED_PREFIX+subject)
+}
+
+// UnlockLogin resets failures of a subject and unblocks it in all instances.
+// Error if shared cache failed: subject may still be blocked on other instances
+func (d *Dao) UnlockLogin(ctx context.Context, subject string) error {
+	if err := d.cache.StrictDelete(ctx, LOGIN_FAILURES_PREFIX+subject); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	} else if err := d.cache.StrictDelete(ctx, LOGIN_BLOCKED_PREFIX+subject); err != nil {
+		d.logger.Println("DAO: ERROR", err)
+		return mapError(err)
+	}
+
+	return nil
+}
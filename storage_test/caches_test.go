@@ -2,7 +2,10 @@ package storage_test
 
 import (
 	"context"
+	"io"
+	"log"
 	"testing"
+	"time"
 
 	"github.com/zefrenchwan/scrutateur.git/storage"
 )
@@ -49,3 +52,114 @@ func TestCacheHas(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestMemoryCacheExpiration(t *testing.T) {
+	cache := storage.NewMemoryCache()
+	if err := cache.SetValueFor(context.Background(), "short", []byte("value"), time.Millisecond); err != nil {
+		t.Log("Set value error", err)
+		t.Fail()
+	} else if err := cache.SetValue(context.Background(), "long", []byte("value")); err != nil {
+		t.Log("Set value error", err)
+		t.Fail()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if found, err := cache.Has(context.Background(), "short"); err != nil || found {
+		t.Log("expired value still in cache", err)
+		t.Fail()
+	} else if _, err := cache.GetValue(context.Background(), "short"); err != storage.ErrCacheMiss {
+		t.Log("expecting cache miss for expired value", err)
+		t.Fail()
+	} else if value, err := cache.GetValue(context.Background(), "long"); err != nil || string(value) != "value" {
+		t.Log("failed to get value", err)
+		t.Fail()
+	}
+}
+
+func TestResilientCacheWithoutSharedCache(t *testing.T) {
+	// shared cache is unreachable: local cache should still work
+	shared, errBoot := storage.NewCacheStorage("redis://127.0.0.1:1/0")
+	if errBoot != nil {
+		t.Log("failed to create cache")
+		t.FailNow()
+	}
+
+	defer shared.Close()
+	cache := storage.NewResilientCache(&shared, log.New(io.Discard, "", 0))
+	if err := cache.SetValueFor(context.Background(), "revoked", []byte("1"), time.Minute); err != nil {
+		t.Log("Set value error", err)
+		t.Fail()
+	} else if found, err := cache.Has(context.Background(), "revoked"); err != nil || !found {
+		t.Log("failed to find value in local cache", err)
+		t.Fail()
+	} else if err := cache.Delete(context.Background(), "revoked"); err != nil {
+		t.Log("Failed to delete", err)
+		t.Fail()
+	} else if found, err := cache.Has(context.Background(), "revoked"); err != nil || found {
+		t.Log("deleted value still in cache", err)
+		t.Fail()
+	}
+}
+
+// newSharedTestCache returns a cache on the test redis, test is skipped if redis is not available
+func newSharedTestCache(t *testing.T) *storage.CacheStorage {
+	cache, errBoot := storage.NewCacheStorage(REDIS_TEST_URL)
+	if errBoot != nil {
+		t.Log("failed to create cache")
+		t.FailNow()
+	} else if _, err := cache.Has(context.Background(), "ping"); err != nil {
+		cache.Close()
+		t.Skip("redis is not available", err)
+	}
+
+	return &cache
+}
+
+func TestResilientCacheInstances(t *testing.T) {
+	// two instances sharing a cache: changes made by one are seen by the other
+	sharedA, sharedB := newSharedTestCache(t), newSharedTestCache(t)
+	defer sharedA.Close()
+	defer sharedB.Close()
+
+	ctx := context.Background()
+	first := storage.NewResilientCache(sharedA, log.New(io.Discard, "", 0))
+	second := storage.NewResilientCache(sharedB, log.New(io.Discard, "", 0))
+	if err := first.SetValueFor(ctx, "instances:test", []byte("value"), time.Minute); err != nil {
+		t.Log("Set value error", err)
+		t.Fail()
+	} else if value, err := second.GetValue(ctx, "instances:test"); err != nil || string(value) != "value" {
+		t.Log("value should be shared", err)
+		t.Fail()
+	} else if err := second.Delete(ctx, "instances:test"); err != nil {
+		t.Log("Failed to delete", err)
+		t.Fail()
+	} else if _, err := first.GetValue(ctx, "instances:test"); err != storage.ErrCacheMiss {
+		t.Log("deleted value still in cache of other instance", err)
+		t.Fail()
+	} else if found, err := first.Has(ctx, "instances:test"); err != nil || found {
+		t.Log("deleted value still in cache of other instance", err)
+		t.Fail()
+	}
+}
+
+func TestMemoryCacheFixedWindow(t *testing.T) {
+	cache := storage.NewMemoryCache()
+	ctx := context.Background()
+	if counter, _ := cache.Increment(ctx, "window", 50*time.Millisecond); counter != 1 {
+		t.Log("expecting 1, got", counter)
+		t.Fail()
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if counter, _ := cache.Increment(ctx, "window", 50*time.Millisecond); counter != 2 {
+		t.Log("expecting 2, got", counter)
+		t.Fail()
+	}
+
+	// window started at first increment, and is not extended by the second one
+	time.Sleep(30 * time.Millisecond)
+	if counter, _ := cache.Increment(ctx, "window", 50*time.Millisecond); counter != 1 {
+		t.Log("counter should restart after the window, got", counter)
+		t.Fail()
+	}
+}
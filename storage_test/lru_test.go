@@ -0,0 +1,53 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zefrenchwan/scrutateur.git/storage"
+)
+
+func TestLRUEviction(t *testing.T) {
+	cache := storage.NewLRUCache(2, time.Minute)
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	// a is now the most recently used, b is evicted
+	if value, found := cache.Get("a"); !found || value.(int) != 1 {
+		t.Log("expected a value for a")
+		t.Fail()
+	}
+
+	cache.Set("c", 3)
+	if _, found := cache.Get("b"); found {
+		t.Log("least recently used value not evicted")
+		t.Fail()
+	} else if _, found := cache.Get("a"); !found {
+		t.Log("recently used value evicted")
+		t.Fail()
+	} else if cache.Len() != 2 {
+		t.Log("expected 2 values, got", cache.Len())
+		t.Fail()
+	}
+
+	cache.Delete("a")
+	if _, found := cache.Get("a"); found {
+		t.Log("deleted value found")
+		t.Fail()
+	}
+
+	cache.Clear()
+	if cache.Len() != 0 {
+		t.Log("cleared cache has values")
+		t.Fail()
+	}
+}
+
+func TestLRUExpiration(t *testing.T) {
+	cache := storage.NewLRUCache(10, 10*time.Millisecond)
+	cache.Set("a", 1)
+	time.Sleep(20 * time.Millisecond)
+	if _, found := cache.Get("a"); found {
+		t.Log("expired value found")
+		t.Fail()
+	}
+}
@@ -0,0 +1,68 @@
+package storage_test
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/zefrenchwan/scrutateur.git/storage"
+)
+
+func TestPasswordHashing(t *testing.T) {
+	for _, algorithm := range []string{storage.HASHING_ARGON2ID, storage.HASHING_BCRYPT} {
+		hasher, errHasher := storage.NewPasswordHasher(algorithm)
+		if errHasher != nil {
+			t.Log(algorithm, "failed to create hasher", errHasher)
+			t.FailNow()
+		}
+
+		if hash, err := hasher.Hash("secret"); err != nil {
+			t.Log(algorithm, "failed to hash", err)
+			t.Fail()
+		} else if other, _ := hasher.Hash("secret"); other == hash {
+			t.Log(algorithm, "hashes should be salted")
+			t.Fail()
+		} else if valid, rehash, err := hasher.Verify([]byte(hash), "secret"); err != nil || !valid || rehash {
+			t.Log(algorithm, "failed to verify hash", err)
+			t.Fail()
+		} else if valid, _, err := hasher.Verify([]byte(hash), "other"); err != nil || valid {
+			t.Log(algorithm, "wrong password accepted", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestArgon2PHCFormat(t *testing.T) {
+	hasher, _ := storage.NewPasswordHasher("")
+	if hash, err := hasher.Hash("secret"); err != nil {
+		t.Log("failed to hash", err)
+		t.Fail()
+	} else if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Log("unexpected PHC string", hash)
+		t.Fail()
+	} else if valid, _, err := hasher.Verify([]byte(hash[:len(hash)-2]), "secret"); err == nil && valid {
+		t.Log("truncated hash accepted")
+		t.Fail()
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	argon, _ := storage.NewPasswordHasher(storage.HASHING_ARGON2ID)
+	bcrypt, _ := storage.NewPasswordHasher(storage.HASHING_BCRYPT)
+	legacy := sha256.Sum256([]byte("secret"))
+	bcryptHash, _ := bcrypt.Hash("secret")
+
+	if valid, rehash, err := argon.Verify(legacy[:], "secret"); err != nil || !valid || !rehash {
+		t.Log("legacy hash should be valid and replaced", err)
+		t.Fail()
+	} else if valid, rehash, err := argon.Verify(legacy[:], "other"); err != nil || valid || rehash {
+		t.Log("legacy hash accepted wrong password", err)
+		t.Fail()
+	} else if valid, rehash, err := argon.Verify([]byte(bcryptHash), "secret"); err != nil || !valid || !rehash {
+		t.Log("bcrypt hash should be valid and replaced with argon2id", err)
+		t.Fail()
+	} else if _, _, err := argon.Verify([]byte("plain"), "plain"); err == nil {
+		t.Log("unknown format should fail")
+		t.Fail()
+	}
+}